@@ -1,23 +1,196 @@
 package gtpm
 
+import "bufio"
 import "bytes"
+import "encoding/binary"
+import "encoding/hex"
+import "hash/crc32"
+import "context"
+import "encoding/json"
+import "errors"
 import "fmt"
 import "io"
+import "io/fs"
+import "iter"
+import "log/slog"
+import "math"
+import "os"
+import "regexp"
 import "strconv"
 import "strings"
+import "sync"
+import "unicode"
 
 type (
 	// Matcher is the interface that tries to match given Reader against a rule
 	Matcher interface {
 		// MatchReader returns matched if given Reader match a rule
 		MatchReader(io.Reader) (matched [][]byte, err error)
+		// MatchBytes returns matched if given bytes match a rule
+		MatchBytes([]byte) (matched [][]byte, err error)
 	}
 	// TextPatternMatcher implements Matcher with Text Pattern Matching(DSL)
 	TextPatternMatcher struct {
-		instSlice  []instruction
-		intBinds   []int
-		maxVarSize int
+		options
+		// pattern is the source of instSlice.
+		pattern   string
+		instSlice []inst
+		// intBinds holds the initial values of int binds copied to each matchState.
+		intBinds []int
+		// floatBinds is the number of float binds.
+		floatBinds int
+		// externals maps integer variables given by WithExternalInts to their int binds.
+		externals map[string]int
+		// mu guards lastFrame, consumed and lastAudit.
+		mu        sync.Mutex
+		lastFrame []byte
+		consumed  int
+		lastAudit []ConstRecord
+		// pool holds the MatchStates released to be acquired again.
+		pool sync.Pool
 	}
+	// MatchState is the per-call state of a match which can be reused across matches.
+	// Acquire it by TextPatternMatcher.Acquire and give it back by Release.
+	MatchState struct {
+		tpm   *TextPatternMatcher
+		s     matchState
+		binds [][]byte
+	}
+	// options holds the settings given by Option.
+	options struct {
+		maxVarSize   int
+		eofOnEmpty   bool
+		binIntAuto   bool
+		growth       float64
+		captureFrame bool
+		logger       *slog.Logger
+		skipBOM      bool
+		hexInput     bool
+		transform    func(name string, b []byte) ([]byte, error)
+		skipEmpty    bool
+		maxDepth     int
+		maxCaptures  int
+		alloc        func(size int) []byte
+		maxZeroReads int
+		intDigits    string
+		singleRecord bool
+		maxLookahead int
+		packed       bool
+		byteCounter  bool
+		resyncWindow int
+		nilEmpty     bool
+		externalInts []string
+		maxVars      int
+		trimSpace    bool
+		budget       int
+		constReadErr bool
+		recordSep    []byte
+		canonical    bool
+		zeroCopy     bool
+		spillSize    int
+		spillDir     string
+		offsets      bool
+		maxRetries   int
+		strict       bool
+		audit        bool
+		foldSkips    bool
+		// err is the error of an option given an invalid value which compile returns.
+		err error
+	}
+	// spec is the portable form of a compiled matcher encoded by MarshalSpec.
+	spec struct {
+		Version           int        `json:"version"`
+		Pattern           string     `json:"pattern"`
+		MaxVariableSize   int        `json:"max_variable_size"`
+		GrowthFactor      float64    `json:"growth_factor"`
+		EOFOnEmpty        bool       `json:"eof_on_empty,omitempty"`
+		BinaryIntFallback bool       `json:"binary_int_fallback,omitempty"`
+		CaptureFrame      bool       `json:"capture_frame,omitempty"`
+		SkipBOM           bool       `json:"skip_bom,omitempty"`
+		HexInput          bool       `json:"hex_input,omitempty"`
+		SkipEmptyCaptures bool       `json:"skip_empty_captures,omitempty"`
+		MaxExpansionDepth int        `json:"max_expansion_depth,omitempty"`
+		MaxCaptures       int        `json:"max_captures,omitempty"`
+		MaxZeroReads      int        `json:"max_zero_reads,omitempty"`
+		IntDigits         string     `json:"int_digits,omitempty"`
+		SingleRecord      bool       `json:"single_record,omitempty"`
+		MaxLookahead      int        `json:"max_lookahead,omitempty"`
+		PackedCaptures    bool       `json:"packed_captures,omitempty"`
+		ByteCounter       bool       `json:"byte_counter,omitempty"`
+		ResyncWindow      int        `json:"resync_window,omitempty"`
+		NilEmptyCaptures  bool       `json:"nil_empty_captures,omitempty"`
+		ExternalInts      []string   `json:"external_ints,omitempty"`
+		MaxVariables      int        `json:"max_variables,omitempty"`
+		TrimTrailingSpace bool       `json:"trim_trailing_space,omitempty"`
+		CaptureBudget     int        `json:"capture_budget,omitempty"`
+		ConstReadFailed   bool       `json:"const_read_failed,omitempty"`
+		RecordSeparator   []byte     `json:"record_separator,omitempty"`
+		Canonicalize      bool       `json:"canonicalize,omitempty"`
+		ZeroCopyCaptures  bool       `json:"zero_copy_captures,omitempty"`
+		SpillThreshold    int        `json:"spill_threshold,omitempty"`
+		SpillDir          string     `json:"spill_dir,omitempty"`
+		Offsets           bool       `json:"offsets,omitempty"`
+		MaxRetries        int        `json:"max_retries,omitempty"`
+		StrictGrammar     bool       `json:"strict_grammar,omitempty"`
+		ConstAudit        bool       `json:"const_audit,omitempty"`
+		FoldSkips         bool       `json:"fold_skips,omitempty"`
+		Insts             []specInst `json:"insts"`
+	}
+	// specInst is the metadata of an instruction in spec.
+	specInst struct {
+		Kind  instKind `json:"kind"`
+		Pos   int      `json:"pos"`
+		Name  string   `json:"name,omitempty"`
+		Min   int      `json:"min"`
+		Fixed bool     `json:"fixed,omitempty"`
+		Ref   bool     `json:"ref,omitempty"`
+		Depth int      `json:"depth,omitempty"`
+	}
+	// PatternError reports the pattern failed to compile by CompileAll.
+	PatternError struct {
+		// Index is the index of the pattern.
+		Index int
+		// Err is the error returned by Compile.
+		Err error
+	}
+	// MatchResult holds the captures and the values of integer variables by name.
+	// A variable bound more than once like in a repetition has the last one.
+	MatchResult struct {
+		Bytes map[string][]byte
+		Ints  map[string]int
+		// Offsets holds the offsets of the start and the end of the captures within the bytes consumed
+		// if the matcher is compiled with WithOffsets.
+		Offsets map[string][2]int
+	}
+	// FieldSpec describes an instruction of a compiled pattern.
+	FieldSpec struct {
+		// Name is the name of the variable bound if any.
+		Name string
+		// Kind is the kind of the instruction like "const", "blind", "bin", "int" or "float".
+		Kind string
+		// FixedSize is the number of bytes consumed if it's fixed or 0 otherwise.
+		FixedSize int
+		// Suffix is the const terminating the variable if any.
+		Suffix []byte
+	}
+	// ConstRecord records a const matched.
+	ConstRecord struct {
+		// Pos is the position of the const in the pattern.
+		Pos int
+		// Offset is the offset of the const within the bytes consumed.
+		Offset int
+		// Bytes is the bytes matched.
+		Bytes []byte
+	}
+	// CheckCase is an input and the result expected by Check.
+	CheckCase struct {
+		In   []byte
+		Want [][]byte
+		// Err is the error expected which is compared by errors.Is if not nil.
+		Err error
+	}
+	// Errors holds errors reported together like references to variables not defined.
+	Errors []Error
 	// ErrorCode includes an error description.
 	ErrorCode string
 	// Error holds information related to an error.
@@ -31,28 +204,236 @@ type (
 	}
 	// Option defines a functional parameter.
 	Option      func(*TextPatternMatcher)
-	instruction func(io.Reader) ([]byte, error)
-	parseState  int
+	instruction func(*matchState) ([]byte, error)
+	// inst is an instruction with metadata about the token it was compiled from.
+	inst struct {
+		kind instKind
+		pos  int
+		// name is the name of the variable bound by exec if any.
+		name string
+		// out is the index of the int bind set by exec if kind is intKind
+		// or the float bind if kind is floatKind or the instruction jumped to if kind is jumpKind
+		// or the last instruction of the branch if kind is ifKind.
+		out  int
+		exec instruction
+		// min is the minimum number of bytes exec consumes.
+		min int
+		// fixed is true if exec always consumes exactly min bytes.
+		fixed bool
+		// lit is the bytes exec matches if kind is constKind or an example of them if any otherwise.
+		lit []byte
+		// suffix is the const terminating the variable bound by exec if any.
+		suffix []byte
+		// ref is true if the bytes bound by exec are referenced by a later instruction.
+		ref bool
+		// modifier is how the variable terminated by suffix is modified like "!", "\"", "~64" or "<=64" if any.
+		modifier string
+		// depth is the number of repetitions enclosing this instruction.
+		depth int
+	}
+	// hexReader decodes a hex dump read from r skipping white spaces.
+	hexReader struct {
+		r   io.Reader
+		raw []byte
+		// hi holds the upper nibble of the byte being decoded if half is true.
+		hi   byte
+		half bool
+		err  error
+	}
+	// Scanner matches records in a stream one after another.
+	Scanner struct {
+		m *TextPatternMatcher
+		r io.Reader
+		// pending holds bytes read from r but not consumed by records yet.
+		pending []byte
+		marker  []byte
+		record  [][]byte
+		err     error
+		ints    map[string]int
+		// separate is true if a record separator must precede the next record.
+		separate bool
+	}
+	// recordReader records the bytes read from r.
+	recordReader struct {
+		r   io.Reader
+		buf []byte
+	}
+	// peekReader reads buf and then r.
+	peekReader struct {
+		buf []byte
+		r   io.Reader
+	}
+	instKind   string
+	parseState int
+	// matchState holds the state of a single MatchReader call.
+	matchState struct {
+		r io.Reader
+		// peeked holds bytes read ahead and given back by unread.
+		peeked []byte
+		// n is the number of bytes consumed so far.
+		n int
+		// vars holds the bytes bound by referenced instructions indexed by the instruction.
+		vars [][]byte
+		// ints holds the values of int binds.
+		ints []int
+		// floats holds the values of float binds.
+		floats []float64
+		// pc is the index of the instruction being run.
+		// Instructions controlling repetitions jump by setting it.
+		pc int
+		// start is the number of bytes consumed before the instruction being run.
+		start int
+		// frame holds the bytes consumed so far if recorded.
+		frame       []byte
+		recordFrame bool
+		// intValues collects the values of int binds by name if not nil.
+		intValues map[string][]int
+		// floatValues collects the values of float binds by name if not nil.
+		floatValues map[string][]float64
+		// lineEnding is the terminator of the last line bound and
+		// lineEndings collects them by name if not nil.
+		lineEnding  string
+		lineEndings map[string][]string
+		// alloc allocates buffers for captures if not nil.
+		alloc func(size int) []byte
+		// zeroReads is the number of consecutive reads of r which returned nothing without error.
+		zeroReads    int
+		maxZeroReads int
+		// intDigits is the digits of integer variables in order of their values if not empty.
+		intDigits string
+		// maxLookahead is the maximum number of bytes read ahead speculatively if positive.
+		maxLookahead int
+		// arena is the slab buffers for captures are cut from if captures are packed.
+		arena []byte
+		// input is the whole input if captures are its subslices
+		// and then scratch is the buffer reused by every instruction.
+		input   []byte
+		scratch []byte
+		// src is the input given by MatchBytes which r reads
+		// so that instructions can index it directly instead of reading r.
+		src []byte
+		// spill is true if fixed-size variables larger than spillSize are written to temp files in spillDir
+		// and then spilled holds the path of the file written by the current instruction.
+		spill     bool
+		spillSize int
+		spillDir  string
+		spilled   string
+		// span holds the offsets of the start and the end of the capture of the current instruction
+		// within the bytes consumed if spans is true.
+		spans bool
+		span  [2]int
+		// capStart is the offset where the capture of the current instruction starts, which is start
+		// unless the instruction sets it, or -1 if the capture isn't the bytes consumed but made of them
+		// like the index of an alternation.
+		capStart int
+		// audit holds the consts matched if the matcher is compiled with WithConstAudit.
+		audit []ConstRecord
+		// retries is the number of reads retried on temporary errors out of maxRetries.
+		retries    int
+		maxRetries int
+		// ctx aborts the match once it's done if it can be.
+		ctx context.Context
+		// reads counts reads to check ctx every ctxCheckInterval reads.
+		reads int
+	}
 )
 
 const (
-	defaultInstCap    = 8
-	defaultMaxVarSize = 4096
+	defaultInstCap      = 8
+	defaultMaxVarSize   = 4096
+	defaultGrowth       = 2
+	specVersion         = 1
+	defaultArenaSize    = 256
+	defaultResyncWindow = 4096
+	ctxCheckInterval    = 256
 )
 
 const (
 	ErrConstNotMuch     = "gtpm: const not matched"
+	ErrConstReadFailed  = "gtpm: reading const failed"
 	ErrVarNotMuch       = "gtpm: variable not matched"
 	ErrVarExceedMaxSize = "gtpm: variable size exceeded the maximum: %d"
 	ErrIntVarNotMuch    = "gtpm: integer variable not matched"
+	ErrFloatVarNotMuch  = "gtpm: float variable not matched"
+	ErrAltNotMuch       = "gtpm: none of alternatives matched"
+	ErrVarPadded        = "gtpm: variable filled with the pad byte: 0x%02x"
+	ErrSuffixEmpty      = "gtpm: suffix bound to a variable is empty"
+	ErrFrameOverrun     = "gtpm: frame length is less than the bytes consumed: %d"
+	ErrCaptureTransform = "gtpm: capture transform failed"
+	ErrVarRequired      = "gtpm: required variable is empty: %s"
+	ErrNetstringNotMuch = "gtpm: netstring not matched"
+	ErrRepOverrun       = "gtpm: repetition overran the length: %d"
+	ErrRepNoProgress    = "gtpm: repetition consumed nothing"
+	ErrNoProgress       = "gtpm: reader returned nothing too many times in a row"
+	ErrNotEOF           = "gtpm: input continues after the record"
+	ErrLookaheadTooLong = "gtpm: lookahead exceeded the maximum: %d"
+	ErrNestNotMuch      = "gtpm: balanced brackets not matched"
+	ErrResyncWindow     = "gtpm: not matched within the resync window: %d"
+	ErrCaptureBudget    = "gtpm: captures exceeded the total budget: %d"
+	ErrSizeNotFound     = "gtpm: no size for the discriminator: %d"
+	ErrCaptureCallback  = "gtpm: capture callback failed"
+	ErrSeparatorNotMuch = "gtpm: record separator not matched"
+	ErrSpillFailed      = "gtpm: spilling variable to a file failed"
+	ErrCheckMismatch    = "gtpm: check case %d: got %q %v, want %q %v"
+	ErrIntNotEqual      = "gtpm: integer not equal to the expected: %d"
+	ErrVarNotEqual      = "gtpm: variable not equal to %s"
+	ErrNoSample         = "gtpm: no sample matching the pattern generated"
+	ErrVarNotBound      = "gtpm: variable not bound: %s"
+	ErrCanceled         = "gtpm: match canceled"
+	ErrNotRegexp        = "gtpm: %s can't be translated into a regexp"
+)
+
+const (
+	ErrSpecInvalid      = "gtpm: spec invalid"
+	ErrSpecVersion      = "gtpm: spec version not supported: %d"
+	ErrSpecInstMismatch = "gtpm: spec instruction mismatched"
+	ErrResultsInvalid   = "gtpm: results invalid"
+	ErrInvalidByteSize  = "gtpm: invalid byte size: %q"
 )
 
 const (
 	ErrParseColonExpected      = "gtpm: parse error. ':' expected"
 	ErrParseVariableNotDefined = "gtpm: parse error. variable: %s not defined"
 	ErrParseSuffixExpected     = "gtpm: parse error. suffix expected"
+	ErrParseSuffixExpectedFor  = "gtpm: parse error. suffix expected for variable: %s. give it a fixed size like \"%s:12\" or follow it with a suffix"
 	ErrParseInvalidSlash       = "gtpm: parse error. '/' appeared more than onece"
 	ErrParseInvalidType        = "gtpm: parse error. \"bin\" or \"int\" should appear after '/'"
+	ErrParseInvalidPad         = "gtpm: parse error. pad byte must be a hex number"
+	ErrParseInvalidAlign       = "gtpm: parse error. alignment must be a positive integer"
+	ErrParseInvalidRest        = "gtpm: parse error. \"rest\" or \"rest-N\" expected"
+	ErrParseBraceExpected      = "gtpm: parse error. '}' expected"
+	ErrParseInvalidLimit       = "gtpm: parse error. limit must be a positive integer up to the max variable size like \"~64\" or \"<=64\""
+	ErrExpansionTooDeep        = "gtpm: parse error. repetitions nested deeper than the maximum: %d"
+	ErrTooManyVariables        = "gtpm: parse error. variables defined more than the maximum: %d"
+	ErrParseStrict             = "gtpm: parse error. not allowed in the strict grammar: %s"
+	ErrParseZeroWidthInt       = "gtpm: parse error. integer variable must be at least 1 byte wide like \"var/int:1\""
+	ErrParseInvalidExpected    = "gtpm: parse error. expected integer must be a decimal like \"=/int:42\""
+	ErrParseInvalidSizeTable   = "gtpm: parse error. size table must be like \"Type[1=4|2=8]\""
+	ErrParseInvalidSize        = "gtpm: parse error. size: %s must be a non-negative integer or an integer variable"
+	ErrParseInvalidRequired    = "gtpm: parse error. '!' is allowed only for a variable followed by a suffix like \"var/bin!\""
+	ErrParseInvalidUntilEOF    = "gtpm: parse error. '?' is allowed only for a variable followed by a suffix like \"var/bin?\""
+	ErrParseInvalidBrackets    = "gtpm: parse error. a pair of distinct brackets like \"()\" expected"
+	ErrParseInvalidSeparators  = "gtpm: parse error. a pair of distinct separators like \"=&\" expected"
+)
+
+const (
+	constKind instKind = "const"
+	blindKind instKind = "blind"
+	binKind   instKind = "bin"
+	intKind   instKind = "int"
+	floatKind instKind = "float"
+	lineKind  instKind = "line"
+	eofKind   instKind = "eof"
+	nzKind    instKind = "nz"
+	altKind   instKind = "alt"
+	optKind   instKind = "opt"
+	repKind   instKind = "rep"
+	bomKind   instKind = "bom"
+	frameKind instKind = "frame"
+	endKind   instKind = "end"
+	alignKind instKind = "align"
+	ifKind    instKind = "if"
+	jumpKind  instKind = "jump"
 )
 
 const (
@@ -60,6 +441,9 @@ const (
 	blindParseState
 	binParseState
 	intParseState
+	fixedParseState
+	repParseState
+	pairsParseState
 )
 
 func (e Error) Error() string {
@@ -69,258 +453,3369 @@ func (e Error) Error() string {
 	return fmt.Sprintf("%s at %d", e.Code, e.Pos)
 }
 
-func WithMaxVariableSize(max int) Option {
-	return func(tpm *TextPatternMatcher) {
-		tpm.maxVarSize = max
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
 	}
+	return strings.Join(msgs, "\n")
 }
 
-func Compile(pattern string, opts ...Option) (Matcher, error) {
-	matcher := &TextPatternMatcher{}
-	for _, opt := range opts {
-		opt(matcher)
+// Unwrap returns the errors so that errors.Is and errors.As can inspect them.
+func (e Errors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
 	}
-	if matcher.instSlice == nil {
-		matcher.instSlice = make([]instruction, 0, defaultInstCap)
+	return errs
+}
+
+func (e PatternError) Error() string {
+	return fmt.Sprintf("gtpm: pattern %d: %v", e.Index, e.Err)
+}
+
+// Unwrap returns the error returned by Compile.
+func (e PatternError) Unwrap() error {
+	return e.Err
+}
+
+// Unwrap returns the cause of this error.
+func (e Error) Unwrap() error {
+	return e.Cause
+}
+
+// RawCause returns the deepest cause of err which is not an Error,
+// typically the error returned by the underlying reader.
+// It returns nil if err was not caused by any other error.
+func RawCause(err error) error {
+	var e Error
+	for errors.As(err, &e) {
+		err = e.Cause
 	}
-	if matcher.maxVarSize == 0 {
-		matcher.maxVarSize = defaultMaxVarSize
+	return err
+}
+
+// isTemporary reports whether err is temporary like a network timeout.
+func isTemporary(err error) bool {
+	var t interface{ Temporary() bool }
+	return errors.As(err, &t) && t.Temporary()
+}
+
+func (s *matchState) Read(p []byte) (int, error) {
+	if s.ctx != nil {
+		if s.reads++; s.reads%ctxCheckInterval == 0 && s.ctx.Err() != nil {
+			return 0, s.ctx.Err()
+		}
 	}
-	r := bytes.NewBufferString(pattern)
-	intBindsMap := make(map[string]int)
-	var state parseState
-	pos := 1
-	var name string
-	for {
-		rawLine, err := r.ReadString(',')
-		if err != nil && err != io.EOF {
-			return nil, err
+	if len(s.peeked) > 0 {
+		n := copy(p, s.peeked)
+		s.peeked = s.peeked[n:]
+		s.n += n
+		if s.recordFrame {
+			s.frame = append(s.frame, p[:n]...)
 		}
-		// trim the last ','
-		var line string
-		if rawLine[len(rawLine)-1] == ',' {
-			line = rawLine[:len(rawLine)-1]
-		} else {
-			line = rawLine
+		return n, nil
+	}
+	n, err := s.r.Read(p)
+	for n == 0 && err != nil && s.retries < s.maxRetries && isTemporary(err) {
+		s.retries++
+		n, err = s.r.Read(p)
+	}
+	if n > 0 && err != nil && s.maxRetries > 0 && isTemporary(err) {
+		// the error is left to the subsequent read which may retry
+		err = nil
+	}
+	if n == 0 && err == nil && len(p) > 0 {
+		if s.zeroReads++; s.maxZeroReads > 0 && s.zeroReads >= s.maxZeroReads {
+			return 0, io.ErrNoProgress
 		}
-		// 1. blind(unbind) (start with '_')
-		//   - "_" # the subsequent block must be const
-		//   - "_:12"
-		//   - "_:Number" # Number is an integer variable
-		// 2. bind binary variable
-		//   - "var/bin" # the subsequent block must be const
-		//   - "var/bin:12"
-		//   - "var/bin:Number" # Number is an integer variable
-		// 3. bind integer variable
-		//   - "var/int" # the subsequent block must be const
-		//   - "var/int:12"
-		//   - "var/int:Number" # Number is an integer variable
-		// 4. const (arbitrary bytes: not matched with any rule)
-		//   - suffix for the above types
-		//     - "_, suffix"
-		//     - "var/bin, suffix"
-		//     - "var/int, suffix"
-		//   - or pure const
-		if line[0] == '_' {
-			// blind
-			if len(line) == 1 {
-				// "_"
-				state = blindParseState
-			} else {
-				tokens := strings.Split(line, ":")
-				if len(tokens) != 2 {
-					return nil, Error{Code: ErrParseColonExpected, Pos: pos}
-				}
-				n, err := strconv.ParseInt(tokens[1], 10, 64)
-				if err == nil {
-					// "_:12"
-					matcher.intBinds = append(matcher.intBinds, int(n))
-					matcher.instSlice = append(matcher.instSlice, genInstVarWithSize(pos, &matcher.intBinds[len(matcher.intBinds)-1], false))
-				} else {
-					// "_:Number"
-					idx, ok := intBindsMap[tokens[1]]
-					if !ok {
-						return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrParseVariableNotDefined, tokens[1])), Pos: pos}
-					}
-					matcher.instSlice = append(matcher.instSlice, genInstVarWithSize(pos, &matcher.intBinds[idx], false))
-				}
+	} else {
+		s.zeroReads = 0
+	}
+	s.n += n
+	if s.recordFrame {
+		s.frame = append(s.frame, p[:n]...)
+	}
+	return n, err
+}
+
+func (p *peekReader) Read(b []byte) (int, error) {
+	if len(p.buf) > 0 {
+		n := copy(b, p.buf)
+		p.buf = p.buf[n:]
+		return n, nil
+	}
+	return p.r.Read(b)
+}
+
+func (h *hexReader) Read(p []byte) (int, error) {
+	var n int
+	for n == 0 && len(p) > 0 {
+		if h.err != nil {
+			return 0, h.err
+		}
+		// every two hex digits read decode into one byte so that p never overflows.
+		if l := 2 * len(p); cap(h.raw) < l {
+			h.raw = make([]byte, l)
+		}
+		m, err := h.r.Read(h.raw[:2*len(p)])
+		for _, c := range h.raw[:m] {
+			switch c {
+			case ' ', '\t', '\r', '\n':
+				continue
 			}
-		} else if strings.Contains(line, "/") {
-			// bind binary|integer
-			tokens := strings.Split(line, "/")
-			if len(tokens) != 2 {
-				return nil, Error{Code: ErrParseInvalidSlash, Pos: pos}
+			v, ok := fromHexChar(c)
+			if !ok {
+				h.err = hex.InvalidByteError(c)
+				return n, h.err
 			}
-			if len(tokens[1]) < 3 {
-				return nil, Error{Code: ErrParseInvalidType, Pos: pos}
+			if h.half {
+				p[n] = h.hi<<4 | v
+				n++
+			} else {
+				h.hi = v
 			}
-			switch tokens[1][:3] {
-			case "bin":
-				subTokens := strings.Split(tokens[1], ":")
-				if subTokens[0] != "bin" {
-					return nil, Error{Code: ErrParseInvalidType, Pos: pos}
-				}
-				if len(subTokens) == 2 {
-					n, err := strconv.ParseInt(subTokens[1], 10, 64)
-					if err == nil {
-						//   - "var/bin:12"
-						matcher.intBinds = append(matcher.intBinds, int(n))
-						matcher.instSlice = append(matcher.instSlice, genInstVarWithSize(pos, &matcher.intBinds[len(matcher.intBinds)-1], true))
-					} else {
-						//   - "var/bin:Number"
-						idx, ok := intBindsMap[subTokens[1]]
-						if !ok {
-							return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrParseVariableNotDefined, subTokens[1])), Pos: pos}
-						}
-						matcher.instSlice = append(matcher.instSlice, genInstVarWithSize(pos, &matcher.intBinds[idx], true))
-					}
-				} else {
-					//   - "var/bin"
-					state = binParseState
-				}
-			case "int":
-				subTokens := strings.Split(tokens[1], ":")
-				if subTokens[0] != "int" {
-					return nil, Error{Code: ErrParseInvalidType, Pos: pos}
-				}
-				if len(subTokens) == 2 {
-					n, err := strconv.ParseInt(subTokens[1], 10, 64)
-					if err == nil {
-						//   - "var/int:12"
-						matcher.intBinds = append(matcher.intBinds, int(n))
-						matcher.intBinds = append(matcher.intBinds, 0)
-						intBindsMap[tokens[0]] = len(matcher.intBinds) - 1
-						matcher.instSlice = append(matcher.instSlice, genInstIntWithSize(pos, &matcher.intBinds[len(matcher.intBinds)-2], &matcher.intBinds[len(matcher.intBinds)-1]))
-					} else {
-						//   - "var/int:Number"
-						idx, ok := intBindsMap[subTokens[1]]
-						if !ok {
-							return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrParseVariableNotDefined, subTokens[1])), Pos: pos}
-						}
-						matcher.intBinds = append(matcher.intBinds, 0)
-						intBindsMap[tokens[0]] = len(matcher.intBinds) - 1
-						matcher.instSlice = append(matcher.instSlice, genInstIntWithSize(pos, &matcher.intBinds[idx], &matcher.intBinds[len(matcher.intBinds)-1]))
-					}
-				} else {
-					//   - "var/int"
-					name = tokens[0]
-					state = intParseState
-				}
-			default:
-				return nil, Error{Code: ErrParseInvalidType, Pos: pos}
+			h.half = !h.half
+		}
+		if err != nil {
+			if err == io.EOF && h.half {
+				err = io.ErrUnexpectedEOF
 			}
-		} else if state != nonParseState {
-			// suffix for blind/binary|integer
-			switch state {
-			case blindParseState:
-				// blind
-				// "_, suffix"
-				matcher.instSlice = append(matcher.instSlice, genInstVarWithoutSize(pos, []byte(line), false, matcher.maxVarSize))
-			case binParseState:
-				// binary
-				// "var/bin, suffix"
-				matcher.instSlice = append(matcher.instSlice, genInstVarWithoutSize(pos, []byte(line), true, matcher.maxVarSize))
-			case intParseState:
-				// integer
-				// "var/int, suffix"
-				matcher.intBinds = append(matcher.intBinds, 0)
-				intBindsMap[name] = len(matcher.intBinds) - 1
-				matcher.instSlice = append(matcher.instSlice, genInstIntWithoutSize(pos, []byte(line), &matcher.intBinds[len(matcher.intBinds)-1], matcher.maxVarSize))
+			h.err = err
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// fromHexChar returns the value of the hex digit c.
+func fromHexChar(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+func (rr *recordReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.buf = append(rr.buf, p[:n]...)
+	return n, err
+}
+
+// remaining returns the number of bytes left until EOF if the reader is an io.Seeker.
+func (s *matchState) remaining() (int, bool) {
+	sk, ok := s.r.(io.Seeker)
+	if !ok {
+		return 0, false
+	}
+	cur, err := sk.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, false
+	}
+	end, err := sk.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, false
+	}
+	if _, err := sk.Seek(cur, io.SeekStart); err != nil {
+		return 0, false
+	}
+	return int(end-cur) + len(s.peeked), true
+}
+
+// bufReader returns the underlying reader if it's a *bufio.Reader
+// and no bytes given back by unread are left so that it can be read directly.
+// It's never read directly if reads are retried, which only Read does.
+func (s *matchState) bufReader() (*bufio.Reader, bool) {
+	br, ok := s.r.(*bufio.Reader)
+	return br, ok && len(s.peeked) == 0 && s.maxRetries == 0
+}
+
+// readSlice reads br up to delim by ReadSlice counting the bytes consumed as Read does.
+func (s *matchState) readSlice(br *bufio.Reader, delim byte) ([]byte, error) {
+	line, err := br.ReadSlice(delim)
+	s.n += len(line)
+	if s.recordFrame {
+		s.frame = append(s.frame, line...)
+	}
+	return line, err
+}
+
+// rest returns the bytes of src not read yet if r reads src and no bytes given back by unread are left.
+func (s *matchState) rest() ([]byte, bool) {
+	br, ok := s.r.(*bytes.Reader)
+	if !ok || s.src == nil || len(s.peeked) > 0 {
+		return nil, false
+	}
+	return s.src[len(s.src)-br.Len():], true
+}
+
+// consume advances r over b, the head of the bytes returned by rest, counting them as Read does.
+func (s *matchState) consume(b []byte) {
+	s.r.(*bytes.Reader).Seek(int64(len(b)), io.SeekCurrent)
+	s.n += len(b)
+	if s.recordFrame {
+		s.frame = append(s.frame, b...)
+	}
+}
+
+// newBuf returns a buffer of size bytes for a capture.
+func (s *matchState) newBuf(size int) []byte {
+	if s.input != nil {
+		if s.scratch == nil || cap(s.scratch) < size {
+			// never nil so that empty captures aren't taken for no capture
+			s.scratch = make([]byte, size)
+		}
+		return s.scratch[:size]
+	}
+	if s.alloc != nil {
+		return s.alloc(size)[:size]
+	}
+	if s.arena != nil {
+		if cap(s.arena)-len(s.arena) < size {
+			s.arena = make([]byte, 0, max(size, 2*cap(s.arena)))
+		}
+		buf := s.arena[len(s.arena) : len(s.arena)+size : len(s.arena)+size]
+		s.arena = s.arena[:len(s.arena)+size]
+		return buf
+	}
+	return make([]byte, size)
+}
+
+// spillVar writes size bytes to a temp file recording its path in spilled
+// and returns an empty capture standing for it.
+func (s *matchState) spillVar(pos int, size int) ([]byte, error) {
+	f, err := os.CreateTemp(s.spillDir, "gtpm-")
+	if err != nil {
+		return nil, Error{Code: ErrSpillFailed, Pos: pos, Cause: err}
+	}
+	_, err = io.CopyN(f, s, int64(size))
+	if cerr := f.Close(); err == nil && cerr != nil {
+		err = Error{Code: ErrSpillFailed, Pos: pos, Cause: cerr}
+	} else if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		err = Error{Code: ErrVarNotMuch, Pos: pos, Cause: err}
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	s.spilled = f.Name()
+	s.capStart = -1
+	return []byte{}, nil
+}
+
+// alias returns the subslice of the bytes consumed by the current instruction buf was read from
+// so that buf, which may be scratch, can be reused.
+func (s *matchState) alias(buf []byte) []byte {
+	if s.capStart < 0 {
+		return append([]byte{}, buf...)
+	}
+	return s.input[s.capStart : s.capStart+len(buf) : s.capStart+len(buf)]
+}
+
+// boundVar returns the bytes bound by the ref th instruction and true
+// if it has been run in this match. It may not if it's in a branch not taken or a repetition run zero times.
+func (s *matchState) boundVar(ref int) ([]byte, bool) {
+	if ref >= len(s.vars) || s.vars[ref] == nil {
+		return nil, false
+	}
+	return s.vars[ref], true
+}
+
+// parseInt parses buf as an integer in decimal or with intDigits if given.
+func (s *matchState) parseInt(buf []byte) (int64, error) {
+	return parseIntDigits(buf, s.intDigits)
+}
+
+// parseIntDigits parses buf as an integer in decimal or with intDigits in order of their values if not empty.
+func parseIntDigits(buf []byte, intDigits string) (int64, error) {
+	if intDigits == "" {
+		return strconv.ParseInt(string(buf), 10, 64)
+	}
+	digits := buf
+	neg := len(digits) > 0 && digits[0] == '-' && strings.IndexByte(intDigits, '-') < 0
+	if neg {
+		digits = digits[1:]
+	}
+	if len(digits) == 0 {
+		return 0, &strconv.NumError{Func: "ParseInt", Num: string(buf), Err: strconv.ErrSyntax}
+	}
+	radix := int64(len(intDigits))
+	var n int64
+	for _, c := range digits {
+		d := strings.IndexByte(intDigits, c)
+		if d < 0 {
+			return 0, &strconv.NumError{Func: "ParseInt", Num: string(buf), Err: strconv.ErrSyntax}
+		}
+		if n > (math.MaxInt64-int64(d))/radix {
+			return 0, &strconv.NumError{Func: "ParseInt", Num: string(buf), Err: strconv.ErrRange}
+		}
+		n = n*radix + int64(d)
+	}
+	if neg {
+		n = -n
+	}
+	return n, nil
+}
+
+// lookaheadTooLong returns an error at pos if reading n bytes ahead exceeds maxLookahead.
+func (s *matchState) lookaheadTooLong(pos int, n int) error {
+	if s.maxLookahead > 0 && n > s.maxLookahead {
+		return Error{Code: ErrorCode(fmt.Sprintf(ErrLookaheadTooLong, s.maxLookahead)), Pos: pos}
+	}
+	return nil
+}
+
+// peek reads len(p) bytes ahead into p without consuming them.
+// If the reader is a *bufio.Reader, they're left in its buffer
+// so that nothing is read beyond the match even if the reader is shared.
+func (s *matchState) peek(p []byte) (int, error) {
+	if br, ok := s.bufReader(); ok {
+		b, err := br.Peek(len(p))
+		if err != bufio.ErrBufferFull {
+			return copy(p, b), err
+		}
+	}
+	n, err := readFull(s, p)
+	s.unread(p[:n])
+	return n, err
+}
+
+// skip consumes n bytes peeked by peek.
+func (s *matchState) skip(n int) {
+	if len(s.peeked) >= n {
+		if s.recordFrame {
+			s.frame = append(s.frame, s.peeked[:n]...)
+		}
+		s.peeked = s.peeked[n:]
+		s.n += n
+		return
+	}
+	br := s.r.(*bufio.Reader)
+	if s.recordFrame {
+		b, _ := br.Peek(n)
+		s.frame = append(s.frame, b...)
+	}
+	br.Discard(n)
+	s.n += n
+}
+
+// unread gives back b so that the subsequent Read returns it first.
+func (s *matchState) unread(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	s.peeked = append(append([]byte(nil), b...), s.peeked...)
+	s.n -= len(b)
+	if s.recordFrame {
+		s.frame = s.frame[:len(s.frame)-len(b)]
+	}
+}
+
+func WithMaxVariableSize(max int) Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.maxVarSize = max
+	}
+}
+
+// WithMaxVariableSizeBytes is WithMaxVariableSize taking the size in a human unit
+// like "512", "512B", "4KiB", "16MiB" or "1GiB" to prevent off-by-1024 mistakes.
+// Compile fails with ErrInvalidByteSize if size isn't parsed.
+func WithMaxVariableSizeBytes(size string) Option {
+	return func(tpm *TextPatternMatcher) {
+		n, err := parseByteSize(size)
+		if err != nil {
+			tpm.err = Error{Code: ErrorCode(fmt.Sprintf(ErrInvalidByteSize, size)), Cause: err}
+			return
+		}
+		tpm.maxVarSize = n
+	}
+}
+
+// WithGrowthFactor sets the factor by which the buffer for a variable terminated by a suffix grows.
+// The default is 2. A smaller factor like 1.5 copies the buffer more often but wastes less memory.
+// A factor not greater than 1 is ignored.
+func WithGrowthFactor(factor float64) Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.growth = factor
+	}
+}
+
+// WithBinaryIntFallback makes fixed size integer variables("var/int:12")
+// which aren't written in decimal to be decoded as a big-endian unsigned integer.
+// Note that this is ambiguous when the binary happens to consist of ASCII digits,
+// e.g. the 2 bytes "\x31\x32" are always decoded as 12 rather than 0x3132,
+// so only use this if the protocol guarantees such values never appear in binary.
+func WithBinaryIntFallback() Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.binIntAuto = true
+	}
+}
+
+// WithEOFOnEmpty makes MatchReader return io.EOF as is
+// when the reader has reached EOF before any byte is consumed.
+func WithEOFOnEmpty() Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.eofOnEmpty = true
+	}
+}
+
+// WithCaptureFrame makes the matcher retain the bytes consumed by a successful match
+// which can be retrieved by LastFrame.
+func WithCaptureFrame() Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.captureFrame = true
+	}
+}
+
+// WithSkipBOM makes MatchReader skip a UTF-8 or UTF-16 byte order mark at the beginning if present.
+func WithSkipBOM() Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.skipBOM = true
+	}
+}
+
+// WithHexInput makes MatchReader decode the input as a hex dump like "ca fe 0d 0a" before matching.
+// White spaces between hex digits are ignored. It's mainly useful to test patterns for binary protocols.
+func WithHexInput() Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.hexInput = true
+	}
+}
+
+// WithCaptureTransform makes MatchReader call transform with every capture and
+// the name of its variable, and return what transform returns instead.
+// Captures not bound to a variable like the index of alternatives have an empty name.
+// The match fails with ErrCaptureTransform caused by the error transform returns.
+// Variables referenced by a later variable keep the bytes before transformed.
+func WithCaptureTransform(transform func(name string, b []byte) ([]byte, error)) Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.transform = transform
+	}
+}
+
+// WithSkipEmptyCaptures makes MatchReader omit empty captures like the one by "var/bin:0".
+// By default an empty capture is returned as an empty but non-nil slice.
+func WithSkipEmptyCaptures() Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.skipEmpty = true
+	}
+}
+
+// WithMaxExpansionDepth makes Compile fail with ErrExpansionTooDeep
+// if repetitions are nested deeper than depth.
+// It guards against pathological patterns given by users. By default the depth is not limited.
+func WithMaxExpansionDepth(depth int) Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.maxDepth = depth
+	}
+}
+
+// WithMaxVariables makes Compile fail with ErrTooManyVariables
+// if the pattern defines more than n distinct variables.
+// A name used twice like in rep bodies counts once, and n <= 0 means no limit, which is the default.
+func WithMaxVariables(n int) Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.maxVars = n
+	}
+}
+
+// WithTrimPatternTrailingSpace makes Compile ignore spaces and tabs at the end of the pattern
+// which are likely added by accident to a pattern stored in a config file.
+// Line breaks are kept. It's off by default not to change the meaning of binary patterns.
+func WithTrimPatternTrailingSpace() Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.trimSpace = true
+	}
+}
+
+// WithTotalCaptureBudget makes MatchReader fail with ErrCaptureBudget
+// once the captures sum up to more than n bytes.
+// Unlike WithMaxVariableSize bounding each variable, it bounds the memory held by all of them.
+func WithTotalCaptureBudget(n int) Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.budget = n
+	}
+}
+
+// WithConstReadFailed makes MatchReader fail with ErrConstReadFailed instead of ErrConstNotMuch
+// if reading a const fails for a reason other than the input ending
+// so that callers can tell a transient I/O failure worth retrying from bad content.
+func WithConstReadFailed() Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.constReadErr = true
+	}
+}
+
+// WithRecordSeparator makes Scanner require sep between records and consume it.
+// A missing separator fails with ErrSeparatorNotMuch. The input may end with sep.
+func WithRecordSeparator(sep []byte) Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.recordSep = sep
+	}
+}
+
+// WithCanonicalizeCaptures makes MatchReader replace "\r\n" in text fields with "\n".
+// Text fields are variables terminated by a suffix like "var/bin, suffix" and lines like "var/line".
+// Binary fields whose sizes are given aren't touched.
+func WithCanonicalizeCaptures() Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.canonical = true
+	}
+}
+
+// WithZeroCopyCaptures makes MatchBytes return captures which are subslices of the input
+// instead of allocating them.
+// The captures share the memory of the input so the caller must not modify the input
+// while using the captures, and modifying a capture modifies the input.
+// It takes precedence over WithBufferAllocator and WithPackedCaptures and doesn't take effect with WithHexInput.
+func WithZeroCopyCaptures() Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.zeroCopy = true
+	}
+}
+
+// WithSpillToFile makes MatchReaderSpill write variables of fixed sizes larger than threshold bytes
+// like "var/bin:Number" to temp files in dir instead of memory so that huge frames can be matched.
+// The default directory is used if dir is empty.
+func WithSpillToFile(threshold int, dir string) Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.spillSize = threshold
+		tpm.spillDir = dir
+	}
+}
+
+// WithOffsets makes MatchReaderResult also return the offsets of the captures within the bytes consumed
+// so that callers can locate the fields to rewrite them.
+// Captures decoded from the input like "var/hex" span the bytes they're decoded from.
+func WithOffsets() Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.offsets = true
+	}
+}
+
+// WithRetry makes MatchReader retry a read failed with a temporary error,
+// one implementing Temporary() bool like a network timeout, up to n times in a match
+// instead of failing. Bytes read before the error are kept so that nothing is consumed twice.
+func WithRetry(n int) Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.maxRetries = n
+	}
+}
+
+// WithStrictGrammar makes Compile reject patterns which are tolerated by default but likely mistakes:
+// empty tokens, white spaces around a token, more colons in a variable than its type takes
+// and a suffix followed by a const starting with it.
+func WithStrictGrammar() Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.strict = true
+	}
+}
+
+// WithFoldedSkips makes Compile fold adjacent blind skips of fixed size like "_:2,_:3"
+// into one skip of the combined size to reduce the instructions run.
+// Errors from the folded skip are reported at the position of the first one.
+func WithFoldedSkips() Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.foldSkips = true
+	}
+}
+
+// WithConstAudit makes the matcher record the consts matched with their offsets
+// for auditing, which can be retrieved by LastAudit. They aren't included in the captures.
+func WithConstAudit() Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.audit = true
+	}
+}
+
+// WithMaxCaptures makes MatchReader stop matching as soon as n captures are bound
+// and return them leaving the rest of input unread.
+// Note that the reader is then positioned in the middle of what the pattern matches.
+func WithMaxCaptures(n int) Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.maxCaptures = n
+	}
+}
+
+// WithBufferAllocator makes MatchReader allocate buffers for captures by alloc instead of make
+// so that callers can control where the memory comes from, e.g. a pool.
+// alloc must return a slice whose length or capacity is at least size.
+// Note that buffers grown while reading a variable terminated by a suffix are discarded.
+func WithBufferAllocator(alloc func(size int) []byte) Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.alloc = alloc
+	}
+}
+
+// WithMaxZeroReads makes MatchReader fail with ErrNoProgress
+// once the reader returns no bytes without error n times in a row
+// rather than spinning on a broken connection forever.
+func WithMaxZeroReads(n int) Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.maxZeroReads = n
+	}
+}
+
+// WithIntDigits makes integer variables written with digits in order of their values
+// instead of decimal. The radix is the number of digits.
+// A range of digits can be written like "0-9a-z" which is base 36.
+func WithIntDigits(digits string) Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.intDigits = expandDigits(digits)
+	}
+}
+
+// WithSingleRecord makes MatchReader fail with ErrNotEOF unless the input ends right after the pattern
+// so that the pattern matches the whole input like a file.
+func WithSingleRecord() Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.singleRecord = true
+	}
+}
+
+// WithMaxLookahead makes MatchReader fail with ErrLookaheadTooLong
+// if alternations, optional consts or terminators of repetitions need to read more than n bytes ahead
+// to tell whether they match. By default the lookahead is not limited.
+func WithMaxLookahead(n int) Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.maxLookahead = n
+	}
+}
+
+// WithPackedCaptures makes MatchReader return captures sharing a single contiguous buffer
+// which reduces allocations for many small captures.
+// The captures must then be treated as a whole, e.g. retaining one of them keeps all of them in memory.
+// It doesn't take effect on the buffers allocated by WithBufferAllocator.
+func WithPackedCaptures() Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.packed = true
+	}
+}
+
+// WithByteCounter makes the matcher retain the number of bytes consumed by the last match
+// even if it failed, which can be retrieved by Consumed.
+func WithByteCounter() Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.byteCounter = true
+	}
+}
+
+// WithResyncWindow sets the maximum number of bytes Resync skips to find a match.
+// The default is 4096.
+func WithResyncWindow(n int) Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.resyncWindow = n
+	}
+}
+
+// WithNilEmptyCaptures makes MatchReader return empty captures as nil.
+// By default, they are empty but non-nil.
+func WithNilEmptyCaptures() Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.nilEmpty = true
+	}
+}
+
+// WithExternalInts declares integer variables whose values are given per match
+// by MatchReaderWithInts or Scanner.SetInts like a size read from a header record
+// which governs the following records. They are 0 unless given.
+func WithExternalInts(names ...string) Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.externalInts = append(tpm.externalInts, names...)
+	}
+}
+
+// WithLogger makes MatchReader log every instruction run at the debug level.
+func WithLogger(logger *slog.Logger) Option {
+	return func(tpm *TextPatternMatcher) {
+		tpm.logger = logger
+	}
+}
+
+func Compile(pattern string, opts ...Option) (Matcher, error) {
+	matcher := &TextPatternMatcher{}
+	for _, opt := range opts {
+		opt(matcher)
+	}
+	m, err := compile(pattern, matcher.options)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// CompileAll compiles patterns with the same opts.
+// If any of patterns fails to compile, it returns a PatternError holding the index of the first one.
+func CompileAll(patterns []string, opts ...Option) ([]Matcher, error) {
+	proto := &TextPatternMatcher{}
+	for _, opt := range opts {
+		opt(proto)
+	}
+	if proto.err != nil {
+		return nil, proto.err
+	}
+	matchers := make([]Matcher, len(patterns))
+	for i, pattern := range patterns {
+		m, err := compile(pattern, proto.options)
+		if err != nil {
+			return nil, PatternError{Index: i, Err: err}
+		}
+		matchers[i] = m
+	}
+	return matchers, nil
+}
+
+func compile(pattern string, opts options) (*TextPatternMatcher, error) {
+	if opts.err != nil {
+		return nil, opts.err
+	}
+	matcher := &TextPatternMatcher{options: opts, pattern: pattern}
+	if matcher.instSlice == nil {
+		matcher.instSlice = make([]inst, 0, defaultInstCap)
+	}
+	if matcher.maxVarSize == 0 {
+		matcher.maxVarSize = defaultMaxVarSize
+	}
+	if matcher.growth <= 1 {
+		matcher.growth = defaultGrowth
+	}
+	if matcher.resyncWindow <= 0 {
+		matcher.resyncWindow = defaultResyncWindow
+	}
+	if matcher.skipBOM {
+		matcher.instSlice = append(matcher.instSlice, inst{kind: bomKind, exec: genInstBOM()})
+	}
+	if matcher.trimSpace {
+		pattern = strings.TrimRight(pattern, " \t")
+	}
+	r := bytes.NewBufferString(pattern)
+	intBindsMap := make(map[string]int)
+	for _, name := range matcher.externalInts {
+		if matcher.externals == nil {
+			matcher.externals = make(map[string]int)
+		}
+		matcher.intBinds = append(matcher.intBinds, 0)
+		intBindsMap[name] = len(matcher.intBinds) - 1
+		matcher.externals[name] = len(matcher.intBinds) - 1
+	}
+	// binBindsMap maps binary variables to the index of instructions binding them
+	binBindsMap := make(map[string]int)
+	// vars holds the names of variables defined
+	vars := make(map[string]struct{})
+	var state parseState
+	pos := 1
+	var name string
+	// required is true if the variable pending a suffix must not be empty
+	var required bool
+	// untilEOF is true if the suffix of the pending variable may be missing at EOF
+	var untilEOF bool
+	// limit is the maximum size of the variable pending a suffix if positive and
+	// truncate is true if the variable is cut at the limit instead of failing
+	var limit int
+	var truncate bool
+	// quoted is true if the suffix of the pending variable is ignored in double quotes
+	var quoted bool
+	// neg is the index of the int bind set to 1 if the integer part of the pending fractional part is negative
+	var neg int
+	// groups holds open repetitions and group is the last one closed
+	type repetition struct {
+		// check is the index of the instruction checking the end of the repetition
+		check int
+		// count is the index of the int bind counting repetitions
+		count int
+		// mark is the index of the int bind holding the offset where the last repetition started
+		mark int
+		// end is the index of the instruction closing the repetition
+		end int
+		// within is true if the repetition ends once the bytes held by the length th int bind are consumed
+		// counting from the offset held by the start th int bind
+		within bool
+		length int
+		start  int
+	}
+	var groups []repetition
+	var group repetition
+	type branch struct {
+		// check is the index of the instruction checking the signature
+		check int
+		// jump is the index of the instruction jumping over the latter block if any
+		jump int
+		// groups is the number of repetitions open when the branch is opened
+		groups int
+		pos    int
+	}
+	var branches []branch
+	// unresolved holds the references to variables not defined
+	// which are reported together once the pattern is parsed
+	var unresolved Errors
+	// lastSuffix is the suffix of the previous token if any
+	var lastSuffix string
+	// constRun is the index of the const instruction adjacent consts are merged into
+	// and constPoses and constEnds hold the positions and the end offsets of the merged ones
+	constRun := -1
+	var constPoses, constEnds []int
+	// skipRun is the index of the blind skip of fixed size adjacent ones are folded into with WithFoldedSkips
+	// and skipBind is the index of the int bind holding its size
+	skipRun, skipBind := -1, -1
+	// seps holds the separators of the key value pairs pending a terminator
+	var seps string
+	// pairs appends a repetition of the key value pairs of name terminated by term or EOF if term is nil.
+	pairs := func(term []byte) {
+		matcher.intBinds = append(matcher.intBinds, 0, 0)
+		count, mark := len(matcher.intBinds)-2, len(matcher.intBinds)-1
+		check := len(matcher.instSlice) + 1
+		end := check + 3
+		until := genInstRepUntilEOF(pos, count, end)
+		if term != nil {
+			until = genInstRepUntil(pos, term, count, mark, end)
+		}
+		matcher.instSlice = append(matcher.instSlice,
+			inst{kind: repKind, pos: pos, exec: genInstRepInit(count)},
+			inst{kind: repKind, pos: pos, exec: until, min: len(term), suffix: term},
+			inst{kind: binKind, pos: pos, name: name, exec: genInstVarWithoutSize(pos, []byte{seps[0]}, true, matcher.maxVarSize, matcher.growth), min: 1, suffix: []byte{seps[0]}, depth: 1},
+			inst{kind: binKind, pos: pos, name: name, exec: genInstPairValue(pos, seps[1], term, matcher.maxVarSize, matcher.growth), depth: 1},
+			inst{kind: endKind, pos: pos, exec: genInstRepEnd(count, check)},
+		)
+	}
+	// resolveInt returns the index of the int bind of the integer variable name.
+	// If it's not defined, it records the reference and returns a placeholder.
+	resolveInt := func(name string) int {
+		if idx, ok := intBindsMap[name]; ok {
+			return idx
+		}
+		if !isName(name) {
+			unresolved = append(unresolved, Error{Code: ErrorCode(fmt.Sprintf(ErrParseInvalidSize, name)), Pos: pos})
+		} else {
+			unresolved = append(unresolved, Error{Code: ErrorCode(fmt.Sprintf(ErrParseVariableNotDefined, name)), Pos: pos})
+		}
+		matcher.intBinds = append(matcher.intBinds, 0)
+		return len(matcher.intBinds) - 1
+	}
+	for {
+		rawLine, err := r.ReadString(',')
+		// "\," is a comma in the block rather than the delimiter unless the backslash is escaped as "\\"
+		for err == nil && escapedComma(rawLine) {
+			var more string
+			more, err = r.ReadString(',')
+			rawLine += more
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		// trim the last ','
+		var line string
+		if err == nil {
+			line = rawLine[:len(rawLine)-1]
+		} else {
+			line = rawLine
+		}
+		line = unescape(line)
+		suffix := lastSuffix
+		lastSuffix = ""
+		if matcher.strict {
+			if reason := strictViolation(line, state, suffix); reason != "" {
+				return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrParseStrict, reason)), Pos: pos}
+			}
+		}
+		// 1. blind(unbind) (start with '_')
+		//   - "_" # the subsequent block must be const
+		//   - "_:12"
+		//   - "_:Number" # Number is an integer variable
+		// 2. bind binary variable
+		//   - "var/bin" # the subsequent block must be const
+		//   - "var/bin:12"
+		//   - "var/bin:Number" # Number is an integer variable
+		//   - "var/bin:rest-8" # up to 8 bytes before EOF
+		//   - "var/bin:@Delim" # up to the bytes bound to Delim, a binary variable
+		//   - "var/bin:=Other" # the same bytes as bound to Other, a binary variable
+		//   - "var/bin:~64" # the subsequent block must be const. up to it or 64 bytes whichever comes first
+		//   - "var/bin:<=64" # the subsequent block must be const. fails if it doesn't come within 64 bytes
+		//   - "var/bin:\"" # the subsequent block must be const. it's ignored in double quotes
+		//   - "var/bin:8{Number}" # Number items of 8 bytes each
+		//   - "var/bin:Type[1=4|2=8]" # 4 bytes if Type, an integer variable, is 1 or 8 bytes if it's 2
+		//   - "var/line" # up to "\n" or "\r\n" which is not bound
+		//   - "var/run:20" # a run of the byte given in hex, 0x20 here, up to another byte. it may be empty
+		//   - "var/crc32" # up to the first 4 bytes which are the CRC-32 (IEEE) of the preceding ones in big endian. they are not bound
+		//   - "var/nest:()" # from "(" up to the ")" balancing it, both bound. "(a(b)c)" as a whole
+		//   - "var/hex:4" # 8 hex digits like "0a1b2c3d" decoded into 4 bytes
+		//   - "var/hex:Number"
+		//   - "var/kv:=&" # "a=1&b=2" up to the subsequent const or EOF. keys and values bound alternately followed by the number of pairs
+		//   - "var/bin!" # the subsequent block must be const and the variable must not be empty
+		//   - "var/bin?" # the subsequent block must be const. up to it or EOF whichever comes first
+		// 3. bind integer variable
+		//   - "var/int" # the subsequent block must be const
+		//   - "var/int:12"
+		//   - "var/int:Number" # Number is an integer variable
+		//   - "=/int:42" # an integer of as many digits as written which must equal 42. it's not bound
+		//   - "var/hexint:2" # hex digits like "1f"
+		//   - "var/hexint:Number"
+		//   - "var/u16be" # unsigned binary integer of 8, 16, 32 or 64 bits in big or little endian like "u8", "u32le"
+		// 4. bind binary floating point variable in big or little endian
+		//   - "var/f32be"
+		//   - "var/f64le"
+		// 5. bind binary variable up to the end of a frame whose total length is given
+		//   - "var/frame:Number" # Number - the bytes consumed so far
+		// 6. bind integer and fractional parts of a decimal to "var" and "var.frac"
+		//    and the number of fractional digits to "var.scale"
+		//   - "var/fixed:." # the subsequent block must be const. "-12.34" binds -12, -34 and 2
+		// 7. bind binary variable which must not consist only of a pad byte
+		//   - "var/nz:12" # the pad byte defaults to 0x00
+		//   - "var/nz:Number:20" # the pad byte is given in hex
+		// 8. bind binary variable encoded as a netstring
+		//   - "var/netstring" # "5:hello," binds "hello"
+		//   - "var/lp" # "5:hello" binds "hello" without the trailing comma
+		// 9. repetition of the block enclosed by "{" and "}" (the number of repetitions is bound)
+		//   - "var/rep{, ... ,}, terminator" # repeated until terminator comes next
+		//   - "var/rep{:Number, ... ,}" # repeated until exactly Number bytes are consumed
+		// 10. const (arbitrary bytes: not matched with any rule)
+		//   - suffix for the above types
+		//     - "_, suffix"
+		//     - "var/bin, suffix"
+		//     - "var/bin!, suffix"
+		//     - "var/int, suffix"
+		//   - or pure const
+		//   - "\," is a comma instead of the delimiter like "var/bin,\,END"
+		//   - "\\" is a backslash so that it can precede the delimiter like "C:\\,V/bin:1"
+		// 11. alternation of consts (the index of the matched one is bound)
+		//   - "(A|B|C)"
+		// 12. optional const (whether it's present or not is bound as '1' or '0')
+		//   - "?OK:"
+		// 13. alignment (skip bytes until the bytes consumed is a multiple of 4)
+		//   - "align:4"
+		// 14. branch by a signature (whether it's present or not is bound as '1' or '0')
+		//   - "?V2:{, ... ,}" # the block is matched only if "V2:" is present
+		//   - "?V2:{, ... ,}|{, ... ,}" # the former block if "V2:" is present or the latter otherwise
+		if line == "" {
+			// empty token matching nothing
+			if state != nonParseState {
+				return nil, Error{Code: ErrParseSuffixExpected, Pos: pos}
+			}
+		} else if line[0] == '_' {
+			// blind
+			if len(line) == 1 {
+				// "_"
+				state = blindParseState
+			} else {
+				tokens := strings.Split(line, ":")
+				if len(tokens) != 2 {
+					return nil, Error{Code: ErrParseColonExpected, Pos: pos}
+				}
+				n, err := parseSize(tokens[1])
+				if err == nil {
+					// "_:12"
+					if last := len(matcher.instSlice) - 1; matcher.foldSkips && last >= 0 && last == skipRun {
+						// folded into the preceding skip so that they are discarded with one read
+						matcher.instSlice[last].min += int(n)
+						matcher.intBinds[skipBind] += int(n)
+					} else {
+						matcher.intBinds = append(matcher.intBinds, int(n))
+						matcher.instSlice = append(matcher.instSlice, inst{kind: blindKind, pos: pos, exec: genInstVarWithSize(pos, len(matcher.intBinds)-1, false, matcher.maxVarSize), min: int(n), fixed: true})
+						skipRun, skipBind = len(matcher.instSlice)-1, len(matcher.intBinds)-1
+					}
+				} else {
+					// "_:Number"
+					idx := resolveInt(tokens[1])
+					matcher.instSlice = append(matcher.instSlice, inst{kind: blindKind, pos: pos, exec: genInstVarWithSize(pos, idx, false, matcher.maxVarSize)})
+				}
+			}
+		} else if strings.HasPrefix(line, "=/int:") {
+			// integer which must equal the given one
+			// "=/int:42"
+			// it's written in the digits of the input
+			want, err := parseIntDigits([]byte(line[len("=/int:"):]), matcher.intDigits)
+			if err != nil {
+				return nil, Error{Code: ErrParseInvalidExpected, Pos: pos}
+			}
+			size := len(line) - len("=/int:")
+			matcher.instSlice = append(matcher.instSlice, inst{kind: blindKind, pos: pos, exec: genInstIntEqual(pos, size, int(want)), min: size, fixed: true, lit: []byte(line[len("=/int:"):])})
+		} else if strings.Contains(line, "/") {
+			// bind binary|integer
+			tokens := strings.Split(line, "/")
+			if len(tokens) != 2 {
+				return nil, Error{Code: ErrParseInvalidSlash, Pos: pos}
+			}
+			if vars[tokens[0]] = struct{}{}; matcher.maxVars > 0 && len(vars) > matcher.maxVars {
+				return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrTooManyVariables, matcher.maxVars)), Pos: pos}
+			}
+			subTokens := strings.Split(tokens[1], ":")
+			switch subTokens[0] {
+			case "bin":
+				if len(subTokens) == 2 && strings.HasPrefix(subTokens[1], "rest") {
+					//   - "var/bin:rest-8"
+					var trailer int64
+					if subTokens[1] != "rest" {
+						n, err := strconv.ParseInt(strings.TrimPrefix(subTokens[1], "rest-"), 10, 64)
+						if err != nil || n < 0 || !strings.HasPrefix(subTokens[1], "rest-") {
+							return nil, Error{Code: ErrParseInvalidRest, Pos: pos}
+						}
+						trailer = n
+					}
+					binBindsMap[tokens[0]] = len(matcher.instSlice)
+					matcher.instSlice = append(matcher.instSlice, inst{kind: binKind, pos: pos, name: tokens[0], exec: genInstVarRest(pos, int(trailer), matcher.maxVarSize), min: int(trailer)})
+				} else if len(subTokens) == 2 && strings.HasPrefix(subTokens[1], "@") {
+					//   - "var/bin:@Delim" # Delim is a binary variable
+					idx, ok := binBindsMap[subTokens[1][1:]]
+					if ok {
+						matcher.instSlice[idx].ref = true
+					} else {
+						unresolved = append(unresolved, Error{Code: ErrorCode(fmt.Sprintf(ErrParseVariableNotDefined, subTokens[1][1:])), Pos: pos})
+					}
+					binBindsMap[tokens[0]] = len(matcher.instSlice)
+					matcher.instSlice = append(matcher.instSlice, inst{kind: binKind, pos: pos, name: tokens[0], exec: genInstVarWithRefSuffix(pos, idx, true, matcher.maxVarSize, matcher.growth)})
+				} else if len(subTokens) == 2 && strings.HasPrefix(subTokens[1], "=") {
+					//   - "var/bin:=Other" # Other is a binary variable
+					other := subTokens[1][1:]
+					idx, ok := binBindsMap[other]
+					if ok {
+						matcher.instSlice[idx].ref = true
+					} else {
+						unresolved = append(unresolved, Error{Code: ErrorCode(fmt.Sprintf(ErrParseVariableNotDefined, other)), Pos: pos})
+					}
+					binBindsMap[tokens[0]] = len(matcher.instSlice)
+					matcher.instSlice = append(matcher.instSlice, inst{kind: binKind, pos: pos, name: tokens[0], exec: genInstVarEqual(pos, idx, other)})
+				} else if len(subTokens) == 2 && (strings.HasPrefix(subTokens[1], "~") || strings.HasPrefix(subTokens[1], "<=")) {
+					//   - "var/bin:~64"
+					//   - "var/bin:<=64"
+					truncate = subTokens[1][0] == '~'
+					n, err := strconv.ParseInt(strings.TrimLeft(subTokens[1], "~<="), 10, 64)
+					if err != nil || n <= 0 || n > int64(matcher.maxVarSize) {
+						return nil, Error{Code: ErrParseInvalidLimit, Pos: pos}
+					}
+					name = tokens[0]
+					limit = int(n)
+					state = binParseState
+				} else if len(subTokens) == 2 && strings.HasSuffix(subTokens[1], "]") && strings.Contains(subTokens[1], "[") {
+					//   - "var/bin:Type[1=4|2=8]"
+					disc, table, _ := strings.Cut(strings.TrimSuffix(subTokens[1], "]"), "[")
+					sizes := make(map[int]int)
+					for _, entry := range strings.Split(table, "|") {
+						k, v, ok := strings.Cut(entry, "=")
+						key, err := strconv.Atoi(k)
+						size, serr := parseSize(v)
+						if !ok || err != nil || serr != nil {
+							return nil, Error{Code: ErrParseInvalidSizeTable, Pos: pos}
+						}
+						if size > int64(matcher.maxVarSize) {
+							return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, matcher.maxVarSize)), Pos: pos}
+						}
+						sizes[key] = int(size)
+					}
+					binBindsMap[tokens[0]] = len(matcher.instSlice)
+					matcher.instSlice = append(matcher.instSlice, inst{kind: binKind, pos: pos, name: tokens[0], exec: genInstVarBySize(pos, resolveInt(disc), sizes)})
+				} else if len(subTokens) == 2 && strings.HasSuffix(subTokens[1], "}") && strings.Contains(subTokens[1], "{") {
+					//   - "var/bin:8{Number}"
+					size, times, _ := strings.Cut(strings.TrimSuffix(subTokens[1], "}"), "{")
+					var sizeBind int
+					if n, err := parseSize(size); err == nil {
+						matcher.intBinds = append(matcher.intBinds, int(n))
+						sizeBind = len(matcher.intBinds) - 1
+					} else {
+						sizeBind = resolveInt(size)
+					}
+					timesBind := resolveInt(times)
+					matcher.intBinds = append(matcher.intBinds, 0)
+					count := len(matcher.intBinds) - 1
+					matcher.instSlice = append(matcher.instSlice, inst{kind: repKind, pos: pos, exec: genInstRepInit(count)})
+					check := len(matcher.instSlice)
+					end := check + 2
+					matcher.instSlice = append(matcher.instSlice,
+						inst{kind: repKind, pos: pos, exec: genInstRepTimes(pos, timesBind, sizeBind, count, end, matcher.maxVarSize)},
+						inst{kind: binKind, pos: pos, name: tokens[0], exec: genInstVarWithSize(pos, sizeBind, true, matcher.maxVarSize), depth: 1},
+						inst{kind: endKind, pos: pos, exec: genInstRepEnd(count, check)})
+				} else if len(subTokens) == 2 && subTokens[1] == "\"" {
+					//   - "var/bin:\""
+					name = tokens[0]
+					quoted = true
+					state = binParseState
+				} else if len(subTokens) == 2 {
+					n, err := parseSize(subTokens[1])
+					if err == nil {
+						//   - "var/bin:12"
+						matcher.intBinds = append(matcher.intBinds, int(n))
+						binBindsMap[tokens[0]] = len(matcher.instSlice)
+						matcher.instSlice = append(matcher.instSlice, inst{kind: binKind, pos: pos, name: tokens[0], exec: genInstVarWithSize(pos, len(matcher.intBinds)-1, true, matcher.maxVarSize), min: int(n), fixed: true})
+					} else {
+						//   - "var/bin:Number"
+						idx := resolveInt(subTokens[1])
+						binBindsMap[tokens[0]] = len(matcher.instSlice)
+						matcher.instSlice = append(matcher.instSlice, inst{kind: binKind, pos: pos, name: tokens[0], exec: genInstVarWithSize(pos, idx, true, matcher.maxVarSize)})
+					}
+				} else {
+					//   - "var/bin"
+					name = tokens[0]
+					state = binParseState
+				}
+			case "int":
+				if len(subTokens) == 2 {
+					n, err := parseSize(subTokens[1])
+					if err == nil {
+						//   - "var/int:12"
+						if n == 0 {
+							return nil, Error{Code: ErrParseZeroWidthInt, Pos: pos}
+						}
+						matcher.intBinds = append(matcher.intBinds, int(n))
+						matcher.intBinds = append(matcher.intBinds, 0)
+						intBindsMap[tokens[0]] = len(matcher.intBinds) - 1
+						matcher.instSlice = append(matcher.instSlice, inst{kind: intKind, pos: pos, name: tokens[0], out: len(matcher.intBinds) - 1, exec: genInstIntWithSize(pos, len(matcher.intBinds)-2, len(matcher.intBinds)-1, matcher.binIntAuto, matcher.maxVarSize), min: int(n), fixed: true})
+					} else {
+						//   - "var/int:Number"
+						idx := resolveInt(subTokens[1])
+						matcher.intBinds = append(matcher.intBinds, 0)
+						intBindsMap[tokens[0]] = len(matcher.intBinds) - 1
+						matcher.instSlice = append(matcher.instSlice, inst{kind: intKind, pos: pos, name: tokens[0], out: len(matcher.intBinds) - 1, exec: genInstIntWithSize(pos, idx, len(matcher.intBinds)-1, matcher.binIntAuto, matcher.maxVarSize)})
+					}
+				} else {
+					//   - "var/int"
+					name = tokens[0]
+					state = intParseState
+				}
+			case "hexint":
+				//   - "var/hexint:2"
+				//   - "var/hexint:Number"
+				if len(subTokens) != 2 {
+					return nil, Error{Code: ErrParseColonExpected, Pos: pos}
+				}
+				n, err := parseSize(subTokens[1])
+				if err == nil && n == 0 {
+					return nil, Error{Code: ErrParseZeroWidthInt, Pos: pos}
+				}
+				if err == nil {
+					matcher.intBinds = append(matcher.intBinds, int(n), 0)
+					intBindsMap[tokens[0]] = len(matcher.intBinds) - 1
+					matcher.instSlice = append(matcher.instSlice, inst{kind: intKind, pos: pos, name: tokens[0], out: len(matcher.intBinds) - 1, exec: genInstHexIntWithSize(pos, len(matcher.intBinds)-2, len(matcher.intBinds)-1, matcher.maxVarSize), min: int(n), fixed: true})
+				} else {
+					idx := resolveInt(subTokens[1])
+					matcher.intBinds = append(matcher.intBinds, 0)
+					intBindsMap[tokens[0]] = len(matcher.intBinds) - 1
+					matcher.instSlice = append(matcher.instSlice, inst{kind: intKind, pos: pos, name: tokens[0], out: len(matcher.intBinds) - 1, exec: genInstHexIntWithSize(pos, idx, len(matcher.intBinds)-1, matcher.maxVarSize)})
+				}
+			case "u8", "u16be", "u16le", "u32be", "u32le", "u64be", "u64le":
+				//   - "var/u16be"
+				if len(subTokens) != 1 {
+					return nil, Error{Code: ErrParseInvalidType, Pos: pos}
+				}
+				bits, _ := strconv.Atoi(strings.TrimRight(subTokens[0][1:], "bel"))
+				var order binary.ByteOrder = binary.BigEndian
+				if strings.HasSuffix(subTokens[0], "le") {
+					order = binary.LittleEndian
+				}
+				matcher.intBinds = append(matcher.intBinds, 0)
+				intBindsMap[tokens[0]] = len(matcher.intBinds) - 1
+				matcher.instSlice = append(matcher.instSlice, inst{kind: intKind, pos: pos, name: tokens[0], out: len(matcher.intBinds) - 1, exec: genInstUint(pos, bits/8, order, len(matcher.intBinds)-1), min: bits / 8, fixed: true, lit: make([]byte, bits/8)})
+			case "f32be", "f32le", "f64be", "f64le":
+				//   - "var/f32be"
+				if len(subTokens) != 1 {
+					return nil, Error{Code: ErrParseInvalidType, Pos: pos}
+				}
+				size := 4
+				if subTokens[0][1:3] == "64" {
+					size = 8
+				}
+				var order binary.ByteOrder = binary.BigEndian
+				if strings.HasSuffix(subTokens[0], "le") {
+					order = binary.LittleEndian
+				}
+				matcher.floatBinds++
+				matcher.instSlice = append(matcher.instSlice, inst{kind: floatKind, pos: pos, name: tokens[0], out: matcher.floatBinds - 1, exec: genInstFloat(pos, size, order, matcher.floatBinds-1), min: size, fixed: true, lit: make([]byte, size)})
+			case "frame":
+				//   - "var/frame:12"
+				//   - "var/frame:Number"
+				if len(subTokens) != 2 {
+					return nil, Error{Code: ErrParseColonExpected, Pos: pos}
+				}
+				n, err := parseSize(subTokens[1])
+				if err == nil {
+					matcher.intBinds = append(matcher.intBinds, int(n))
+					binBindsMap[tokens[0]] = len(matcher.instSlice)
+					matcher.instSlice = append(matcher.instSlice, inst{kind: frameKind, pos: pos, name: tokens[0], exec: genInstVarFrame(pos, len(matcher.intBinds)-1, matcher.maxVarSize)})
+				} else {
+					idx := resolveInt(subTokens[1])
+					binBindsMap[tokens[0]] = len(matcher.instSlice)
+					matcher.instSlice = append(matcher.instSlice, inst{kind: frameKind, pos: pos, name: tokens[0], exec: genInstVarFrame(pos, idx, matcher.maxVarSize)})
+				}
+			case "fixed":
+				//   - "var/fixed:."
+				sep := "."
+				if len(subTokens) == 2 && subTokens[1] != "" {
+					sep = subTokens[1]
+				} else if len(subTokens) > 2 {
+					return nil, Error{Code: ErrParseColonExpected, Pos: pos}
+				}
+				matcher.intBinds = append(matcher.intBinds, 0, 0)
+				intBindsMap[tokens[0]] = len(matcher.intBinds) - 2
+				neg = len(matcher.intBinds) - 1
+				exec := genInstIntWithoutSize(pos, []byte(sep), len(matcher.intBinds)-2, matcher.maxVarSize, matcher.growth)
+				matcher.instSlice = append(matcher.instSlice, inst{kind: intKind, pos: pos, name: tokens[0], out: len(matcher.intBinds) - 2, exec: genInstSign(exec, neg), min: len(sep)})
+				name = tokens[0]
+				state = fixedParseState
+			case "rep{":
+				//   - "var/rep{"
+				if matcher.maxDepth > 0 && len(groups) >= matcher.maxDepth {
+					return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrExpansionTooDeep, matcher.maxDepth)), Pos: pos}
+				}
+				if len(subTokens) > 2 {
+					return nil, Error{Code: ErrParseColonExpected, Pos: pos}
+				}
+				if len(subTokens) == 1 {
+					matcher.intBinds = append(matcher.intBinds, 0, 0)
+					intBindsMap[tokens[0]] = len(matcher.intBinds) - 2
+					matcher.instSlice = append(matcher.instSlice, inst{kind: repKind, pos: pos, exec: genInstRepInit(len(matcher.intBinds) - 2)})
+					groups = append(groups, repetition{check: len(matcher.instSlice), count: len(matcher.intBinds) - 2, mark: len(matcher.intBinds) - 1})
+					// exec is generated once the terminator is parsed
+					matcher.instSlice = append(matcher.instSlice, inst{kind: repKind, pos: pos})
+				} else {
+					//   - "var/rep{:12"
+					//   - "var/rep{:Number"
+					g := repetition{within: true}
+					n, err := parseSize(subTokens[1])
+					if err == nil {
+						matcher.intBinds = append(matcher.intBinds, int(n))
+						g.length = len(matcher.intBinds) - 1
+					} else {
+						idx := resolveInt(subTokens[1])
+						g.length = idx
+					}
+					matcher.intBinds = append(matcher.intBinds, 0, 0, 0)
+					g.start = len(matcher.intBinds) - 3
+					g.count = len(matcher.intBinds) - 2
+					g.mark = len(matcher.intBinds) - 1
+					intBindsMap[tokens[0]] = g.count
+					matcher.instSlice = append(matcher.instSlice, inst{kind: repKind, pos: pos, exec: genInstRepWithinInit(g.count, g.start)})
+					g.check = len(matcher.instSlice)
+					groups = append(groups, g)
+					// exec is generated once the end of the repetition is parsed
+					matcher.instSlice = append(matcher.instSlice, inst{kind: repKind, pos: pos})
+				}
+			case "nz":
+				//   - "var/nz:12" # must not be all zero
+				//   - "var/nz:Number:20" # must not be all the pad byte 0x20
+				if len(subTokens) != 2 && len(subTokens) != 3 {
+					return nil, Error{Code: ErrParseColonExpected, Pos: pos}
+				}
+				var pad byte
+				if len(subTokens) == 3 {
+					n, err := strconv.ParseUint(subTokens[2], 16, 8)
+					if err != nil {
+						return nil, Error{Code: ErrParseInvalidPad, Pos: pos}
+					}
+					pad = byte(n)
+				}
+				n, err := parseSize(subTokens[1])
+				if err == nil {
+					matcher.intBinds = append(matcher.intBinds, int(n))
+					binBindsMap[tokens[0]] = len(matcher.instSlice)
+					matcher.instSlice = append(matcher.instSlice, inst{kind: nzKind, pos: pos, name: tokens[0], exec: genInstVarNonPad(pos, len(matcher.intBinds)-1, pad, matcher.maxVarSize), min: int(n), fixed: true})
+				} else {
+					idx := resolveInt(subTokens[1])
+					binBindsMap[tokens[0]] = len(matcher.instSlice)
+					matcher.instSlice = append(matcher.instSlice, inst{kind: nzKind, pos: pos, name: tokens[0], exec: genInstVarNonPad(pos, idx, pad, matcher.maxVarSize)})
+				}
+			case "netstring":
+				//   - "var/netstring"
+				if len(subTokens) != 1 {
+					return nil, Error{Code: ErrParseInvalidType, Pos: pos}
+				}
+				binBindsMap[tokens[0]] = len(matcher.instSlice)
+				matcher.instSlice = append(matcher.instSlice, inst{kind: binKind, pos: pos, name: tokens[0], exec: genInstVarNetstring(pos, matcher.maxVarSize), min: len("0:,")})
+			case "lp":
+				//   - "var/lp"
+				if len(subTokens) != 1 {
+					return nil, Error{Code: ErrParseInvalidType, Pos: pos}
+				}
+				matcher.intBinds = append(matcher.intBinds, 0)
+				size := len(matcher.intBinds) - 1
+				matcher.instSlice = append(matcher.instSlice, inst{kind: blindKind, pos: pos, exec: genInstLength(pos, size, matcher.maxVarSize, matcher.growth), min: len("0:")})
+				binBindsMap[tokens[0]] = len(matcher.instSlice)
+				matcher.instSlice = append(matcher.instSlice, inst{kind: binKind, pos: pos, name: tokens[0], exec: genInstVarWithSize(pos, size, true, matcher.maxVarSize)})
+			case "line":
+				//   - "var/line"
+				if len(subTokens) != 1 {
+					return nil, Error{Code: ErrParseInvalidType, Pos: pos}
+				}
+				binBindsMap[tokens[0]] = len(matcher.instSlice)
+				matcher.instSlice = append(matcher.instSlice, inst{kind: lineKind, pos: pos, name: tokens[0], exec: genInstLine(pos, matcher.maxVarSize, matcher.growth), min: len("\n")})
+			case "run":
+				//   - "var/run:20"
+				if len(subTokens) != 2 {
+					return nil, Error{Code: ErrParseColonExpected, Pos: pos}
+				}
+				b, err := strconv.ParseUint(subTokens[1], 16, 8)
+				if err != nil {
+					return nil, Error{Code: ErrParseInvalidPad, Pos: pos}
+				}
+				binBindsMap[tokens[0]] = len(matcher.instSlice)
+				matcher.instSlice = append(matcher.instSlice, inst{kind: binKind, pos: pos, name: tokens[0], exec: genInstRun(pos, byte(b), matcher.maxVarSize, matcher.growth)})
+			case "hex":
+				//   - "var/hex:4"
+				//   - "var/hex:Number"
+				if len(subTokens) != 2 {
+					return nil, Error{Code: ErrParseColonExpected, Pos: pos}
+				}
+				binBindsMap[tokens[0]] = len(matcher.instSlice)
+				if n, err := parseSize(subTokens[1]); err == nil {
+					matcher.intBinds = append(matcher.intBinds, int(n))
+					matcher.instSlice = append(matcher.instSlice, inst{kind: binKind, pos: pos, name: tokens[0], exec: genInstVarHex(pos, len(matcher.intBinds)-1, matcher.maxVarSize), min: 2 * int(n), fixed: true})
+				} else {
+					matcher.instSlice = append(matcher.instSlice, inst{kind: binKind, pos: pos, name: tokens[0], exec: genInstVarHex(pos, resolveInt(subTokens[1]), matcher.maxVarSize)})
+				}
+			case "kv":
+				//   - "var/kv:=&"
+				if len(subTokens) != 2 || len(subTokens[1]) != 2 || subTokens[1][0] == subTokens[1][1] {
+					return nil, Error{Code: ErrParseInvalidSeparators, Pos: pos}
+				}
+				name = tokens[0]
+				seps = subTokens[1]
+				state = pairsParseState
+			case "crc32":
+				//   - "var/crc32"
+				if len(subTokens) != 1 {
+					return nil, Error{Code: ErrParseInvalidType, Pos: pos}
+				}
+				binBindsMap[tokens[0]] = len(matcher.instSlice)
+				matcher.instSlice = append(matcher.instSlice, inst{kind: binKind, pos: pos, name: tokens[0], exec: genInstVarCRC32(pos, matcher.maxVarSize, matcher.growth), min: crc32.Size})
+			case "nest":
+				//   - "var/nest:()"
+				if len(subTokens) != 2 || len(subTokens[1]) != 2 || subTokens[1][0] == subTokens[1][1] {
+					return nil, Error{Code: ErrParseInvalidBrackets, Pos: pos}
+				}
+				binBindsMap[tokens[0]] = len(matcher.instSlice)
+				matcher.instSlice = append(matcher.instSlice, inst{kind: binKind, pos: pos, name: tokens[0], exec: genInstVarNest(pos, subTokens[1][0], subTokens[1][1], matcher.maxVarSize, matcher.growth), min: 2})
+			case "bin!":
+				//   - "var/bin!"
+				if len(subTokens) != 1 {
+					return nil, Error{Code: ErrParseInvalidRequired, Pos: pos}
+				}
+				name = tokens[0]
+				required = true
+				state = binParseState
+			case "bin?":
+				//   - "var/bin?"
+				if len(subTokens) != 1 {
+					return nil, Error{Code: ErrParseInvalidUntilEOF, Pos: pos}
+				}
+				name = tokens[0]
+				untilEOF = true
+				state = binParseState
+			default:
+				return nil, Error{Code: ErrParseInvalidType, Pos: pos}
+			}
+		} else if state != nonParseState {
+			// suffix for blind/binary|integer
+			lastSuffix = line
+			switch state {
+			case blindParseState:
+				// blind
+				// "_, suffix"
+				matcher.instSlice = append(matcher.instSlice, inst{kind: blindKind, pos: pos, exec: genInstVarWithoutSize(pos, []byte(line), false, matcher.maxVarSize, matcher.growth), min: len(line), suffix: []byte(line)})
+			case binParseState:
+				// binary
+				// "var/bin, suffix"
+				binBindsMap[name] = len(matcher.instSlice)
+				exec := genInstVarWithoutSize(pos, []byte(line), true, matcher.maxVarSize, matcher.growth)
+				var modifier string
+				if quoted {
+					exec = genInstVarQuoted(pos, []byte(line), '"', matcher.maxVarSize, matcher.growth)
+					modifier += "\""
+					quoted = false
+				}
+				if limit > 0 {
+					exec = genInstVarUpTo(pos, []byte(line), limit, truncate)
+					if truncate {
+						modifier += "~" + strconv.Itoa(limit)
+					} else {
+						modifier += "<=" + strconv.Itoa(limit)
+					}
+					limit = 0
+				}
+				min := len(line)
+				if untilEOF {
+					exec = genInstVarUntilEOF(pos, []byte(line), matcher.maxVarSize, matcher.growth)
+					modifier += "?"
+					min = 0
+					untilEOF = false
+				}
+				if required {
+					exec = genInstRequired(pos, name, exec)
+					modifier += "!"
+					required = false
+				}
+				matcher.instSlice = append(matcher.instSlice, inst{kind: binKind, pos: pos, name: name, exec: exec, min: min, suffix: []byte(line), modifier: modifier})
+			case repParseState:
+				// repetition
+				// "var/rep{, ... ,}, terminator"
+				matcher.instSlice[group.check].exec = genInstRepUntil(pos, []byte(line), group.count, group.mark, group.end)
+				matcher.instSlice[group.check].min = len(line)
+				matcher.instSlice[group.check].suffix = []byte(line)
+			case pairsParseState:
+				// key value pairs
+				// "var/kv:=&, terminator"
+				pairs([]byte(line))
+			case fixedParseState:
+				// fractional part
+				// "var/fixed:., suffix"
+				matcher.intBinds = append(matcher.intBinds, 0, 0)
+				out, scale := len(matcher.intBinds)-2, len(matcher.intBinds)-1
+				intBindsMap[name+".frac"], intBindsMap[name+".scale"] = out, scale
+				exec := genInstFrac(pos, genInstIntWithoutSize(pos, []byte(line), out, matcher.maxVarSize, matcher.growth), out, scale, neg)
+				matcher.instSlice = append(matcher.instSlice, inst{kind: intKind, pos: pos, name: name + ".frac", out: out, exec: exec, min: len(line), suffix: []byte(line)})
+			case intParseState:
+				// integer
+				// "var/int, suffix"
+				matcher.intBinds = append(matcher.intBinds, 0)
+				intBindsMap[name] = len(matcher.intBinds) - 1
+				matcher.instSlice = append(matcher.instSlice, inst{kind: intKind, pos: pos, name: name, out: len(matcher.intBinds) - 1, exec: genInstIntWithoutSize(pos, []byte(line), len(matcher.intBinds)-1, matcher.maxVarSize, matcher.growth), min: len(line), suffix: []byte(line)})
+			}
+			state = nonParseState
+		} else if (line == "}" || line == "}|{") && len(branches) > 0 && branches[len(branches)-1].groups == len(groups) {
+			// end of the block of a branch opened after the innermost repetition
+			b := &branches[len(branches)-1]
+			last := len(matcher.instSlice) - 1
+			if line == "}|{" && b.jump < 0 {
+				// the signature is absent so the former block is jumped over to the latter
+				b.jump = len(matcher.instSlice)
+				matcher.instSlice = append(matcher.instSlice, inst{kind: jumpKind, pos: pos})
+				sig := matcher.instSlice[b.check].lit
+				matcher.instSlice[b.check].exec = genInstIf(b.pos, sig, b.jump)
+			} else if line == "}" {
+				if b.jump < 0 {
+					matcher.instSlice[b.check].exec = genInstIf(b.pos, matcher.instSlice[b.check].lit, last)
+				} else {
+					matcher.instSlice[b.jump].exec = genInstJump(last)
+					matcher.instSlice[b.jump].out = last
+				}
+				matcher.instSlice[b.check].out = last
+				branches = branches[:len(branches)-1]
+			} else {
+				return nil, Error{Code: ErrParseBraceExpected, Pos: pos}
+			}
+			// the blocks are never merged with what follows
+			constRun, skipRun = -1, -1
+		} else if line == "}" && len(groups) > 0 {
+			// end of repetition
+			group = groups[len(groups)-1]
+			groups = groups[:len(groups)-1]
+			for i := group.check + 1; i < len(matcher.instSlice); i++ {
+				matcher.instSlice[i].depth++
+			}
+			group.end = len(matcher.instSlice)
+			matcher.instSlice = append(matcher.instSlice, inst{kind: endKind, pos: pos, exec: genInstRepEnd(group.count, group.check)})
+			if group.within {
+				check := &matcher.instSlice[group.check]
+				check.exec = genInstRepWithin(check.pos, group.length, group.start, group.count, group.mark, group.end)
+			} else {
+				state = repParseState
+			}
+		} else if len(line) > 2 && line[0] == '?' && line[len(line)-1] == '{' {
+			// branch
+			// "?V2:{"
+			branches = append(branches, branch{check: len(matcher.instSlice), jump: -1, groups: len(groups), pos: pos})
+			// exec is generated once the block is closed
+			matcher.instSlice = append(matcher.instSlice, inst{kind: ifKind, pos: pos, lit: []byte(line[1 : len(line)-1])})
+		} else if len(line) > 1 && line[0] == '?' {
+			// optional const
+			// "?OK:"
+			matcher.instSlice = append(matcher.instSlice, inst{kind: optKind, pos: pos, exec: genInstOptConst(pos, []byte(line[1:]))})
+		} else if strings.HasPrefix(line, "align:") {
+			// alignment
+			// "align:4"
+			n, err := strconv.ParseInt(line[len("align:"):], 10, 64)
+			if err != nil || n <= 0 {
+				return nil, Error{Code: ErrParseInvalidAlign, Pos: pos}
+			}
+			matcher.instSlice = append(matcher.instSlice, inst{kind: alignKind, pos: pos, exec: genInstAlign(pos, int(n))})
+		} else if len(line) > 2 && line[0] == '(' && line[len(line)-1] == ')' && strings.Contains(line, "|") {
+			// alternation
+			// "(A|B|C)"
+			var alts [][]byte
+			min := len(line)
+			for _, alt := range strings.Split(line[1:len(line)-1], "|") {
+				alts = append(alts, []byte(alt))
+				if len(alt) < min {
+					min = len(alt)
+				}
+			}
+			matcher.instSlice = append(matcher.instSlice, inst{kind: altKind, pos: pos, exec: genInstAlt(pos, alts), min: min, lit: alts[0]})
+		} else {
+			// pure const
+			if n := len(matcher.instSlice); n > 0 && n-1 == constRun && matcher.instSlice[n-1].kind == constKind {
+				// merged into the preceding const so that they are matched with one read and one comparison
+				last := &matcher.instSlice[n-1]
+				last.lit = append(last.lit, line...)
+				constPoses = append(constPoses, pos)
+				constEnds = append(constEnds, len(last.lit))
+				last.exec = genInstConsts(constPoses, constEnds, last.lit)
+				last.min = len(last.lit)
+			} else {
+				constRun = n
+				constPoses = []int{pos}
+				constEnds = []int{len(line)}
+				matcher.instSlice = append(matcher.instSlice, inst{kind: constKind, pos: pos, exec: genInstConst(pos, []byte(line)), min: len(line), fixed: true, lit: []byte(line)})
+			}
+		}
+		if err == io.EOF {
+			switch state {
+			case nonParseState:
+			case pairsParseState:
+				// key value pairs up to EOF
+				pairs(nil)
+			case binParseState, intParseState:
+				return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrParseSuffixExpectedFor, name, line)), Pos: pos}
+			default:
+				return nil, Error{Code: ErrParseSuffixExpected, Pos: pos}
+			}
+			if len(groups) > 0 || len(branches) > 0 {
+				return nil, Error{Code: ErrParseBraceExpected, Pos: pos}
+			}
+			switch len(unresolved) {
+			case 0:
+				if matcher.singleRecord {
+					matcher.instSlice = append(matcher.instSlice, inst{kind: eofKind, pos: len(pattern) + 1, exec: genInstEOF(len(pattern) + 1), fixed: true})
+				}
+				return matcher, nil
+			case 1:
+				return nil, unresolved[0]
+			default:
+				return nil, unresolved
+			}
+		}
+		pos += len(rawLine)
+	}
+}
+
+// Match compiles pattern and matches r against it at once.
+// Use Compile instead to match the same pattern many times.
+func Match(pattern string, r io.Reader, opts ...Option) ([][]byte, error) {
+	m, err := Compile(pattern, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return m.MatchReader(r)
+}
+
+// MatchReader matches r against the pattern and returns the captures.
+// Variables terminated by a single byte suffix are read much faster if r is a *bufio.Reader.
+// Bytes looked ahead are peeked from a *bufio.Reader so that it can be shared with other parsers:
+// nothing beyond the match is consumed except by "var/bin:rest-8" which reads up to EOF.
+func (tpm *TextPatternMatcher) MatchReader(r io.Reader) (matched [][]byte, err error) {
+	return tpm.MatchReaderContext(context.Background(), r)
+}
+
+// MatchReaderContext works like MatchReader aborting the match once ctx is done.
+// ctx is checked between instructions and every some reads within an instruction
+// and then it fails with ErrCanceled caused by ctx.Err().
+// A read blocking in r isn't interrupted.
+func (tpm *TextPatternMatcher) MatchReaderContext(ctx context.Context, r io.Reader) (matched [][]byte, err error) {
+	s := tpm.newState(r)
+	if ctx.Done() != nil {
+		s.ctx = ctx
+	}
+	return tpm.match(s)
+}
+
+// MatchReaderSpill works like MatchReader except that the variables of fixed sizes
+// larger than the threshold given by WithSpillToFile are written to temp files
+// instead of memory. spilled maps the indexes of such captures, which are empty, to the paths of the files.
+// The caller is responsible for removing the files. They are removed if the match fails.
+func (tpm *TextPatternMatcher) MatchReaderSpill(r io.Reader) (matched [][]byte, spilled map[int]string, err error) {
+	s := tpm.newState(r)
+	s.spill, s.spillSize, s.spillDir = tpm.spillSize > 0, tpm.spillSize, tpm.spillDir
+	spilled = make(map[int]string)
+	err = tpm.run(s, func(buf []byte) bool {
+		if s.spilled != "" {
+			spilled[len(matched)] = s.spilled
+			s.spilled = ""
+		}
+		matched = append(matched, buf)
+		return true
+	})
+	if err != nil {
+		for _, path := range spilled {
+			os.Remove(path)
+		}
+		if s.spilled != "" {
+			os.Remove(s.spilled)
+		}
+		return nil, nil, err
+	}
+	return matched, spilled, nil
+}
+
+// MatchBytes works like MatchReader matching b.
+// It's faster than MatchReader with a bytes.Reader as consts and variables followed by a suffix
+// are matched by indexing b directly.
+// With WithZeroCopyCaptures, the captures are subslices of b.
+func (tpm *TextPatternMatcher) MatchBytes(b []byte) ([][]byte, error) {
+	s := tpm.newState(bytes.NewReader(b))
+	if !tpm.hexInput {
+		s.src = b
+		if tpm.zeroCopy {
+			s.input = b
+		}
+	}
+	return tpm.match(s)
+}
+
+// MatchString works like MatchBytes matching str.
+func (tpm *TextPatternMatcher) MatchString(str string) ([][]byte, error) {
+	return tpm.MatchBytes([]byte(str))
+}
+
+// MatchAt works like MatchReader reading ra from off without seeking it
+// so that matches at different offsets of the same ra can run concurrently.
+func (tpm *TextPatternMatcher) MatchAt(ra io.ReaderAt, off int64) ([][]byte, error) {
+	if size, ok := readerAtSize(ra); ok {
+		return tpm.MatchReader(io.NewSectionReader(ra, off, max(size-off, 0)))
+	}
+	// hide Seek so that the size isn't taken for the end of ra
+	return tpm.MatchReader(struct{ io.Reader }{io.NewSectionReader(ra, off, math.MaxInt64-off)})
+}
+
+// readerAtSize returns the size of ra and true if it's given by Size like *bytes.Reader or Stat like *os.File.
+func readerAtSize(ra io.ReaderAt) (int64, bool) {
+	switch ra := ra.(type) {
+	case interface{ Size() int64 }:
+		return ra.Size(), true
+	case interface{ Stat() (fs.FileInfo, error) }:
+		if fi, err := ra.Stat(); err == nil && fi.Mode().IsRegular() {
+			return fi.Size(), true
+		}
+	}
+	return 0, false
+}
+
+// MatchReaderWithInts works like MatchReader giving the integer variables declared by WithExternalInts
+// the values of ints by name. Names not declared are ignored.
+func (tpm *TextPatternMatcher) MatchReaderWithInts(r io.Reader, ints map[string]int) ([][]byte, error) {
+	s := tpm.newState(r)
+	tpm.setInts(s, ints)
+	return tpm.match(s)
+}
+
+// setInts sets the int binds of the integer variables declared by WithExternalInts to ints by name.
+func (tpm *TextPatternMatcher) setInts(s *matchState, ints map[string]int) {
+	for name, v := range ints {
+		if idx, ok := tpm.externals[name]; ok {
+			s.ints[idx] = v
+		}
+	}
+}
+
+// MatchReaderResult matches r against the pattern and returns the captures of named variables
+// and the values of integer variables in one pass.
+// Captures without a name like the index of an alternation aren't included.
+func (tpm *TextPatternMatcher) MatchReaderResult(r io.Reader) (*MatchResult, error) {
+	s := tpm.newState(r)
+	s.intValues = make(map[string][]int)
+	res := &MatchResult{Bytes: make(map[string][]byte), Ints: make(map[string]int)}
+	if tpm.offsets {
+		s.recordFrame, s.spans = true, true
+		res.Offsets = make(map[string][2]int)
+	}
+	err := tpm.run(s, func(buf []byte) bool {
+		if name := tpm.instSlice[s.pc].name; name != "" {
+			res.Bytes[name] = buf
+			if s.spans {
+				res.Offsets[name] = s.span
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range s.intValues {
+		res.Ints[name] = values[len(values)-1]
+	}
+	return res, nil
+}
+
+// MatchReaderNamed works like MatchReader returning the captures keyed by the name of their variables.
+// Captures without a name like "_" aren't included and the last capture wins
+// if a variable is bound more than once in a repetition.
+func (tpm *TextPatternMatcher) MatchReaderNamed(r io.Reader) (map[string][]byte, error) {
+	s := tpm.newState(r)
+	named := make(map[string][]byte)
+	err := tpm.run(s, func(buf []byte) bool {
+		if name := tpm.instSlice[s.pc].name; name != "" {
+			named[name] = buf
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return named, nil
+}
+
+// MatchReaderFunc matches r against the pattern calling fn with every capture as soon as it's bound
+// instead of returning all of them so that fn can process and discard each one.
+// index is the index of the capture and name is the name of the variable if any.
+// If fn returns an error, the match stops and fails with ErrCaptureCallback caused by it.
+func (tpm *TextPatternMatcher) MatchReaderFunc(r io.Reader, fn func(index int, name string, b []byte) error) error {
+	s := tpm.newState(r)
+	var index int
+	var ferr error
+	err := tpm.run(s, func(buf []byte) bool {
+		inst := tpm.instSlice[s.pc]
+		if ferr = fn(index, inst.name, buf); ferr != nil {
+			ferr = Error{Code: ErrCaptureCallback, Pos: inst.pos, Cause: ferr}
+			return false
+		}
+		index++
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return ferr
+}
+
+// MatchReaderInts works like MatchReader and also returns ints
+// which holds the values of integer variables by name in the order bound
+// so that an integer variable in a repetition has all of its values.
+func (tpm *TextPatternMatcher) MatchReaderInts(r io.Reader) (matched [][]byte, ints map[string][]int, err error) {
+	s := tpm.newState(r)
+	s.intValues = make(map[string][]int)
+	matched, err = tpm.match(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	return matched, s.intValues, nil
+}
+
+// MatchReaderFloats works like MatchReader and also returns floats
+// which holds the values of float variables like "var/f64le" by name in the order bound.
+func (tpm *TextPatternMatcher) MatchReaderFloats(r io.Reader) (matched [][]byte, floats map[string][]float64, err error) {
+	s := tpm.newState(r)
+	s.floatValues = make(map[string][]float64)
+	matched, err = tpm.match(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	return matched, s.floatValues, nil
+}
+
+// MatchReaderLineEndings works like MatchReader and also returns endings
+// which holds the terminators, "\n" or "\r\n", of line variables like "var/line" by name in the order bound.
+func (tpm *TextPatternMatcher) MatchReaderLineEndings(r io.Reader) (matched [][]byte, endings map[string][]string, err error) {
+	s := tpm.newState(r)
+	s.lineEndings = make(map[string][]string)
+	matched, err = tpm.match(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	return matched, s.lineEndings, nil
+}
+
+// MatchReaderRest works like MatchReader and also returns rest
+// which reads bytes read ahead but not consumed by the match, followed by r.
+// Use rest instead of r to read what follows the match.
+// With WithHexInput, rest reads the decoded bytes.
+func (tpm *TextPatternMatcher) MatchReaderRest(r io.Reader) (matched [][]byte, rest io.Reader, err error) {
+	s := tpm.newState(r)
+	matched, err = tpm.match(s)
+	if len(s.peeked) == 0 {
+		return matched, s.r, err
+	}
+	return matched, &peekReader{buf: s.peeked, r: s.r}, err
+}
+
+// MatchReaderReplay works like MatchReader and also returns frame
+// which replays exactly the bytes consumed by the match so that they can be forwarded as they are.
+// If the match fails, frame replays the bytes consumed until then.
+// With WithHexInput, frame replays the decoded bytes.
+func (tpm *TextPatternMatcher) MatchReaderReplay(r io.Reader) (matched [][]byte, frame io.Reader, err error) {
+	s := tpm.newState(r)
+	s.recordFrame = true
+	matched, err = tpm.match(s)
+	return matched, bytes.NewReader(s.frame), err
+}
+
+// Resync matches r against the pattern at its current offset and, on failure,
+// retries one byte further repeatedly up to the window given by WithResyncWindow.
+// It returns the captures and the offset the match started at, leaving r right after the match.
+// Offsets are of the decoded bytes and r isn't positioned exactly with WithHexInput.
+func (tpm *TextPatternMatcher) Resync(r io.ReadSeeker) ([][]byte, int64, error) {
+	start, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, 0, err
+	}
+	for off := start; off <= start+int64(tpm.resyncWindow); off++ {
+		if _, err = r.Seek(off, io.SeekStart); err != nil {
+			return nil, 0, err
+		}
+		s := tpm.newState(r)
+		matched, merr := tpm.match(s)
+		if merr != nil {
+			err = merr
+			continue
+		}
+		if _, err := r.Seek(off+int64(s.n), io.SeekStart); err != nil {
+			return nil, 0, err
+		}
+		return matched, off, nil
+	}
+	return nil, 0, Error{Code: ErrorCode(fmt.Sprintf(ErrResyncWindow, tpm.resyncWindow)), Cause: err}
+}
+
+// LastFrame returns the bytes consumed by the last successful match
+// if the matcher is compiled with WithCaptureFrame.
+// If matches run concurrently, it's unspecified which one is the last.
+func (tpm *TextPatternMatcher) LastFrame() []byte {
+	tpm.mu.Lock()
+	defer tpm.mu.Unlock()
+	return tpm.lastFrame
+}
+
+// LastAudit returns the consts matched by the last successful match in order
+// if the matcher is compiled with WithConstAudit.
+// Adjacent consts in the pattern are recorded as one.
+// If matches run concurrently, it's unspecified which one is the last.
+func (tpm *TextPatternMatcher) LastAudit() []ConstRecord {
+	tpm.mu.Lock()
+	defer tpm.mu.Unlock()
+	return tpm.lastAudit
+}
+
+// Consumed returns the number of bytes consumed by the last match including a failed one
+// if the matcher is compiled with WithByteCounter.
+// If matches run concurrently, it's unspecified which one is the last.
+func (tpm *TextPatternMatcher) Consumed() int {
+	tpm.mu.Lock()
+	defer tpm.mu.Unlock()
+	return tpm.consumed
+}
+
+// MarshalSpec encodes the compiled pattern along with the options into JSON
+// so that the matcher can be cached and restored by UnmarshalSpec.
+// Functions given by options like WithLogger are not encoded.
+func (tpm *TextPatternMatcher) MarshalSpec() ([]byte, error) {
+	sp := spec{
+		Version:           specVersion,
+		Pattern:           tpm.pattern,
+		MaxVariableSize:   tpm.maxVarSize,
+		GrowthFactor:      tpm.growth,
+		EOFOnEmpty:        tpm.eofOnEmpty,
+		BinaryIntFallback: tpm.binIntAuto,
+		CaptureFrame:      tpm.captureFrame,
+		SkipBOM:           tpm.skipBOM,
+		HexInput:          tpm.hexInput,
+		SkipEmptyCaptures: tpm.skipEmpty,
+		MaxExpansionDepth: tpm.maxDepth,
+		MaxCaptures:       tpm.maxCaptures,
+		MaxZeroReads:      tpm.maxZeroReads,
+		IntDigits:         tpm.intDigits,
+		SingleRecord:      tpm.singleRecord,
+		MaxLookahead:      tpm.maxLookahead,
+		PackedCaptures:    tpm.packed,
+		ByteCounter:       tpm.byteCounter,
+		ResyncWindow:      tpm.resyncWindow,
+		NilEmptyCaptures:  tpm.nilEmpty,
+		ExternalInts:      tpm.externalInts,
+		MaxVariables:      tpm.maxVars,
+		TrimTrailingSpace: tpm.trimSpace,
+		CaptureBudget:     tpm.budget,
+		ConstReadFailed:   tpm.constReadErr,
+		RecordSeparator:   tpm.recordSep,
+		Canonicalize:      tpm.canonical,
+		ZeroCopyCaptures:  tpm.zeroCopy,
+		SpillThreshold:    tpm.spillSize,
+		SpillDir:          tpm.spillDir,
+		Offsets:           tpm.offsets,
+		MaxRetries:        tpm.maxRetries,
+		StrictGrammar:     tpm.strict,
+		ConstAudit:        tpm.audit,
+		FoldSkips:         tpm.foldSkips,
+		Insts:             make([]specInst, len(tpm.instSlice)),
+	}
+	for i, in := range tpm.instSlice {
+		sp.Insts[i] = specInst{Kind: in.kind, Pos: in.pos, Name: in.name, Min: in.min, Fixed: in.fixed, Ref: in.ref, Depth: in.depth}
+	}
+	return json.Marshal(sp)
+}
+
+// UnmarshalSpec restores the matcher encoded by MarshalSpec into tpm.
+// The instructions are rebuilt from the encoded pattern and
+// it fails if they don't match the encoded instruction metadata.
+// Functions given by options to tpm like the logger are kept as is.
+func (tpm *TextPatternMatcher) UnmarshalSpec(data []byte) error {
+	var sp spec
+	if err := json.Unmarshal(data, &sp); err != nil {
+		return Error{Code: ErrSpecInvalid, Cause: err}
+	}
+	if sp.Version != specVersion {
+		return Error{Code: ErrorCode(fmt.Sprintf(ErrSpecVersion, sp.Version))}
+	}
+	m, err := compile(sp.Pattern, options{
+		maxVarSize:   sp.MaxVariableSize,
+		eofOnEmpty:   sp.EOFOnEmpty,
+		binIntAuto:   sp.BinaryIntFallback,
+		growth:       sp.GrowthFactor,
+		captureFrame: sp.CaptureFrame,
+		logger:       tpm.logger,
+		skipBOM:      sp.SkipBOM,
+		hexInput:     sp.HexInput,
+		skipEmpty:    sp.SkipEmptyCaptures,
+		maxDepth:     sp.MaxExpansionDepth,
+		maxCaptures:  sp.MaxCaptures,
+		maxZeroReads: sp.MaxZeroReads,
+		intDigits:    sp.IntDigits,
+		singleRecord: sp.SingleRecord,
+		maxLookahead: sp.MaxLookahead,
+		packed:       sp.PackedCaptures,
+		byteCounter:  sp.ByteCounter,
+		resyncWindow: sp.ResyncWindow,
+		nilEmpty:     sp.NilEmptyCaptures,
+		externalInts: sp.ExternalInts,
+		maxVars:      sp.MaxVariables,
+		trimSpace:    sp.TrimTrailingSpace,
+		budget:       sp.CaptureBudget,
+		constReadErr: sp.ConstReadFailed,
+		recordSep:    sp.RecordSeparator,
+		canonical:    sp.Canonicalize,
+		zeroCopy:     sp.ZeroCopyCaptures,
+		spillSize:    sp.SpillThreshold,
+		spillDir:     sp.SpillDir,
+		offsets:      sp.Offsets,
+		maxRetries:   sp.MaxRetries,
+		strict:       sp.StrictGrammar,
+		audit:        sp.ConstAudit,
+		foldSkips:    sp.FoldSkips,
+		transform:    tpm.transform,
+		alloc:        tpm.alloc,
+	})
+	if err != nil {
+		return err
+	}
+	if len(m.instSlice) != len(sp.Insts) {
+		return Error{Code: ErrSpecInstMismatch}
+	}
+	for i, in := range m.instSlice {
+		if (specInst{Kind: in.kind, Pos: in.pos, Name: in.name, Min: in.min, Fixed: in.fixed, Ref: in.ref, Depth: in.depth}) != sp.Insts[i] {
+			return Error{Code: ErrSpecInstMismatch, Pos: in.pos}
+		}
+	}
+	tpm.options = m.options
+	tpm.pattern = m.pattern
+	tpm.instSlice = m.instSlice
+	tpm.intBinds = m.intBinds
+	tpm.floatBinds = m.floatBinds
+	tpm.externals = m.externals
+	return nil
+}
+
+// MarshalResults encodes captures into a compact blob for transport or caching
+// which consists of the number of captures followed by each one prefixed with its length, all in uvarint.
+// UnmarshalResults decodes it.
+func MarshalResults(captures [][]byte) []byte {
+	size := binary.MaxVarintLen64
+	for _, c := range captures {
+		size += binary.MaxVarintLen64 + len(c)
+	}
+	buf := make([]byte, 0, size)
+	buf = binary.AppendUvarint(buf, uint64(len(captures)))
+	for _, c := range captures {
+		buf = binary.AppendUvarint(buf, uint64(len(c)))
+		buf = append(buf, c...)
+	}
+	return buf
+}
+
+// UnmarshalResults decodes captures encoded by MarshalResults.
+// The captures share the memory of data.
+func UnmarshalResults(data []byte) ([][]byte, error) {
+	n, l := binary.Uvarint(data)
+	if l <= 0 || n > uint64(len(data)) {
+		return nil, Error{Code: ErrResultsInvalid}
+	}
+	data = data[l:]
+	captures := make([][]byte, 0, n)
+	for i := uint64(0); i < n; i++ {
+		size, l := binary.Uvarint(data)
+		if l <= 0 || size > uint64(len(data)-l) {
+			return nil, Error{Code: ErrResultsInvalid}
+		}
+		end := l + int(size)
+		captures = append(captures, data[l:end:end])
+		data = data[end:]
+	}
+	if len(data) > 0 {
+		return nil, Error{Code: ErrResultsInvalid}
+	}
+	return captures, nil
+}
+
+// newState returns the state for a match call against r.
+// Every call has its own state so that a matcher can be used concurrently.
+func (tpm *TextPatternMatcher) newState(r io.Reader) *matchState {
+	s := &matchState{}
+	tpm.resetState(s, r)
+	return s
+}
+
+// resetState initializes s to match r reusing the int binds, the float binds and the arena s holds.
+func (tpm *TextPatternMatcher) resetState(s *matchState, r io.Reader) {
+	if tpm.hexInput {
+		r = &hexReader{r: r}
+	}
+	ints, floats, arena := s.ints[:0], s.floats[:0], s.arena[:0]
+	*s = matchState{r: r, recordFrame: tpm.captureFrame, alloc: tpm.alloc, maxZeroReads: tpm.maxZeroReads, intDigits: tpm.intDigits, maxLookahead: tpm.maxLookahead, maxRetries: tpm.maxRetries}
+	if tpm.packed {
+		if cap(arena) == 0 {
+			arena = make([]byte, 0, defaultArenaSize)
+		}
+		s.arena = arena
+	}
+	if tpm.floatBinds > 0 {
+		if cap(floats) < tpm.floatBinds {
+			floats = make([]float64, tpm.floatBinds)
+		}
+		s.floats = floats[:tpm.floatBinds]
+		clear(s.floats)
+	}
+	if len(tpm.intBinds) > 0 {
+		s.ints = append(ints, tpm.intBinds...)
+	}
+}
+
+// Acquire returns a MatchState released before if any or a new one.
+// Matching by it reuses the buffers of the previous matches to reduce allocations.
+func (tpm *TextPatternMatcher) Acquire() *MatchState {
+	if ms, ok := tpm.pool.Get().(*MatchState); ok {
+		return ms
+	}
+	return &MatchState{tpm: tpm}
+}
+
+// Release gives back ms acquired by Acquire so that it's reused.
+// The captures returned by ms must not be used after that.
+func (tpm *TextPatternMatcher) Release(ms *MatchState) {
+	if ms == nil || ms.tpm != tpm {
+		return
+	}
+	clear(ms.binds)
+	ms.binds = ms.binds[:0]
+	ms.s.r = nil
+	tpm.pool.Put(ms)
+}
+
+// MatchReader works like TextPatternMatcher.MatchReader reusing the buffers of ms.
+// The captures are valid until the next match by ms or Release.
+func (ms *MatchState) MatchReader(r io.Reader) (matched [][]byte, err error) {
+	ms.tpm.resetState(&ms.s, r)
+	binds, err := ms.tpm.matchAppend(&ms.s, ms.binds[:0])
+	if binds != nil {
+		ms.binds = binds
+	}
+	return binds, err
+}
+
+func (tpm *TextPatternMatcher) match(s *matchState) ([][]byte, error) {
+	return tpm.matchAppend(s, nil)
+}
+
+// matchAppend works like match appending the captures to binds.
+func (tpm *TextPatternMatcher) matchAppend(s *matchState, binds [][]byte) ([][]byte, error) {
+	err := tpm.run(s, func(buf []byte) bool {
+		binds = append(binds, buf)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if tpm.packed && s.input == nil {
+		pack(binds)
+	}
+	return binds, nil
+}
+
+// canonicalize replaces "\r\n" in buf with "\n".
+// buf is returned as is if it doesn't contain "\r\n" and never modified
+// since it may be referenced by a later instruction.
+func canonicalize(buf []byte) []byte {
+	if bytes.Index(buf, []byte("\r\n")) < 0 {
+		return buf
+	}
+	return bytes.ReplaceAll(buf, []byte("\r\n"), []byte("\n"))
+}
+
+// pack copies binds into a single buffer and replaces them with its subslices.
+func pack(binds [][]byte) {
+	var total int
+	for _, b := range binds {
+		total += len(b)
+	}
+	buf := make([]byte, total)
+	var off int
+	for i, b := range binds {
+		if b == nil {
+			continue
+		}
+		n := copy(buf[off:], b)
+		binds[i] = buf[off : off+n : off+n]
+		off += n
+	}
+}
+
+// All returns an iterator running the instructions against r
+// which yields every capture as soon as it's bound.
+// If the match fails, it yields the error with nil at the end.
+// Breaking the iteration stops the match leaving the rest of input unread.
+func (tpm *TextPatternMatcher) All(r io.Reader) iter.Seq2[[]byte, error] {
+	return func(yield func([]byte, error) bool) {
+		err := tpm.run(tpm.newState(r), func(buf []byte) bool {
+			return yield(buf, nil)
+		})
+		if err != nil {
+			yield(nil, err)
+		}
+	}
+}
+
+// NewScanner returns a Scanner matching records in r against m.
+func NewScanner(r io.Reader, m *TextPatternMatcher) *Scanner {
+	return &Scanner{m: m, r: r}
+}
+
+// Resync makes the Scanner recover from a malformed record
+// by skipping input up to the next marker which starts a record
+// instead of stopping with the error.
+func (sc *Scanner) Resync(marker []byte) {
+	sc.marker = marker
+}
+
+// SetInts gives the integer variables declared by WithExternalInts the values of ints by name
+// for the subsequent records.
+func (sc *Scanner) SetInts(ints map[string]int) {
+	sc.ints = ints
+}
+
+// Scan matches the next record which is available through Record.
+// It returns false when the input ends or a record is malformed unless Resync is called.
+func (sc *Scanner) Scan() bool {
+	for {
+		src := &peekReader{buf: sc.pending, r: sc.r}
+		rec := &recordReader{r: src}
+		sep := sc.m.recordSep
+		if !sc.separate {
+			sep = nil
+		}
+		var matched [][]byte
+		var s *matchState
+		err := readSeparator(rec, sep)
+		if err == nil {
+			s = sc.m.newState(rec)
+			sc.m.setInts(s, sc.ints)
+			matched, err = sc.m.match(s)
+		}
+		if err == nil {
+			sc.record = matched
+			sc.pending = append(append([]byte(nil), s.peeked...), src.buf...)
+			sc.separate = len(sc.m.recordSep) > 0
+			return true
+		}
+		sc.record = nil
+		// the input may end before or right after a separator
+		if (len(rec.buf) == 0 || len(rec.buf) == len(sep)) && (err == io.EOF || RawCause(err) == io.EOF) {
+			return false
+		}
+		if len(sc.marker) == 0 || len(rec.buf) == 0 {
+			// nothing is read to skip so that retrying never progresses
+			sc.err = err
+			return false
+		}
+		// retry from the next marker after the first byte of the malformed record
+		sc.pending = append(rec.buf[1:len(rec.buf):len(rec.buf)], src.buf...)
+		sc.separate = false
+		if !sc.skipToMarker() {
+			return false
+		}
+	}
+}
+
+// readSeparator reads sep from r failing with ErrSeparatorNotMuch if it doesn't come.
+func readSeparator(r io.Reader, sep []byte) error {
+	if len(sep) == 0 {
+		return nil
+	}
+	buf := make([]byte, len(sep))
+	if _, err := readFull(r, buf); err != nil {
+		return Error{Code: ErrSeparatorNotMuch, Cause: err}
+	}
+	if !bytes.Equal(buf, sep) {
+		return Error{Code: ErrSeparatorNotMuch}
+	}
+	return nil
+}
+
+// skipToMarker drops pending bytes before the marker reading more from the underlying reader if needed.
+// It returns false if the input ends before the marker or reading fails.
+func (sc *Scanner) skipToMarker() bool {
+	buf := make([]byte, 512)
+	for {
+		if i := bytes.Index(sc.pending, sc.marker); i >= 0 {
+			sc.pending = sc.pending[i:]
+			return true
+		}
+		// keep the bytes which may be the beginning of the marker
+		if keep := len(sc.marker) - 1; len(sc.pending) > keep {
+			sc.pending = sc.pending[len(sc.pending)-keep:]
+		}
+		n, err := sc.r.Read(buf)
+		sc.pending = append(sc.pending, buf[:n]...)
+		if err != nil && n == 0 {
+			if err != io.EOF {
+				sc.err = err
+			}
+			return false
+		}
+	}
+}
+
+// Record returns the captures of the record matched by the last Scan.
+func (sc *Scanner) Record() [][]byte {
+	return sc.record
+}
+
+// Err returns the error which stopped the Scanner if it's not the end of the input.
+func (sc *Scanner) Err() error {
+	return sc.err
+}
+
+// run runs the instructions against s calling yield with every capture.
+// It stops without error if yield returns false.
+func (tpm *TextPatternMatcher) run(s *matchState, yield func([]byte) bool) error {
+	logging := tpm.logger != nil && tpm.logger.Enabled(context.Background(), slog.LevelDebug)
+	if tpm.byteCounter {
+		defer func() {
+			tpm.mu.Lock()
+			tpm.consumed = s.n
+			tpm.mu.Unlock()
+		}()
+	}
+	var captures, total int
+	for s.pc = 0; s.pc < len(tpm.instSlice); s.pc++ {
+		i, inst := s.pc, tpm.instSlice[s.pc]
+		if s.ctx != nil && s.ctx.Err() != nil {
+			return Error{Code: ErrCanceled, Pos: inst.pos, Cause: s.ctx.Err()}
+		}
+		n := s.n
+		s.start, s.capStart = n, n
+		buf, err := inst.exec(s)
+		if logging {
+			tpm.logger.LogAttrs(context.Background(), slog.LevelDebug, "gtpm: instruction",
+				slog.String("kind", string(inst.kind)), slog.Int("pos", inst.pos), slog.Int("bytes", s.n-n), slog.Any("err", err))
+		}
+		if err != nil {
+			if s.ctx != nil && s.ctx.Err() != nil {
+				return Error{Code: ErrCanceled, Pos: inst.pos, Cause: s.ctx.Err()}
+			}
+			if e, ok := err.(Error); ok && tpm.eofOnEmpty && s.n == 0 && e.Cause == io.EOF {
+				return io.EOF
+			}
+			if errors.Is(err, io.ErrNoProgress) && s.maxZeroReads > 0 && s.zeroReads >= s.maxZeroReads {
+				return Error{Code: ErrNoProgress, Pos: inst.pos, Cause: io.ErrNoProgress}
+			}
+			if e, ok := err.(Error); ok && tpm.constReadErr && e.Code == ErrConstNotMuch && e.Cause != nil && e.Cause != io.EOF && e.Cause != io.ErrUnexpectedEOF {
+				e.Code = ErrConstReadFailed
+				return e
+			}
+			return err
+		}
+		if s.input != nil && buf != nil {
+			buf = s.alias(buf)
+		}
+		if s.spans && buf != nil {
+			if s.capStart < 0 {
+				// the bytes the capture is made of
+				s.span = [2]int{s.start, s.n}
+			} else {
+				s.span = [2]int{s.capStart, s.capStart + len(buf)}
+			}
+		}
+		if tpm.audit && inst.kind == constKind {
+			s.audit = append(s.audit, ConstRecord{Pos: inst.pos, Offset: s.start, Bytes: inst.lit})
+		}
+		if s.intValues != nil && inst.kind == intKind {
+			s.intValues[inst.name] = append(s.intValues[inst.name], s.ints[inst.out])
+		}
+		if s.floatValues != nil && inst.kind == floatKind {
+			s.floatValues[inst.name] = append(s.floatValues[inst.name], s.floats[inst.out])
+		}
+		if s.lineEndings != nil && inst.kind == lineKind {
+			s.lineEndings[inst.name] = append(s.lineEndings[inst.name], s.lineEnding)
+		}
+		if inst.ref {
+			if s.vars == nil {
+				s.vars = make([][]byte, len(tpm.instSlice))
+			}
+			s.vars[i] = buf
+		}
+		if buf != nil && tpm.canonical && (inst.kind == lineKind || inst.kind == binKind && inst.suffix != nil) {
+			buf = canonicalize(buf)
+		}
+		if buf != nil && len(buf) == 0 && tpm.skipEmpty && s.spilled == "" {
+			continue
+		}
+		if buf != nil && tpm.transform != nil {
+			if buf, err = tpm.transform(inst.name, buf); err != nil {
+				return Error{Code: ErrCaptureTransform, Pos: inst.pos, Cause: err}
+			}
+		}
+		if buf == nil {
+			continue
+		}
+		if total += len(buf); tpm.budget > 0 && total > tpm.budget {
+			return Error{Code: ErrorCode(fmt.Sprintf(ErrCaptureBudget, tpm.budget)), Pos: inst.pos}
+		}
+		if len(buf) == 0 && tpm.nilEmpty {
+			buf = nil
+		}
+		if !yield(buf) {
+			return nil
+		}
+		if captures++; captures == tpm.maxCaptures {
+			return nil
+		}
+	}
+	if tpm.captureFrame {
+		tpm.mu.Lock()
+		tpm.lastFrame = s.frame
+		tpm.mu.Unlock()
+	}
+	if tpm.audit {
+		tpm.mu.Lock()
+		tpm.lastAudit = s.audit
+		tpm.mu.Unlock()
+	}
+	return nil
+}
+
+// Schema describes the instructions of the pattern in order for tooling like code generators.
+// Instructions which match nothing in the input like the end of a repetition are omitted.
+func (tpm *TextPatternMatcher) Schema() []FieldSpec {
+	fields := make([]FieldSpec, 0, len(tpm.instSlice))
+	for _, inst := range tpm.instSlice {
+		if inst.kind == endKind || inst.kind == bomKind || inst.kind == eofKind || inst.kind == jumpKind {
+			continue
+		}
+		field := FieldSpec{Name: inst.name, Kind: string(inst.kind), Suffix: inst.suffix}
+		if inst.fixed {
+			field.FixedSize = inst.min
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// ToRegexp returns a Go regexp equivalent to the pattern
+// whose submatches are the captures if the pattern consists only of consts,
+// variables followed by a suffix and lines. Otherwise it returns ErrNotRegexp
+// with the position of the first instruction that can't be translated.
+// Variables modified like "var/bin!", "var/bin:\"" or "var/bin:~64" can't be translated except "var/bin?".
+// WithSkipBOM can't be translated either since a Go regexp can't match the raw bytes of the UTF-16 BOMs.
+func (tpm *TextPatternMatcher) ToRegexp() (string, error) {
+	var sb strings.Builder
+	sb.WriteString(`(?s)\A`)
+	for _, inst := range tpm.instSlice {
+		switch {
+		case inst.kind == constKind:
+			sb.WriteString(regexp.QuoteMeta(string(inst.lit)))
+		case inst.kind == eofKind:
+			sb.WriteString(`\z`)
+		case inst.kind == lineKind:
+			sb.WriteString(`([^\n]*?)\r?\n`)
+		case inst.kind == blindKind && inst.suffix != nil:
+			sb.WriteString(`.*?` + regexp.QuoteMeta(string(inst.suffix)))
+		case inst.kind == binKind && inst.suffix != nil && inst.modifier == "?":
+			// "var/bin?"
+			sb.WriteString(`(.*?)(?:` + regexp.QuoteMeta(string(inst.suffix)) + `|\z)`)
+		case inst.kind == binKind && inst.suffix != nil && inst.modifier != "":
+			return "", Error{Code: ErrorCode(fmt.Sprintf(ErrNotRegexp, string(inst.kind)+inst.modifier)), Pos: inst.pos}
+		case inst.kind == binKind && inst.suffix != nil:
+			sb.WriteString(`(.*?)` + regexp.QuoteMeta(string(inst.suffix)))
+		default:
+			return "", Error{Code: ErrorCode(fmt.Sprintf(ErrNotRegexp, inst.kind)), Pos: inst.pos}
+		}
+	}
+	return sb.String(), nil
+}
+
+// Check matches the input of every case and returns ErrCheckMismatch
+// for the first one whose result is not expected so that patterns can be tested succinctly.
+func (tpm *TextPatternMatcher) Check(cases []CheckCase) error {
+	for i, c := range cases {
+		got, err := tpm.MatchReader(bytes.NewReader(c.In))
+		ok := len(got) == len(c.Want)
+		for j := 0; ok && j < len(got); j++ {
+			ok = bytes.Equal(got[j], c.Want[j])
+		}
+		if c.Err == nil {
+			ok = ok && err == nil
+		} else {
+			ok = errors.Is(err, c.Err)
+		}
+		if !ok {
+			return Error{Code: ErrorCode(fmt.Sprintf(ErrCheckMismatch, i, got, err, c.Want, c.Err))}
+		}
+	}
+	return nil
+}
+
+// IsFixedSize returns the number of bytes an input must have to match and true
+// if the pattern consists only of consts and variables of fixed size.
+// Then reading the returned number of bytes at once is enough to match.
+func (tpm *TextPatternMatcher) IsFixedSize() (int, bool) {
+	var n int
+	for _, inst := range tpm.instSlice {
+		if !inst.fixed {
+			return 0, false
+		}
+		n += inst.min
+	}
+	return n, true
+}
+
+// Prefix returns the bytes an input must start with and true
+// if the pattern starts with consts so that patterns can be indexed by it.
+func (tpm *TextPatternMatcher) Prefix() ([]byte, bool) {
+	var prefix []byte
+	for _, inst := range tpm.instSlice {
+		if inst.kind != constKind {
+			break
+		}
+		prefix = append(prefix, inst.lit...)
+	}
+	return prefix, len(prefix) > 0
+}
+
+// GenerateSample returns an input the pattern matches for testing consumers of the captures or fuzzing.
+// Consts are filled as they are, the first alternative and signature are taken, every repetition is empty
+// and variables are filled with digits or zero bytes so that integers and sizes referencing them are 0.
+// It returns ErrNoSample caused by the error matching the sample
+// if the pattern depends on the input in other ways like "var/netstring" or "var/crc32".
+func (tpm *TextPatternMatcher) GenerateSample() ([]byte, error) {
+	var sample []byte
+	for i := 0; i < len(tpm.instSlice); i++ {
+		inst := tpm.instSlice[i]
+		switch {
+		case inst.lit != nil:
+			sample = append(sample, inst.lit...)
+		case inst.kind == jumpKind:
+			// the latter block of a branch whose signature is present
+			i = inst.out
+		case inst.kind == repKind:
+			if i+1 < len(tpm.instSlice) && tpm.instSlice[i+1].kind == repKind {
+				// initialization followed by the check
+				continue
+			}
+			sample = append(sample, inst.suffix...)
+			// skip the body and the end
+			for i+1 < len(tpm.instSlice) && tpm.instSlice[i+1].depth > inst.depth {
+				i++
+			}
+			i++
+		case inst.kind == lineKind:
+			sample = append(sample, "0\n"...)
+		case inst.suffix != nil:
+			sample = append(sample, placeholder(inst.suffix))
+			sample = append(sample, inst.suffix...)
+		default:
+			sample = append(sample, bytes.Repeat([]byte{'0'}, inst.min)...)
+		}
+	}
+	if _, err := tpm.match(tpm.newState(bytes.NewReader(sample))); err != nil {
+		var e Error
+		errors.As(err, &e)
+		return nil, Error{Code: ErrNoSample, Pos: e.Pos, Cause: err}
+	}
+	return sample, nil
+}
+
+// placeholder returns a digit not in suffix to fill a variable followed by suffix.
+func placeholder(suffix []byte) byte {
+	for c := byte('0'); c <= '9'; c++ {
+		if bytes.IndexByte(suffix, c) < 0 {
+			return c
+		}
+	}
+	return '0'
+}
+
+// Explain matches r and describes the result for debugging.
+// If the match fails, it tells the instruction failed with the bytes or size expected
+// and up to 32 bytes it saw.
+func (tpm *TextPatternMatcher) Explain(r io.Reader) string {
+	s := tpm.newState(r)
+	s.recordFrame = true
+	matched, err := tpm.match(s)
+	if err == nil {
+		return fmt.Sprintf("matched %d bytes with %d captures", s.n, len(matched))
+	}
+	if s.pc >= len(tpm.instSlice) {
+		return fmt.Sprintf("failed: %v", err)
+	}
+	inst := tpm.instSlice[s.pc]
+	var b strings.Builder
+	fmt.Fprintf(&b, "instruction %d (%s", s.pc, inst.kind)
+	if inst.name != "" {
+		fmt.Fprintf(&b, " %s", inst.name)
+	}
+	fmt.Fprintf(&b, " at %d) failed after %d bytes: %v\n", inst.pos, s.start, err)
+	switch {
+	case inst.kind == constKind:
+		fmt.Fprintf(&b, "expected: %q\n", inst.lit)
+	case inst.fixed:
+		fmt.Fprintf(&b, "expected: %d bytes\n", inst.min)
+	default:
+		fmt.Fprintf(&b, "expected: at least %d bytes\n", inst.min)
+	}
+	var seen []byte
+	if s.start <= len(s.frame) {
+		seen = append(seen, s.frame[s.start:]...)
+	}
+	seen = append(seen, s.peeked...)
+	if len(seen) > 32 {
+		seen = seen[:32]
+	}
+	fmt.Fprintf(&b, "actual: %q", seen)
+	return b.String()
+}
+
+// MinInputLen returns the minimum number of bytes an input must have to match.
+// Fields sized by an integer variable count as zero and
+// fields terminated by a suffix count as the length of the suffix.
+// Branches count as the shorter of the blocks.
+func (tpm *TextPatternMatcher) MinInputLen() int {
+	return tpm.minInputLen(0, len(tpm.instSlice))
+}
+
+// minInputLen returns the minimum number of bytes the from th to the to-1 th instructions consume.
+func (tpm *TextPatternMatcher) minInputLen(from, to int) int {
+	var n int
+	for i := from; i < to; i++ {
+		inst := tpm.instSlice[i]
+		switch {
+		case inst.depth > 0:
+			// repetitions may be empty
+		case inst.kind == ifKind:
+			// the jump over the latter block if any is the one not nested in another branch
+			jump := -1
+			for j := i + 1; j <= inst.out && jump < 0; j++ {
+				switch tpm.instSlice[j].kind {
+				case ifKind:
+					j = tpm.instSlice[j].out
+				case jumpKind:
+					jump = j
+				}
+			}
+			// the block is skipped without consuming anything if the signature is absent and there's no latter one
+			if jump >= 0 {
+				n += min(len(inst.lit)+tpm.minInputLen(i+1, jump), tpm.minInputLen(jump+1, inst.out+1))
+			}
+			i = inst.out
+		default:
+			n += inst.min
+		}
+	}
+	return n
+}
+
+func genInstConst(pos int, match []byte) instruction {
+	return func(r *matchState) ([]byte, error) {
+		if rest, ok := r.rest(); ok {
+			if len(rest) < len(match) {
+				r.consume(rest)
+				return nil, Error{Code: ErrConstNotMuch, Pos: pos, Cause: io.EOF}
+			}
+			r.consume(rest[:len(match)])
+			if !bytes.Equal(match, rest[:len(match)]) {
+				return nil, Error{Code: ErrConstNotMuch, Pos: pos}
+			}
+			return nil, nil
+		}
+		l := len(match)
+		buf := make([]byte, l)
+		for i := 0; i < l; {
+			n, err := r.Read(buf[i:])
+			if err != nil {
+				return nil, Error{Code: ErrConstNotMuch, Pos: pos, Cause: err}
+			}
+			i += n
+		}
+		if !bytes.Equal(match, buf) {
+			return nil, Error{Code: ErrConstNotMuch, Pos: pos}
+		}
+		return nil, nil
+	}
+}
+
+// genInstConsts matches the concatenation of consts at once.
+// ends are the offsets in match where each const ends and an error is reported at the pos of the const failed.
+func genInstConsts(poses []int, ends []int, match []byte) instruction {
+	return func(r *matchState) ([]byte, error) {
+		buf := make([]byte, len(match))
+		var i int
+		var err error
+		for i < len(buf) && err == nil {
+			var n int
+			n, err = r.Read(buf[i:])
+			i += n
+		}
+		var start int
+		for k, end := range ends {
+			if end > i {
+				return nil, Error{Code: ErrConstNotMuch, Pos: poses[k], Cause: err}
+			}
+			if !bytes.Equal(match[start:end], buf[start:end]) {
+				return nil, Error{Code: ErrConstNotMuch, Pos: poses[k]}
+			}
+			start = end
+		}
+		return nil, nil
+	}
+}
+
+// genInstAlt tries alts in order and binds the index of the first one matched.
+// Bytes read ahead for longer alternatives are peeked and left unconsumed.
+func genInstAlt(pos int, alts [][]byte) instruction {
+	return func(r *matchState) ([]byte, error) {
+		var buf []byte
+		var cause error
+		for i, alt := range alts {
+			if len(buf) < len(alt) && cause == nil {
+				if err := r.lookaheadTooLong(pos, len(alt)); err != nil {
+					return nil, err
+				}
+				buf = make([]byte, len(alt))
+				n, err := r.peek(buf)
+				buf = buf[:n]
+				cause = err
+			}
+			if len(buf) >= len(alt) && bytes.Equal(alt, buf[:len(alt)]) {
+				r.skip(len(alt))
+				r.capStart = -1
+				return []byte(strconv.Itoa(i)), nil
+			}
+		}
+		return nil, Error{Code: ErrAltNotMuch, Pos: pos, Cause: cause}
+	}
+}
+
+// genInstOptConst binds '1' if match comes next, otherwise '0' without consuming anything.
+func genInstOptConst(pos int, match []byte) instruction {
+	return func(r *matchState) ([]byte, error) {
+		if err := r.lookaheadTooLong(pos, len(match)); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, len(match))
+		_, err := r.peek(buf)
+		if err != nil && err != io.EOF {
+			return nil, Error{Code: ErrConstNotMuch, Pos: pos, Cause: err}
+		}
+		r.capStart = -1
+		if err == nil && bytes.Equal(match, buf) {
+			r.skip(len(match))
+			return []byte("1"), nil
+		}
+		return []byte("0"), nil
+	}
+}
+
+// genInstIf binds '1' consuming sig if it comes next, otherwise '0' jumping to the else th instruction.
+func genInstIf(pos int, sig []byte, els int) instruction {
+	opt := genInstOptConst(pos, sig)
+	return func(r *matchState) ([]byte, error) {
+		buf, err := opt(r)
+		if err == nil && buf[0] == '0' {
+			r.pc = els
+		}
+		return buf, err
+	}
+}
+
+// genInstJump jumps to the to th instruction.
+func genInstJump(to int) instruction {
+	return func(r *matchState) ([]byte, error) {
+		r.pc = to
+		return nil, nil
+	}
+}
+
+// genInstRepInit resets the number of repetitions held by the count th int bind.
+func genInstRepInit(count int) instruction {
+	return func(r *matchState) ([]byte, error) {
+		r.ints[count] = 0
+		return nil, nil
+	}
+}
+
+// genInstRepUntil ends a repetition by jumping to the end th instruction
+// if term comes next and binds the number of repetitions held by the count th int bind.
+// Otherwise it records the offset where the repetition starts in the mark th int bind
+// and fails if the last one consumed nothing so that it never repeats forever.
+func genInstRepUntil(pos int, term []byte, count int, mark int, end int) instruction {
+	return func(r *matchState) ([]byte, error) {
+		if err := r.lookaheadTooLong(pos, len(term)); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, len(term))
+		n, err := r.peek(buf)
+		if err == nil && bytes.Equal(term, buf) {
+			r.skip(len(term))
+			r.pc = end
+			r.capStart = -1
+			return []byte(strconv.Itoa(r.ints[count])), nil
+		}
+		if n == 0 && err != nil {
+			// neither terminator nor another repetition comes
+			return nil, Error{Code: ErrConstNotMuch, Pos: pos, Cause: err}
+		}
+		if r.ints[count] > 0 && r.ints[mark] == r.n {
+			return nil, Error{Code: ErrRepNoProgress, Pos: pos}
+		}
+		r.ints[mark] = r.n
+		return nil, nil
+	}
+}
+
+// genInstRepUntilEOF ends a repetition by jumping to the end th instruction
+// if the input ends and binds the number of repetitions held by the count th int bind.
+func genInstRepUntilEOF(pos int, count int, end int) instruction {
+	return func(r *matchState) ([]byte, error) {
+		n, err := r.peek(make([]byte, 1))
+		if n == 0 && err == io.EOF {
+			r.pc = end
+			r.capStart = -1
+			return []byte(strconv.Itoa(r.ints[count])), nil
+		}
+		if n == 0 {
+			return nil, Error{Code: ErrConstNotMuch, Pos: pos, Cause: err}
+		}
+		return nil, nil
+	}
+}
+
+// genInstPairValue binds the value of a key value pair terminated by sep, which is consumed,
+// term, which is left unread, or EOF.
+func genInstPairValue(pos int, sep byte, term []byte, max int, growth float64) instruction {
+	return func(r *matchState) ([]byte, error) {
+		var idx int
+		bs := 16
+		buf := r.newBuf(bs)
+		ahead := make([]byte, len(term))
+		for {
+			if len(term) > 0 {
+				if n, _ := r.peek(ahead); n == len(term) && bytes.Equal(term, ahead) {
+					return buf[:idx], nil
+				}
+			}
+			if _, err := readFull(r, buf[idx:idx+1]); err == io.EOF {
+				return buf[:idx], nil
+			} else if err != nil {
+				return nil, Error{Code: ErrVarNotMuch, Pos: pos, Cause: err}
+			}
+			if buf[idx] == sep {
+				return buf[:idx], nil
+			}
+			idx++
+			if idx == bs {
+				// extend buf
+				bs = grow(bs, growth)
+				if bs > max {
+					return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, max)), Pos: pos}
+				}
+				new := r.newBuf(bs)
+				copy(new, buf)
+				buf = new
+			}
+		}
+	}
+}
+
+// genInstRepWithinInit starts a repetition recording the offset where it starts.
+func genInstRepWithinInit(count int, start int) instruction {
+	return func(r *matchState) ([]byte, error) {
+		r.ints[count] = 0
+		r.ints[start] = r.n
+		return nil, nil
+	}
+}
+
+// genInstRepWithin ends a repetition by jumping to the end th instruction
+// once the bytes held by the length th int bind are consumed since the offset held by the start th int bind
+// and binds the number of repetitions held by the count th int bind.
+// It fails if the last repetition consumed more than that or nothing,
+// recording the offset where each repetition starts in the mark th int bind.
+func genInstRepWithin(pos int, length int, start int, count int, mark int, end int) instruction {
+	return func(r *matchState) ([]byte, error) {
+		consumed := r.n - r.ints[start]
+		if consumed > r.ints[length] {
+			return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrRepOverrun, r.ints[length])), Pos: pos}
+		}
+		if consumed == r.ints[length] {
+			r.pc = end
+			r.capStart = -1
+			return []byte(strconv.Itoa(r.ints[count])), nil
+		}
+		if r.ints[count] > 0 && r.ints[mark] == r.n {
+			return nil, Error{Code: ErrRepNoProgress, Pos: pos}
+		}
+		r.ints[mark] = r.n
+		return nil, nil
+	}
+}
+
+// genInstRepTimes ends a repetition by jumping to the end th instruction
+// once it's repeated the times held by the times th int bind.
+// It fails if the times or the total bytes of the items of the size held by the size th int bind exceed max.
+func genInstRepTimes(pos int, times int, size int, count int, end int, max int) instruction {
+	return func(r *matchState) ([]byte, error) {
+		if t := r.ints[times]; t < 0 || t > max || (r.ints[size] > 0 && t > max/r.ints[size]) {
+			return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, max)), Pos: pos}
+		}
+		if r.ints[count] == r.ints[times] {
+			r.pc = end
+		}
+		return nil, nil
+	}
+}
+
+// genInstRepEnd counts a repetition up and jumps back to the check instruction.
+func genInstRepEnd(count int, check int) instruction {
+	return func(r *matchState) ([]byte, error) {
+		r.ints[count]++
+		r.pc = check - 1
+		return nil, nil
+	}
+}
+
+// genInstEOF fails unless the input ends.
+func genInstEOF(pos int) instruction {
+	return func(r *matchState) ([]byte, error) {
+		buf := make([]byte, 1)
+		n, err := r.peek(buf)
+		if n > 0 {
+			return nil, Error{Code: ErrNotEOF, Pos: pos}
+		}
+		if err != io.EOF {
+			return nil, Error{Code: ErrNotEOF, Pos: pos, Cause: err}
+		}
+		return nil, nil
+	}
+}
+
+// genInstBOM skips a UTF-8(EF BB BF) or UTF-16(FE FF or FF FE) byte order mark if present.
+// It reads no more than the bytes needed to tell whether it's present.
+func genInstBOM() instruction {
+	return func(r *matchState) ([]byte, error) {
+		buf := make([]byte, 3)
+		if _, err := r.peek(buf[:1]); err != nil {
+			return nil, nil
+		}
+		var bom []byte
+		switch buf[0] {
+		case 0xEF:
+			bom = []byte{0xEF, 0xBB, 0xBF}
+		case 0xFE:
+			bom = []byte{0xFE, 0xFF}
+		case 0xFF:
+			bom = []byte{0xFF, 0xFE}
+		default:
+			return nil, nil
+		}
+		n, _ := r.peek(buf[:len(bom)])
+		if bytes.Equal(bom, buf[:n]) {
+			r.skip(len(bom))
+		}
+		return nil, nil
+	}
+}
+
+// genInstAlign skips bytes until the number of bytes consumed is a multiple of align.
+func genInstAlign(pos int, align int) instruction {
+	return func(r *matchState) ([]byte, error) {
+		buf := make([]byte, (align-r.n%align)%align)
+		if _, err := readFull(r, buf); err != nil {
+			return nil, Error{Code: ErrVarNotMuch, Pos: pos, Cause: err}
+		}
+		return nil, nil
+	}
+}
+
+// genInstVarWithSize binds a variable of the size held by the sizeBind th int bind.
+func genInstVarWithSize(pos int, sizeBind int, capture bool, max int) instruction {
+	return func(r *matchState) ([]byte, error) {
+		size := r.ints[sizeBind]
+		if size < 0 {
+			return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, max)), Pos: pos}
+		}
+		if capture && r.spill && size > r.spillSize {
+			return r.spillVar(pos, size)
+		}
+		if size > max {
+			return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, max)), Pos: pos}
+		}
+		buf := r.newBuf(size)
+		for i := 0; i < size; {
+			n, err := r.Read(buf[i:])
+			if err != nil {
+				return nil, Error{Code: ErrVarNotMuch, Pos: pos, Cause: err}
+			}
+			i += n
+		}
+		if capture {
+			return buf, nil
+		} else {
+			return nil, nil
+		}
+	}
+}
+
+// genInstVarHex binds a variable of the size held by the sizeBind th int bind
+// decoded from twice as many hex digits.
+func genInstVarHex(pos int, sizeBind int, max int) instruction {
+	return func(r *matchState) ([]byte, error) {
+		size := r.ints[sizeBind]
+		if size < 0 || size > max {
+			return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, max)), Pos: pos}
+		}
+		digits := make([]byte, 2*size)
+		if _, err := readFull(r, digits); err != nil {
+			return nil, Error{Code: ErrVarNotMuch, Pos: pos, Cause: err}
+		}
+		buf := r.newBuf(size)
+		if _, err := hex.Decode(buf, digits); err != nil {
+			return nil, Error{Code: ErrVarNotMuch, Pos: pos, Cause: err}
+		}
+		r.capStart = -1
+		return buf, nil
+	}
+}
+
+// genInstVarBySize binds a variable of the size sizes maps the value of the discBind th int bind to.
+func genInstVarBySize(pos int, discBind int, sizes map[int]int) instruction {
+	return func(r *matchState) ([]byte, error) {
+		size, ok := sizes[r.ints[discBind]]
+		if !ok {
+			return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrSizeNotFound, r.ints[discBind])), Pos: pos}
+		}
+		buf := r.newBuf(size)
+		if _, err := readFull(r, buf); err != nil {
+			return nil, Error{Code: ErrVarNotMuch, Pos: pos, Cause: err}
+		}
+		return buf, nil
+	}
+}
+
+// genInstVarFrame binds a variable up to the end of a frame
+// whose total length is held by the lenBind th int bind.
+func genInstVarFrame(pos int, lenBind int, max int) instruction {
+	return func(r *matchState) ([]byte, error) {
+		size := r.ints[lenBind] - r.n
+		if size < 0 {
+			return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrFrameOverrun, r.n)), Pos: pos}
+		}
+		if size > max {
+			return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, max)), Pos: pos}
+		}
+		buf := r.newBuf(size)
+		if _, err := readFull(r, buf); err != nil {
+			return nil, Error{Code: ErrVarNotMuch, Pos: pos, Cause: err}
+		}
+		return buf, nil
+	}
+}
+
+// genInstVarNonPad binds a variable like genInstVarWithSize
+// but fails if the bytes read are all pad.
+func genInstVarNonPad(pos int, sizeBind int, pad byte, max int) instruction {
+	read := genInstVarWithSize(pos, sizeBind, true, max)
+	return func(r *matchState) ([]byte, error) {
+		buf, err := read(r)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range buf {
+			if b != pad {
+				return buf, nil
+			}
+		}
+		return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrVarPadded, pad)), Pos: pos}
+	}
+}
+
+// genInstVarRest binds a variable consisting of the rest of input except the last trailer bytes.
+// The trailer bytes are left for the subsequent instructions.
+func genInstVarRest(pos int, trailer int, max int) instruction {
+	return func(r *matchState) ([]byte, error) {
+		if size, ok := r.remaining(); ok {
+			// the size is known in advance so read it at once
+			if size < trailer {
+				return nil, Error{Code: ErrVarNotMuch, Pos: pos, Cause: io.EOF}
+			}
+			if size-trailer > max {
+				return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, max)), Pos: pos}
+			}
+			buf := r.newBuf(size - trailer)
+			if _, err := readFull(r, buf); err != nil {
+				return nil, Error{Code: ErrVarNotMuch, Pos: pos, Cause: err}
+			}
+			return buf, nil
+		}
+		buf, err := io.ReadAll(io.LimitReader(r, int64(max+trailer)+1))
+		if err != nil {
+			return nil, Error{Code: ErrVarNotMuch, Pos: pos, Cause: err}
+		}
+		if len(buf) < trailer {
+			r.unread(buf)
+			return nil, Error{Code: ErrVarNotMuch, Pos: pos, Cause: io.EOF}
+		}
+		if len(buf)-trailer > max {
+			return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, max)), Pos: pos}
+		}
+		r.unread(buf[len(buf)-trailer:])
+		return buf[:len(buf)-trailer], nil
+	}
+}
+
+func genInstVarWithoutSize(pos int, suffix []byte, capture bool, max int, growth float64) instruction {
+	limit := maxBufSize(max, growth)
+	return func(r *matchState) ([]byte, error) {
+		if br, ok := r.bufReader(); ok && len(suffix) == 1 {
+			return readVarUntilByte(r, br, pos, suffix[0], capture, limit, max)
+		}
+		if rest, ok := r.rest(); ok {
+			return indexVar(r, rest, pos, suffix, capture, limit, max)
+		}
+		var idx int
+		var midx int
+		bs := 16
+		buf := r.newBuf(bs)
+		for {
+			_, err := r.Read(buf[idx : idx+1])
+			if err != nil {
+				return nil, Error{Code: ErrVarNotMuch, Pos: pos, Cause: err}
+			}
+			idx++
+			if idx >= len(suffix) {
+				if bytes.Equal(suffix, buf[midx:midx+len(suffix)]) {
+					if capture {
+						return buf[:midx], nil
+					} else {
+						return nil, nil
+					}
+				}
+				midx++
+			}
+			if idx == bs {
+				// extend buf
+				bs = grow(bs, growth)
+				if bs > max {
+					return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, max)), Pos: pos}
+				}
+				new := r.newBuf(bs)
+				copy(new, buf)
+				buf = new
+			}
+		}
+	}
+}
+
+// genInstVarUntilEOF binds a variable terminated by suffix or EOF whichever comes first.
+func genInstVarUntilEOF(pos int, suffix []byte, max int, growth float64) instruction {
+	return func(r *matchState) ([]byte, error) {
+		var idx int
+		bs := 16
+		buf := r.newBuf(bs)
+		for {
+			if _, err := readFull(r, buf[idx:idx+1]); err == io.EOF {
+				return buf[:idx], nil
+			} else if err != nil {
+				return nil, Error{Code: ErrVarNotMuch, Pos: pos, Cause: err}
+			}
+			idx++
+			if midx := idx - len(suffix); midx >= 0 && bytes.Equal(suffix, buf[midx:idx]) {
+				return buf[:midx], nil
+			}
+			if idx == bs {
+				// extend buf
+				bs = grow(bs, growth)
+				if bs > max {
+					return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, max)), Pos: pos}
+				}
+				new := r.newBuf(bs)
+				copy(new, buf)
+				buf = new
 			}
-			state = nonParseState
-		} else {
-			// pure const
-			matcher.instSlice = append(matcher.instSlice, genInstConst(pos, []byte(line)))
 		}
-		if err == io.EOF {
-			if state != nonParseState {
-				return nil, Error{Code: ErrParseSuffixExpected, Pos: pos}
+	}
+}
+
+// indexVar binds a variable terminated by suffix by indexing rest returned by r.rest
+// instead of reading byte by byte. It fails as genInstVarWithoutSize does if the variable and suffix exceed limit bytes.
+func indexVar(r *matchState, rest []byte, pos int, suffix []byte, capture bool, limit int, max int) ([]byte, error) {
+	i := bytes.Index(rest, suffix)
+	if i < 0 || i+len(suffix) > limit {
+		if len(rest) < limit {
+			r.consume(rest)
+			return nil, Error{Code: ErrVarNotMuch, Pos: pos, Cause: io.EOF}
+		}
+		r.consume(rest[:limit])
+		return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, max)), Pos: pos}
+	}
+	r.consume(rest[:i+len(suffix)])
+	if !capture {
+		return nil, nil
+	}
+	buf := r.newBuf(i)
+	copy(buf, rest[:i])
+	return buf, nil
+}
+
+// readVarUntilByte binds a variable terminated by delim reading br chunk by chunk
+// instead of byte by byte. It fails as genInstVarWithoutSize does if the variable and delim exceed limit bytes.
+func readVarUntilByte(r *matchState, br *bufio.Reader, pos int, delim byte, capture bool, limit int, max int) ([]byte, error) {
+	var buf []byte
+	var n int
+	for {
+		chunk, err := r.readSlice(br, delim)
+		n += len(chunk)
+		if n > limit {
+			return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, max)), Pos: pos}
+		}
+		if capture {
+			if n > cap(buf) {
+				grown := r.newBuf(n + cap(buf))
+				buf = grown[:copy(grown, buf)]
 			}
-			return matcher, nil
+			buf = append(buf, chunk...)
+		}
+		if err == nil {
+			if capture {
+				return buf[:n-1], nil
+			}
+			return nil, nil
+		}
+		if err != bufio.ErrBufferFull {
+			return nil, Error{Code: ErrVarNotMuch, Pos: pos, Cause: err}
 		}
-		pos += len(rawLine)
 	}
 }
 
-func (tpm *TextPatternMatcher) MatchReader(r io.Reader) (matched [][]byte, err error) {
-	var binds [][]byte
-	for _, inst := range tpm.instSlice {
-		buf, err := inst(r)
+// genInstLine binds a line terminated by "\n" or "\r\n" and records which one terminated it.
+func genInstLine(pos int, max int, growth float64) instruction {
+	exec := genInstVarWithoutSize(pos, []byte("\n"), true, max, growth)
+	return func(r *matchState) ([]byte, error) {
+		buf, err := exec(r)
 		if err != nil {
 			return nil, err
 		}
-		if buf != nil {
-			binds = append(binds, buf)
+		if n := len(buf); n > 0 && buf[n-1] == '\r' {
+			r.lineEnding = "\r\n"
+			return buf[:n-1], nil
 		}
+		r.lineEnding = "\n"
+		return buf, nil
 	}
-	return binds, nil
 }
 
-func genInstConst(pos int, match []byte) instruction {
-	return func(r io.Reader) ([]byte, error) {
-		l := len(match)
-		buf := make([]byte, l)
-		for i := 0; i < l; {
-			n, err := r.Read(buf[i:])
-			if err != nil {
-				return nil, Error{Code: ErrConstNotMuch, Pos: pos, Cause: err}
-			}
-			i += n
+// genInstLength reads a decimal length followed by ':' into the outBind th int bind without binding it.
+// It fails if the length is negative or exceeds max.
+func genInstLength(pos int, outBind int, max int, growth float64) instruction {
+	exec := genInstIntWithoutSize(pos, []byte(":"), outBind, max, growth)
+	return func(r *matchState) ([]byte, error) {
+		if _, err := exec(r); err != nil {
+			return nil, err
 		}
-		if !bytes.Equal(match, buf) {
-			return nil, Error{Code: ErrConstNotMuch, Pos: pos}
+		if r.ints[outBind] < 0 || r.ints[outBind] > max {
+			return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, max)), Pos: pos}
 		}
 		return nil, nil
 	}
 }
 
-func genInstVarWithSize(pos int, size *int, capture bool) instruction {
-	return func(r io.Reader) ([]byte, error) {
-		buf := make([]byte, *size)
-		for i := 0; i < *size; {
-			n, err := r.Read(buf[i:])
-			if err != nil {
-				return nil, Error{Code: ErrVarNotMuch, Pos: pos, Cause: err}
+// genInstVarNetstring binds the data of a netstring like "5:hello,".
+// The length must be a decimal without leading zeros and not exceed max.
+func genInstVarNetstring(pos int, max int) instruction {
+	return func(r *matchState) ([]byte, error) {
+		var l, digits int
+		b := make([]byte, 1)
+		for {
+			if _, err := readFull(r, b); err != nil {
+				return nil, Error{Code: ErrNetstringNotMuch, Pos: pos, Cause: err}
+			}
+			if b[0] == ':' && digits > 0 {
+				break
+			}
+			if b[0] < '0' || b[0] > '9' || (digits > 0 && l == 0) {
+				return nil, Error{Code: ErrNetstringNotMuch, Pos: pos}
+			}
+			l = l*10 + int(b[0]-'0')
+			digits++
+			if l > max {
+				return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, max)), Pos: pos}
 			}
-			i += n
 		}
-		if capture {
-			return buf, nil
-		} else {
-			return nil, nil
+		r.capStart = r.n
+		buf := r.newBuf(l + 1)
+		if _, err := readFull(r, buf); err != nil {
+			return nil, Error{Code: ErrNetstringNotMuch, Pos: pos, Cause: err}
+		}
+		if buf[l] != ',' {
+			return nil, Error{Code: ErrNetstringNotMuch, Pos: pos}
 		}
+		return buf[:l], nil
 	}
 }
 
-func genInstVarWithoutSize(pos int, suffix []byte, capture bool, max int) instruction {
-	return func(r io.Reader) ([]byte, error) {
+// genInstRun binds a run of b up to another byte which is left unread or EOF.
+func genInstRun(pos int, b byte, max int, growth float64) instruction {
+	return func(r *matchState) ([]byte, error) {
 		var idx int
-		var midx int
 		bs := 16
-		buf := make([]byte, bs)
+		buf := r.newBuf(bs)
 		for {
-			_, err := r.Read(buf[idx : idx+1])
-			if err != nil {
+			if _, err := r.peek(buf[idx : idx+1]); err == io.EOF {
+				return buf[:idx], nil
+			} else if err != nil {
+				return nil, Error{Code: ErrVarNotMuch, Pos: pos, Cause: err}
+			}
+			if buf[idx] != b {
+				return buf[:idx], nil
+			}
+			r.skip(1)
+			idx++
+			if idx == bs {
+				// extend buf
+				bs = grow(bs, growth)
+				if bs > max {
+					return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, max)), Pos: pos}
+				}
+				new := r.newBuf(bs)
+				copy(new, buf)
+				buf = new
+			}
+		}
+	}
+}
+
+// genInstVarCRC32 binds a variable up to the first 4 bytes which are the CRC-32 of it in big endian
+// computing the checksum incrementally as bytes arrive.
+func genInstVarCRC32(pos int, max int, growth float64) instruction {
+	return func(r *matchState) ([]byte, error) {
+		var idx int
+		var crc uint32
+		bs := 16
+		buf := r.newBuf(bs)
+		for {
+			if _, err := readFull(r, buf[idx:idx+1]); err != nil {
 				return nil, Error{Code: ErrVarNotMuch, Pos: pos, Cause: err}
 			}
 			idx++
-			if idx >= len(suffix) {
-				if bytes.Equal(suffix, buf[midx:midx+len(suffix)]) {
-					if capture {
-						return buf[:midx], nil
-					} else {
-						return nil, nil
-					}
+			if l := idx - crc32.Size; l >= 0 {
+				if l > 0 {
+					crc = crc32.Update(crc, crc32.IEEETable, buf[l-1:l])
 				}
-				midx++
+				if binary.BigEndian.Uint32(buf[l:idx]) == crc {
+					return buf[:l], nil
+				}
+			}
+			if idx == bs {
+				// extend buf
+				bs = grow(bs, growth)
+				if bs > max {
+					return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, max)), Pos: pos}
+				}
+				new := r.newBuf(bs)
+				copy(new, buf)
+				buf = new
+			}
+		}
+	}
+}
+
+// genInstVarNest binds a region starting with open and ending with the close balancing it.
+func genInstVarNest(pos int, open, close byte, max int, growth float64) instruction {
+	return func(r *matchState) ([]byte, error) {
+		var idx, depth int
+		bs := 16
+		buf := r.newBuf(bs)
+		for {
+			if _, err := readFull(r, buf[idx:idx+1]); err != nil {
+				return nil, Error{Code: ErrNestNotMuch, Pos: pos, Cause: err}
+			}
+			c := buf[idx]
+			idx++
+			switch {
+			case c == open:
+				depth++
+			case idx == 1:
+				return nil, Error{Code: ErrNestNotMuch, Pos: pos}
+			case c == close:
+				depth--
+				if depth == 0 {
+					return buf[:idx], nil
+				}
+			}
+			if idx == bs {
+				// extend buf
+				bs = grow(bs, growth)
+				if bs > max {
+					return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, max)), Pos: pos}
+				}
+				new := r.newBuf(bs)
+				copy(new, buf)
+				buf = new
+			}
+		}
+	}
+}
+
+// genInstVarQuoted binds a variable terminated by suffix which doesn't count between quotes.
+// A quote preceded by a backslash between quotes doesn't close them.
+func genInstVarQuoted(pos int, suffix []byte, quote byte, max int, growth float64) instruction {
+	return func(r *matchState) ([]byte, error) {
+		var idx int
+		// closed is the index next to the last closing quote
+		var closed int
+		var inQuote, escaped bool
+		bs := 16
+		buf := r.newBuf(bs)
+		for {
+			if _, err := readFull(r, buf[idx:idx+1]); err != nil {
+				return nil, Error{Code: ErrVarNotMuch, Pos: pos, Cause: err}
+			}
+			c := buf[idx]
+			idx++
+			switch {
+			case inQuote && escaped:
+				escaped = false
+			case inQuote && c == '\\':
+				escaped = true
+			case inQuote && c == quote:
+				inQuote = false
+				closed = idx
+			case c == quote:
+				inQuote = true
+			case !inQuote && idx-len(suffix) >= closed && bytes.Equal(suffix, buf[idx-len(suffix):idx]):
+				return buf[:idx-len(suffix)], nil
 			}
 			if idx == bs {
 				// extend buf
-				bs *= 2
+				bs = grow(bs, growth)
 				if bs > max {
 					return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, max)), Pos: pos}
 				}
-				new := make([]byte, bs)
+				new := r.newBuf(bs)
 				copy(new, buf)
 				buf = new
 			}
@@ -328,31 +3823,234 @@ func genInstVarWithoutSize(pos int, suffix []byte, capture bool, max int) instru
 	}
 }
 
-func genInstIntWithSize(pos int, size *int, outSize *int) instruction {
-	return func(r io.Reader) ([]byte, error) {
-		buf := make([]byte, *size)
-		for i := 0; i < *size; {
+// genInstVarUpTo binds a variable terminated by suffix within limit bytes.
+// If suffix doesn't come within limit bytes, it binds limit bytes leaving suffix unread if truncate is true
+// or fails otherwise.
+func genInstVarUpTo(pos int, suffix []byte, limit int, truncate bool) instruction {
+	return func(r *matchState) ([]byte, error) {
+		buf := r.newBuf(limit + len(suffix))
+		for idx := 0; idx < limit; idx++ {
+			if _, err := readFull(r, buf[idx:idx+1]); err != nil {
+				return nil, Error{Code: ErrVarNotMuch, Pos: pos, Cause: err}
+			}
+			if midx := idx + 1 - len(suffix); midx >= 0 && bytes.Equal(suffix, buf[midx:idx+1]) {
+				return buf[:midx], nil
+			}
+		}
+		// the suffix overlapping the limit is peeked so that it's left unread on truncation
+		n, err := r.peek(buf[limit:])
+		for idx := limit; idx < limit+n; idx++ {
+			if midx := idx + 1 - len(suffix); midx >= 0 && bytes.Equal(suffix, buf[midx:idx+1]) {
+				r.skip(idx + 1 - limit)
+				return buf[:midx], nil
+			}
+		}
+		if err != nil {
+			return nil, Error{Code: ErrVarNotMuch, Pos: pos, Cause: err}
+		}
+		if !truncate {
+			return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, limit)), Pos: pos}
+		}
+		return buf[:limit], nil
+	}
+}
+
+// genInstRequired runs exec and fails if the variable bound by exec is empty.
+func genInstRequired(pos int, name string, exec instruction) instruction {
+	return func(r *matchState) ([]byte, error) {
+		buf, err := exec(r)
+		if err == nil && len(buf) == 0 {
+			return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrVarRequired, name)), Pos: pos}
+		}
+		return buf, err
+	}
+}
+
+// genInstVarWithRefSuffix binds a variable terminated by the bytes bound by the ref th instruction.
+func genInstVarWithRefSuffix(pos int, ref int, capture bool, max int, growth float64) instruction {
+	return func(r *matchState) ([]byte, error) {
+		suffix, ok := r.boundVar(ref)
+		if !ok || len(suffix) == 0 {
+			return nil, Error{Code: ErrSuffixEmpty, Pos: pos}
+		}
+		return genInstVarWithoutSize(pos, suffix, capture, max, growth)(r)
+	}
+}
+
+// genInstVarEqual binds a variable which must equal the one bound by the ref th instruction named other.
+func genInstVarEqual(pos int, ref int, other string) instruction {
+	return func(r *matchState) ([]byte, error) {
+		want, ok := r.boundVar(ref)
+		if !ok {
+			return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrVarNotBound, other)), Pos: pos}
+		}
+		buf := r.newBuf(len(want))
+		if _, err := readFull(r, buf); err != nil {
+			return nil, Error{Code: ErrVarNotMuch, Pos: pos, Cause: err}
+		}
+		if !bytes.Equal(want, buf) {
+			return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrVarNotEqual, other)), Pos: pos}
+		}
+		return buf, nil
+	}
+}
+
+// genInstIntEqual reads an integer of size bytes which must equal want without binding it.
+func genInstIntEqual(pos int, size int, want int) instruction {
+	return func(r *matchState) ([]byte, error) {
+		buf := make([]byte, size)
+		if _, err := readFull(r, buf); err != nil {
+			return nil, Error{Code: ErrIntVarNotMuch, Pos: pos, Cause: err}
+		}
+		n, err := r.parseInt(buf)
+		if err != nil {
+			return nil, Error{Code: ErrIntVarNotMuch, Pos: pos, Cause: err}
+		}
+		if int(n) != want {
+			return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrIntNotEqual, want)), Pos: pos}
+		}
+		return nil, nil
+	}
+}
+
+// genInstIntWithSize binds an integer variable written in decimal to the outBind th int bind.
+// Its size is held by the sizeBind th int bind.
+// If binFallback is true, bytes which aren't decimal are decoded as a big-endian unsigned integer.
+func genInstIntWithSize(pos int, sizeBind int, outBind int, binFallback bool, max int) instruction {
+	return func(r *matchState) ([]byte, error) {
+		size := r.ints[sizeBind]
+		if size < 0 || size > max {
+			return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, max)), Pos: pos}
+		}
+		buf := r.newBuf(size)
+		for i := 0; i < size; {
 			n, err := r.Read(buf[i:])
 			if err != nil {
 				return nil, Error{Code: ErrIntVarNotMuch, Pos: pos, Cause: err}
 			}
 			i += n
 		}
-		n, err := strconv.ParseInt(string(buf), 10, 64)
+		n, err := r.parseInt(buf)
+		if err != nil {
+			if !binFallback || len(buf) > 8 {
+				return nil, Error{Code: ErrIntVarNotMuch, Pos: pos, Cause: err}
+			}
+			n = 0
+			for _, b := range buf {
+				n = n<<8 | int64(b)
+			}
+		}
+		r.ints[outBind] = int(n)
+		return buf, nil
+	}
+}
+
+// genInstHexIntWithSize binds an integer variable written in hex digits
+// whose size is held by the sizeBind th int bind to the outBind th int bind.
+func genInstHexIntWithSize(pos int, sizeBind int, outBind int, max int) instruction {
+	return func(r *matchState) ([]byte, error) {
+		size := r.ints[sizeBind]
+		if size < 0 || size > max {
+			return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, max)), Pos: pos}
+		}
+		buf := r.newBuf(size)
+		if _, err := readFull(r, buf); err != nil {
+			return nil, Error{Code: ErrIntVarNotMuch, Pos: pos, Cause: err}
+		}
+		n, err := strconv.ParseUint(string(buf), 16, strconv.IntSize-1)
 		if err != nil {
 			return nil, Error{Code: ErrIntVarNotMuch, Pos: pos, Cause: err}
 		}
-		*outSize = int(n)
+		r.ints[outBind] = int(n)
+		return buf, nil
+	}
+}
+
+// genInstUint binds an unsigned binary integer variable of size bytes in order to the outBind th int bind.
+func genInstUint(pos int, size int, order binary.ByteOrder, outBind int) instruction {
+	return func(r *matchState) ([]byte, error) {
+		buf := r.newBuf(size)
+		if _, err := readFull(r, buf); err != nil {
+			return nil, Error{Code: ErrIntVarNotMuch, Pos: pos, Cause: err}
+		}
+		var v uint64
+		switch size {
+		case 1:
+			v = uint64(buf[0])
+		case 2:
+			v = uint64(order.Uint16(buf))
+		case 4:
+			v = uint64(order.Uint32(buf))
+		default:
+			v = order.Uint64(buf)
+		}
+		if v > math.MaxInt {
+			return nil, Error{Code: ErrIntVarNotMuch, Pos: pos, Cause: strconv.ErrRange}
+		}
+		r.ints[outBind] = int(v)
+		return buf, nil
+	}
+}
+
+// genInstFloat binds a binary floating point variable of size bytes in order to the outBind th float bind.
+func genInstFloat(pos int, size int, order binary.ByteOrder, outBind int) instruction {
+	return func(r *matchState) ([]byte, error) {
+		buf := r.newBuf(size)
+		if _, err := readFull(r, buf); err != nil {
+			return nil, Error{Code: ErrFloatVarNotMuch, Pos: pos, Cause: err}
+		}
+		if size == 4 {
+			r.floats[outBind] = float64(math.Float32frombits(order.Uint32(buf)))
+		} else {
+			r.floats[outBind] = math.Float64frombits(order.Uint64(buf))
+		}
+		return buf, nil
+	}
+}
+
+// genInstSign runs exec binding the integer part of a decimal and
+// sets the neg th int bind to 1 if it's negative including "-0", otherwise 0.
+func genInstSign(exec instruction, neg int) instruction {
+	return func(r *matchState) ([]byte, error) {
+		buf, err := exec(r)
+		if err != nil {
+			return nil, err
+		}
+		r.ints[neg] = 0
+		if len(buf) > 0 && buf[0] == '-' {
+			r.ints[neg] = 1
+		}
+		return buf, nil
+	}
+}
+
+// genInstFrac runs exec binding the fractional part of a decimal to the outBind th int bind
+// and binds the number of its digits to the scale th int bind.
+// It's negated if the neg th int bind is 1 and fails if it's signed itself.
+func genInstFrac(pos int, exec instruction, outBind int, scale int, neg int) instruction {
+	return func(r *matchState) ([]byte, error) {
+		buf, err := exec(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(buf) > 0 && (buf[0] == '-' || buf[0] == '+') {
+			return nil, Error{Code: ErrIntVarNotMuch, Pos: pos, Cause: &strconv.NumError{Func: "ParseInt", Num: string(buf), Err: strconv.ErrSyntax}}
+		}
+		r.ints[scale] = len(buf)
+		if r.ints[neg] == 1 {
+			r.ints[outBind] = -r.ints[outBind]
+		}
 		return buf, nil
 	}
 }
 
-func genInstIntWithoutSize(pos int, suffix []byte, outSize *int, max int) instruction {
-	return func(r io.Reader) ([]byte, error) {
+// genInstIntWithoutSize binds an integer variable terminated by suffix to the outBind th int bind.
+func genInstIntWithoutSize(pos int, suffix []byte, outBind int, max int, growth float64) instruction {
+	return func(r *matchState) ([]byte, error) {
 		var idx int
 		var midx int
 		bs := 16
-		buf := make([]byte, bs)
+		buf := r.newBuf(bs)
 		for {
 			_, err := r.Read(buf[idx : idx+1])
 			if err != nil {
@@ -361,25 +4059,168 @@ func genInstIntWithoutSize(pos int, suffix []byte, outSize *int, max int) instru
 			idx++
 			if idx >= len(suffix) {
 				if bytes.Equal(suffix, buf[midx:midx+len(suffix)]) {
-					n, err := strconv.ParseInt(string(buf[:midx]), 10, 64)
+					n, err := r.parseInt(buf[:midx])
 					if err != nil {
 						return nil, Error{Code: ErrIntVarNotMuch, Pos: pos, Cause: err}
 					}
-					*outSize = int(n)
+					r.ints[outBind] = int(n)
 					return buf[:midx], nil
 				}
 				midx++
 			}
 			if idx == bs {
 				// extend buf
-				bs *= 2
+				bs = grow(bs, growth)
 				if bs > max {
 					return nil, Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, max)), Pos: pos}
 				}
-				new := make([]byte, bs)
+				new := r.newBuf(bs)
 				copy(new, buf)
 				buf = new
 			}
 		}
 	}
 }
+
+// expandDigits expands ranges like "a-z" in digits.
+func expandDigits(digits string) string {
+	var b strings.Builder
+	for i := 0; i < len(digits); i++ {
+		if i+2 < len(digits) && digits[i+1] == '-' && digits[i] < digits[i+2] {
+			for c := digits[i]; c <= digits[i+2]; c++ {
+				b.WriteByte(c)
+			}
+			i += 2
+			continue
+		}
+		b.WriteByte(digits[i])
+	}
+	return b.String()
+}
+
+// grow returns the buffer size following bs grown by factor.
+func grow(bs int, factor float64) int {
+	next := int(float64(bs) * factor)
+	if next <= bs {
+		return bs + 1
+	}
+	return next
+}
+
+// maxBufSize returns the size of the largest buffer not exceeding max
+// which genInstVarWithoutSize grows by factor.
+func maxBufSize(max int, factor float64) int {
+	bs := 16
+	for {
+		next := grow(bs, factor)
+		if next > max {
+			return bs
+		}
+		bs = next
+	}
+}
+
+// strictViolation returns why line is not allowed in the strict grammar or "" if it's allowed.
+// suffix is the suffix which line follows if any.
+func strictViolation(line string, state parseState, suffix string) string {
+	if line == "" {
+		return "empty token"
+	}
+	if trimmed := strings.TrimSpace(line); trimmed != "" && trimmed != line {
+		return "white spaces around token"
+	}
+	isVar := line[0] == '_' || strings.Contains(line, "/")
+	if state == nonParseState && isVar {
+		colons := 1
+		if strings.Contains(line, "/nz:") {
+			colons = 2
+		}
+		if strings.Count(line, ":") > colons {
+			return "multiple colons"
+		}
+	}
+	if suffix != "" && !isVar && strings.HasPrefix(line, suffix) {
+		return "suffix followed by a const starting with it"
+	}
+	return ""
+}
+
+// parseSize parses a size given as a non-negative decimal integer.
+func parseSize(s string) (int64, error) {
+	n, err := strconv.ParseUint(s, 10, 63)
+	return int64(n), err
+}
+
+// parseByteSize parses s consisting of a decimal followed by an optional unit, B, KiB, MiB or GiB.
+func parseByteSize(s string) (int, error) {
+	unit := 1
+	for _, u := range []struct {
+		suffix string
+		size   int
+	}{{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"B", 1}} {
+		if strings.HasSuffix(s, u.suffix) {
+			s, unit = strings.TrimSuffix(s, u.suffix), u.size
+			break
+		}
+	}
+	n, err := parseSize(s)
+	if err != nil {
+		return 0, err
+	}
+	if n > math.MaxInt/int64(unit) {
+		return 0, strconv.ErrRange
+	}
+	return int(n) * unit, nil
+}
+
+// escapedComma reports whether the ',' ending s is escaped by an odd number of backslashes before it.
+func escapedComma(s string) bool {
+	n := 0
+	for i := len(s) - 2; i >= 0 && s[i] == '\\'; i-- {
+		n++
+	}
+	return n%2 == 1
+}
+
+// unescape replaces "\\" and "\," in s with '\' and ',' leaving other backslashes as they are.
+func unescape(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && (s[i+1] == '\\' || s[i+1] == ',') {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// isName reports whether s can be the name of a variable referenced as a size
+// which consists of letters, digits, '_' and '.' and doesn't start with a digit.
+func isName(s string) bool {
+	if s == "" || (s[0] >= '0' && s[0] <= '9') {
+		return false
+	}
+	for _, c := range s {
+		if c != '_' && c != '.' && !unicode.IsLetter(c) && !unicode.IsDigit(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// readFull reads exactly len(buf) bytes from r and returns the number of bytes read
+// along with the error that stopped it early, if any.
+func readFull(r io.Reader, buf []byte) (int, error) {
+	var i int
+	for i < len(buf) {
+		n, err := r.Read(buf[i:])
+		i += n
+		if err != nil && i < len(buf) {
+			return i, err
+		}
+	}
+	return i, nil
+}
@@ -1,11 +1,28 @@
 package gtpm
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unsafe"
 )
 
 func checkError(got error, want error) bool {
@@ -19,8 +36,8 @@ func checkError(got error, want error) bool {
 	return got == want
 }
 
-func invokeInst(inst instruction, r io.Reader, wantBuf []byte, wantErr error, t *testing.T) {
-	ret, err := inst(r)
+func invokeInst(inst instruction, s *matchState, wantBuf []byte, wantErr error, t *testing.T) {
+	ret, err := inst(s)
 	if !bytes.Equal(ret, wantBuf) || !checkError(err, wantErr) {
 		t.Errorf("gtpm_test: got %#v, %+v, want %#v, %+v", ret, err, wantBuf, wantErr)
 	}
@@ -69,17 +86,286 @@ func TestGenInstConst(t *testing.T) {
 	for _, test := range tests {
 		r := bytes.NewReader(test.read)
 		inst := genInstConst(test.pos, test.src)
-		invokeInst(inst, r, test.want, test.err, t)
+		invokeInst(inst, &matchState{r: r}, test.want, test.err, t)
 	}
 
 }
 
+func TestMergeConsts(t *testing.T) {
+	m, err := Compile("GET, ,*,\r\n")
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	if insts := m.(*TextPatternMatcher).instSlice; len(insts) != 1 {
+		t.Errorf("gtpm_test: got %d instructions, want 1", len(insts))
+	}
+	tests := []struct {
+		read []byte
+		err  error
+	}{
+		{
+			read: []byte("GET *\r\n"),
+			err:  nil,
+		},
+		{
+			read: []byte("GET /\r\n"),
+			err:  Error{Code: ErrConstNotMuch, Pos: 7},
+		},
+		{
+			read: []byte("GET *"),
+			err:  Error{Code: ErrConstNotMuch, Pos: 9, Cause: io.EOF},
+		},
+	}
+	for _, test := range tests {
+		_, err := m.MatchReader(bytes.NewReader(test.read))
+		if !checkError(err, test.err) {
+			t.Errorf("gtpm_test: got %+v, want %+v", err, test.err)
+		}
+	}
+
+	m, err = Compile("V/bin:2,=,>,W/bin:2,;,\r\n")
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	var kinds []instKind
+	for _, inst := range m.(*TextPatternMatcher).instSlice {
+		kinds = append(kinds, inst.kind)
+	}
+	if want := []instKind{binKind, constKind, binKind, constKind}; fmt.Sprint(kinds) != fmt.Sprint(want) {
+		t.Errorf("gtpm_test: got %v, want %v", kinds, want)
+	}
+	matched, err := m.MatchReader(bytes.NewReader([]byte("ab=>cd;\r\n")))
+	if want := [][]byte{[]byte("ab"), []byte("cd")}; !cmpByteSliceSlice(matched, want) || err != nil {
+		t.Errorf("gtpm_test: got %#v %+v, want %#v nil", matched, err, want)
+	}
+}
+
+func BenchmarkCollapseConsts(b *testing.B) {
+	read := []byte("HTTP 200 OK\r\nServer: gtpm\r\n\r\n")
+	m, _ := Compile("HTTP, ,200, ,OK,\r\n,Server: gtpm,\r\n,\r\n")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := m.MatchReader(bytes.NewReader(read)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestGenInstAlt(t *testing.T) {
+	tests := []struct {
+		read []byte
+		alts []string
+		pos  int
+		want []byte
+		rest []byte
+		err  error
+	}{
+		{
+			read: []byte("B"),
+			alts: []string{"A", "B", "C"},
+			pos:  0,
+			want: []byte("1"),
+			rest: []byte{},
+			err:  nil,
+		},
+		{
+			read: []byte("GETfoo"),
+			alts: []string{"POST", "GET"},
+			pos:  1,
+			want: []byte("1"),
+			rest: []byte("foo"),
+			err:  nil,
+		},
+		{
+			read: []byte("PUTfoo"),
+			alts: []string{"POST", "GET"},
+			pos:  2,
+			want: nil,
+			rest: []byte("PUTfoo"),
+			err:  Error{Code: ErrAltNotMuch, Pos: 2},
+		},
+		{
+			read: []byte("PO"),
+			alts: []string{"POST", "GET"},
+			pos:  3,
+			want: nil,
+			rest: []byte("PO"),
+			err:  Error{Code: ErrAltNotMuch, Pos: 3, Cause: io.EOF},
+		},
+	}
+	for _, test := range tests {
+		var alts [][]byte
+		for _, alt := range test.alts {
+			alts = append(alts, []byte(alt))
+		}
+		s := &matchState{r: bytes.NewReader(test.read)}
+		ret, err := genInstAlt(test.pos, alts)(s)
+		if !bytes.Equal(ret, test.want) || !checkError(err, test.err) {
+			t.Errorf("gtpm_test: got %#v, %+v, want %#v, %+v", ret, err, test.want, test.err)
+		}
+		rest, _ := io.ReadAll(s)
+		if !bytes.Equal(rest, test.rest) {
+			t.Errorf("gtpm_test: got rest %q, want %q", rest, test.rest)
+		}
+	}
+}
+
+func TestGenInstOptConst(t *testing.T) {
+	tests := []struct {
+		read  []byte
+		match []byte
+		pos   int
+		want  []byte
+		rest  []byte
+		err   error
+	}{
+		{
+			read:  []byte("OK:foo"),
+			match: []byte("OK:"),
+			pos:   0,
+			want:  []byte("1"),
+			rest:  []byte("foo"),
+			err:   nil,
+		},
+		{
+			read:  []byte("foo"),
+			match: []byte("OK:"),
+			pos:   1,
+			want:  []byte("0"),
+			rest:  []byte("foo"),
+			err:   nil,
+		},
+		{
+			read:  []byte("O"),
+			match: []byte("OK:"),
+			pos:   2,
+			want:  []byte("0"),
+			rest:  []byte("O"),
+			err:   nil,
+		},
+	}
+	for _, test := range tests {
+		s := &matchState{r: bytes.NewReader(test.read)}
+		ret, err := genInstOptConst(test.pos, test.match)(s)
+		if !bytes.Equal(ret, test.want) || !checkError(err, test.err) {
+			t.Errorf("gtpm_test: got %#v, %+v, want %#v, %+v", ret, err, test.want, test.err)
+		}
+		rest, _ := io.ReadAll(s)
+		if !bytes.Equal(rest, test.rest) {
+			t.Errorf("gtpm_test: got rest %q, want %q", rest, test.rest)
+		}
+	}
+}
+
+func TestGenInstBOM(t *testing.T) {
+	tests := []struct {
+		read []byte
+		rest []byte
+	}{
+		{
+			read: []byte("\xEF\xBB\xBFfoo"),
+			rest: []byte("foo"),
+		},
+		{
+			read: []byte("\xFE\xFFfoo"),
+			rest: []byte("foo"),
+		},
+		{
+			read: []byte("\xFF\xFEfoo"),
+			rest: []byte("foo"),
+		},
+		{
+			read: []byte("foo"),
+			rest: []byte("foo"),
+		},
+		{
+			read: []byte("\xEF\xBBfoo"),
+			rest: []byte("\xEF\xBBfoo"),
+		},
+		{
+			read: []byte("\xEF"),
+			rest: []byte("\xEF"),
+		},
+		{
+			read: nil,
+			rest: []byte{},
+		},
+	}
+	for _, test := range tests {
+		s := &matchState{r: bytes.NewReader(test.read)}
+		ret, err := genInstBOM()(s)
+		if ret != nil || err != nil {
+			t.Errorf("gtpm_test: got %#v, %+v, want nil, nil", ret, err)
+		}
+		rest, _ := io.ReadAll(s)
+		if !bytes.Equal(rest, test.rest) {
+			t.Errorf("gtpm_test: got rest %q, want %q", rest, test.rest)
+		}
+	}
+}
+
+func TestGenInstAlign(t *testing.T) {
+	tests := []struct {
+		read     []byte
+		pos      int
+		consumed int
+		align    int
+		rest     []byte
+		err      error
+	}{
+		{
+			read:     []byte("\x00foo"),
+			pos:      0,
+			consumed: 3,
+			align:    4,
+			rest:     []byte("foo"),
+			err:      nil,
+		},
+		{
+			read:     []byte("\x00\x00\x00foo"),
+			pos:      1,
+			consumed: 5,
+			align:    4,
+			rest:     []byte("foo"),
+			err:      nil,
+		},
+		{
+			read:     []byte("foo"),
+			pos:      2,
+			consumed: 8,
+			align:    4,
+			rest:     []byte("foo"),
+			err:      nil,
+		},
+		{
+			read:     []byte("\x00"),
+			pos:      3,
+			consumed: 6,
+			align:    4,
+			rest:     []byte{},
+			err:      Error{Code: ErrVarNotMuch, Pos: 3, Cause: io.EOF},
+		},
+	}
+	for _, test := range tests {
+		s := &matchState{r: bytes.NewReader(test.read), n: test.consumed}
+		ret, err := genInstAlign(test.pos, test.align)(s)
+		if ret != nil || !checkError(err, test.err) {
+			t.Errorf("gtpm_test: got %#v, %+v, want nil, %+v", ret, err, test.err)
+		}
+		rest, _ := io.ReadAll(s)
+		if !bytes.Equal(rest, test.rest) {
+			t.Errorf("gtpm_test: got rest %q, want %q", rest, test.rest)
+		}
+	}
+}
+
 func TestGenInstVarWithSize(t *testing.T) {
 	tests := []struct {
 		read    []byte
 		pos     int
 		size    int
 		capture bool
+		max     int
 		want    []byte
 		err     error
 	}{
@@ -107,352 +393,4287 @@ func TestGenInstVarWithSize(t *testing.T) {
 			want:    nil,
 			err:     Error{Code: ErrVarNotMuch, Pos: 2, Cause: io.EOF},
 		},
+		{
+			read:    []byte("foo"),
+			pos:     3,
+			size:    -2,
+			capture: true,
+			want:    nil,
+			err:     Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, 1024)), Pos: 3},
+		},
+		{
+			read:    []byte("foo"),
+			pos:     4,
+			size:    3,
+			capture: false,
+			max:     2,
+			want:    nil,
+			err:     Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, 2)), Pos: 4},
+		},
 	}
 	for _, test := range tests {
+		if test.max == 0 {
+			test.max = 1024
+		}
 		r := bytes.NewReader(test.read)
-		inst := genInstVarWithSize(test.pos, &test.size, test.capture)
-		invokeInst(inst, r, test.want, test.err, t)
+		inst := genInstVarWithSize(test.pos, 0, test.capture, test.max)
+		invokeInst(inst, &matchState{r: r, ints: []int{test.size}}, test.want, test.err, t)
 	}
 
 }
 
-func TestGenInstVarWithoutSize(t *testing.T) {
+func TestGenInstVarFrame(t *testing.T) {
 	tests := []struct {
-		read    []byte
-		pos     int
-		suffix  []byte
-		capture bool
-		max     int
-		want    []byte
-		err     error
+		read     []byte
+		pos      int
+		length   int
+		consumed int
+		max      int
+		want     []byte
+		err      error
 	}{
 		{
-			read:    []byte("foobar"),
-			pos:     0,
-			suffix:  []byte("bar"),
-			capture: true,
-			max:     1024,
-			want:    []byte("foo"),
-			err:     nil,
+			read:     []byte("foobar"),
+			pos:      0,
+			length:   7,
+			consumed: 4,
+			max:      1024,
+			want:     []byte("foo"),
+			err:      nil,
 		},
 		{
-			read:    []byte("foobar"),
-			pos:     1,
-			suffix:  []byte("bar"),
-			capture: false,
-			max:     1024,
-			want:    nil,
-			err:     nil,
+			read:     []byte("foobar"),
+			pos:      1,
+			length:   4,
+			consumed: 4,
+			max:      1024,
+			want:     []byte{},
+			err:      nil,
 		},
 		{
-			read:    []byte("foobar"),
-			pos:     2,
-			suffix:  []byte("buzz"),
-			capture: true,
-			max:     1024,
-			want:    nil,
-			err:     Error{Code: ErrVarNotMuch, Pos: 2, Cause: io.EOF},
+			read:     []byte("foobar"),
+			pos:      2,
+			length:   3,
+			consumed: 4,
+			max:      1024,
+			want:     nil,
+			err:      Error{Code: ErrorCode(fmt.Sprintf(ErrFrameOverrun, 4)), Pos: 2},
 		},
 		{
-			read:    []byte("foobarfoobarfoobarbuzz"),
-			pos:     3,
-			suffix:  []byte("buzz"),
-			capture: true,
-			max:     1024,
-			want:    []byte("foobarfoobarfoobar"),
-			err:     nil,
+			read:     []byte("foobar"),
+			pos:      3,
+			length:   20,
+			consumed: 4,
+			max:      8,
+			want:     nil,
+			err:      Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, 8)), Pos: 3},
 		},
 		{
-			read:    []byte("foobarfoobarfoobarbuzz"),
-			pos:     4,
-			suffix:  []byte("buzz"),
-			capture: true,
-			max:     16,
-			want:    nil,
-			err:     Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, 16)), Pos: 4},
+			read:     []byte("foobar"),
+			pos:      4,
+			length:   12,
+			consumed: 4,
+			max:      1024,
+			want:     nil,
+			err:      Error{Code: ErrVarNotMuch, Pos: 4, Cause: io.EOF},
 		},
 	}
 	for _, test := range tests {
 		r := bytes.NewReader(test.read)
-		inst := genInstVarWithoutSize(test.pos, test.suffix, test.capture, test.max)
-		invokeInst(inst, r, test.want, test.err, t)
+		inst := genInstVarFrame(test.pos, 0, test.max)
+		invokeInst(inst, &matchState{r: r, n: test.consumed, ints: []int{test.length}}, test.want, test.err, t)
 	}
-
 }
 
-func TestGenInstIntWithSize(t *testing.T) {
+func TestGenInstVarNetstring(t *testing.T) {
 	tests := []struct {
 		read []byte
 		pos  int
-		size int
-		out  int
+		max  int
 		want []byte
 		err  error
 	}{
 		{
-			read: []byte("123"),
+			read: []byte("5:hello,"),
 			pos:  0,
-			size: 3,
-			out:  0,
-			want: []byte("123"),
+			max:  1024,
+			want: []byte("hello"),
 			err:  nil,
 		},
 		{
-			read: []byte("foo"),
+			read: []byte("3:a,b,"),
 			pos:  1,
-			size: 3,
-			out:  0,
-			want: nil,
-			err:  Error{Code: ErrIntVarNotMuch, Pos: 1, Cause: &strconv.NumError{Func: "ParseInt", Num: "foo", Err: strconv.ErrSyntax}},
+			max:  1024,
+			want: []byte("a,b"),
+			err:  nil,
 		},
 		{
-			read: []byte("foo"),
+			read: []byte("0:,"),
 			pos:  2,
-			size: 4,
-			out:  0,
+			max:  1024,
+			want: []byte{},
+			err:  nil,
+		},
+		{
+			read: []byte("05:hello,"),
+			pos:  3,
+			max:  1024,
 			want: nil,
-			err:  Error{Code: ErrIntVarNotMuch, Pos: 2, Cause: io.EOF},
+			err:  Error{Code: ErrNetstringNotMuch, Pos: 3},
+		},
+		{
+			read: []byte(":hello,"),
+			pos:  4,
+			max:  1024,
+			want: nil,
+			err:  Error{Code: ErrNetstringNotMuch, Pos: 4},
+		},
+		{
+			read: []byte("5:hello;"),
+			pos:  5,
+			max:  1024,
+			want: nil,
+			err:  Error{Code: ErrNetstringNotMuch, Pos: 5},
+		},
+		{
+			read: []byte("5:hell"),
+			pos:  6,
+			max:  1024,
+			want: nil,
+			err:  Error{Code: ErrNetstringNotMuch, Pos: 6, Cause: io.EOF},
+		},
+		{
+			read: []byte("12:hello world!,"),
+			pos:  7,
+			max:  8,
+			want: nil,
+			err:  Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, 8)), Pos: 7},
 		},
 	}
 	for _, test := range tests {
 		r := bytes.NewReader(test.read)
-		inst := genInstIntWithSize(test.pos, &test.size, &test.out)
-		invokeInst(inst, r, test.want, test.err, t)
-		if test.out != 0 {
-			n, _ := strconv.ParseInt(string(test.want), 10, 64)
-			if test.out != int(n) {
-				t.Errorf("gtpm_test: got %d, want %d", test.out, n)
-			}
-		}
+		inst := genInstVarNetstring(test.pos, test.max)
+		invokeInst(inst, &matchState{r: r}, test.want, test.err, t)
 	}
-
 }
 
-func TestGenInstIntWithoutSize(t *testing.T) {
+func TestGenInstVarNonPad(t *testing.T) {
 	tests := []struct {
-		read   []byte
-		pos    int
-		suffix []byte
-		out    int
-		max    int
-		want   []byte
-		err    error
+		read []byte
+		pos  int
+		size int
+		pad  byte
+		want []byte
+		err  error
 	}{
 		{
-			read:   []byte("789bar"),
-			pos:    0,
-			suffix: []byte("bar"),
-			out:    0,
-			max:    1024,
-			want:   []byte("789"),
-			err:    nil,
+			read: []byte("foo"),
+			pos:  0,
+			size: 3,
+			pad:  0,
+			want: []byte("foo"),
+			err:  nil,
 		},
 		{
-			read:   []byte("foobar"),
-			pos:    1,
-			suffix: []byte("bar"),
-			out:    0,
-			max:    1024,
-			want:   nil,
-			err:    Error{Code: ErrIntVarNotMuch, Pos: 1, Cause: &strconv.NumError{Func: "ParseInt", Num: "foo", Err: strconv.ErrSyntax}},
+			read: []byte{0, 0, 0},
+			pos:  1,
+			size: 3,
+			pad:  0,
+			want: nil,
+			err:  Error{Code: ErrorCode(fmt.Sprintf(ErrVarPadded, 0)), Pos: 1},
 		},
 		{
-			read:   []byte("foobar"),
-			pos:    2,
-			suffix: []byte("buzz"),
-			out:    0,
-			max:    1024,
-			want:   nil,
-			err:    Error{Code: ErrIntVarNotMuch, Pos: 2, Cause: io.EOF},
+			read: []byte("   "),
+			pos:  2,
+			size: 3,
+			pad:  ' ',
+			want: nil,
+			err:  Error{Code: ErrorCode(fmt.Sprintf(ErrVarPadded, ' ')), Pos: 2},
 		},
 		{
-			read:   []byte("1234567890foobarbuzz"),
-			pos:    3,
-			suffix: []byte("foobarbuzz"),
-			out:    0,
-			max:    1024,
-			want:   []byte("1234567890"),
-			err:    nil,
+			read: []byte{0, 0, 1},
+			pos:  3,
+			size: 3,
+			pad:  0,
+			want: []byte{0, 0, 1},
+			err:  nil,
 		},
 		{
-			read:   []byte("1234567890foobarbuzz"),
-			pos:    4,
-			suffix: []byte("foobarbuzz"),
-			out:    0,
-			max:    16,
-			want:   nil,
-			err:    Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, 16)), Pos: 4},
+			read: []byte{0, 0},
+			pos:  4,
+			size: 3,
+			pad:  0,
+			want: nil,
+			err:  Error{Code: ErrVarNotMuch, Pos: 4, Cause: io.EOF},
 		},
 	}
 	for _, test := range tests {
 		r := bytes.NewReader(test.read)
-		inst := genInstIntWithoutSize(test.pos, test.suffix, &test.out, test.max)
-		invokeInst(inst, r, test.want, test.err, t)
-		if test.out != 0 {
-			n, _ := strconv.ParseInt(string(test.want), 10, 64)
-			if test.out != int(n) {
-				t.Errorf("gtpm_test: got %d, want %d", test.out, n)
-			}
-		}
+		inst := genInstVarNonPad(test.pos, 0, test.pad, 1024)
+		invokeInst(inst, &matchState{r: r, ints: []int{test.size}}, test.want, test.err, t)
 	}
 
 }
 
-func TestCompileAndMatch(t *testing.T) {
+func TestGenInstVarRest(t *testing.T) {
 	tests := []struct {
-		pattern string
 		read    []byte
-		cerr    error
-		want    [][]byte
-		merr    error
-		opts    []Option
+		pos     int
+		trailer int
+		max     int
+		want    []byte
+		rest    []byte
+		err     error
 	}{
 		{
-			pattern: "N/int,\r\n",
-			read:    []byte("123\r\n"),
-			cerr:    nil,
-			want: [][]byte{
-				[]byte("123"),
-			},
-			merr: nil,
+			read:    []byte("foobar"),
+			pos:     0,
+			trailer: 2,
+			max:     1024,
+			want:    []byte("foob"),
+			rest:    []byte("ar"),
+			err:     nil,
 		},
 		{
-			pattern: "_,\r\n",
-			read:    []byte("deadbeaf\r\n"),
-			cerr:    nil,
+			read:    []byte("foobar"),
+			pos:     1,
+			trailer: 0,
+			max:     1024,
+			want:    []byte("foobar"),
+			rest:    []byte{},
+			err:     nil,
+		},
+		{
+			read:    []byte("foo"),
+			pos:     2,
+			trailer: 4,
+			max:     1024,
 			want:    nil,
-			merr:    nil,
+			rest:    []byte("foo"),
+			err:     Error{Code: ErrVarNotMuch, Pos: 2, Cause: io.EOF},
 		},
 		{
-			pattern: "_:4",
-			read:    []byte("dead"),
-			cerr:    nil,
+			read:    []byte("foobar"),
+			pos:     3,
+			trailer: 1,
+			max:     4,
 			want:    nil,
-			merr:    nil,
+			err:     Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, 4)), Pos: 3},
 		},
+	}
+	for _, test := range tests {
+		// io.MultiReader hides io.Seeker of bytes.Reader
+		for _, r := range []io.Reader{bytes.NewReader(test.read), io.MultiReader(bytes.NewReader(test.read))} {
+			s := &matchState{r: r}
+			ret, err := genInstVarRest(test.pos, test.trailer, test.max)(s)
+			if !bytes.Equal(ret, test.want) || !checkError(err, test.err) {
+				t.Errorf("gtpm_test: got %#v, %+v, want %#v, %+v", ret, err, test.want, test.err)
+			}
+			if test.rest == nil {
+				continue
+			}
+			rest, _ := io.ReadAll(s)
+			if !bytes.Equal(rest, test.rest) {
+				t.Errorf("gtpm_test: got rest %q, want %q", rest, test.rest)
+			}
+		}
+	}
+}
+
+func TestGenInstVarWithoutSize(t *testing.T) {
+	tests := []struct {
+		read    []byte
+		pos     int
+		suffix  []byte
+		capture bool
+		max     int
+		want    []byte
+		err     error
+	}{
 		{
-			pattern: "N/int,\r\n,_:N",
-			read:    []byte("4\r\nbeaf"),
-			cerr:    nil,
-			want: [][]byte{
-				[]byte("4"),
-			},
-			merr: nil,
+			read:    []byte("foobar"),
+			pos:     0,
+			suffix:  []byte("bar"),
+			capture: true,
+			max:     1024,
+			want:    []byte("foo"),
+			err:     nil,
 		},
 		{
-			pattern: "N/int,\r\n,_:N:0",
-			read:    nil,
-			cerr:    Error{Code: ErrParseColonExpected, Pos: 10},
+			read:    []byte("foobar"),
+			pos:     1,
+			suffix:  []byte("bar"),
+			capture: false,
+			max:     1024,
 			want:    nil,
-			merr:    nil,
+			err:     nil,
 		},
 		{
-			pattern: "N/int,\r\n,_:M",
-			read:    nil,
-			cerr:    Error{Code: ErrorCode(fmt.Sprintf(ErrParseVariableNotDefined, "M")), Pos: 10},
+			read:    []byte("foobar"),
+			pos:     2,
+			suffix:  []byte("buzz"),
+			capture: true,
+			max:     1024,
 			want:    nil,
-			merr:    nil,
+			err:     Error{Code: ErrVarNotMuch, Pos: 2, Cause: io.EOF},
 		},
 		{
-			pattern: "Number/int,\r\n,_:Number",
-			read:    []byte("4\r\nbea"),
-			cerr:    nil,
-			want:    nil,
-			merr:    Error{Code: ErrVarNotMuch, Pos: 15, Cause: io.EOF},
+			read:    []byte("foobarfoobarfoobarbuzz"),
+			pos:     3,
+			suffix:  []byte("buzz"),
+			capture: true,
+			max:     1024,
+			want:    []byte("foobarfoobarfoobar"),
+			err:     nil,
 		},
 		{
-			pattern: "V/bin,\r\n,N/int:2,v2/bin:N,\r\n",
-			read:    []byte("foobarbuzz\r\n16abcdef0123456789\r\n"),
-			cerr:    nil,
-			want: [][]byte{
-				[]byte("foobarbuzz"),
-				[]byte("16"),
-				[]byte("abcdef0123456789"),
-			},
-			merr: nil,
-			opts: []Option{WithMaxVariableSize(32)},
+			read:    []byte("foobarfoobarfoobarbuzz"),
+			pos:     4,
+			suffix:  []byte("buzz"),
+			capture: true,
+			max:     16,
+			want:    nil,
+			err:     Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, 16)), Pos: 4},
 		},
 		{
-			pattern: "V/bin:3,N/int:1,\t,N2/int:N,var/bin:N2",
-			read:    []byte("abc1\t8deadbeaf"),
-			cerr:    nil,
-			want: [][]byte{
-				[]byte("abc"),
-				[]byte("1"),
-				[]byte("8"),
-				[]byte("deadbeaf"),
-			},
-			merr: nil,
+			read:    []byte("foo;bar"),
+			pos:     5,
+			suffix:  []byte(";"),
+			capture: true,
+			max:     1024,
+			want:    []byte("foo"),
+			err:     nil,
 		},
 		{
-			pattern: "N/int",
-			read:    nil,
-			cerr:    Error{Code: ErrParseSuffixExpected, Pos: 1},
+			read:    []byte("foo;bar"),
+			pos:     6,
+			suffix:  []byte(";"),
+			capture: false,
+			max:     1024,
 			want:    nil,
-			merr:    nil,
+			err:     nil,
 		},
 		{
-			pattern: "N/int/bin",
-			read:    nil,
-			cerr:    Error{Code: ErrParseInvalidSlash, Pos: 1},
+			read:    []byte("foobar"),
+			pos:     7,
+			suffix:  []byte(";"),
+			capture: true,
+			max:     1024,
 			want:    nil,
-			merr:    nil,
+			err:     Error{Code: ErrVarNotMuch, Pos: 7, Cause: io.EOF},
 		},
 		{
-			pattern: "hoge,N/bi",
-			read:    nil,
-			cerr:    Error{Code: ErrParseInvalidType, Pos: 6},
-			want:    nil,
-			merr:    nil,
+			read:    append(bytes.Repeat([]byte("a"), 40), ';'),
+			pos:     8,
+			suffix:  []byte(";"),
+			capture: true,
+			max:     1024,
+			want:    bytes.Repeat([]byte("a"), 40),
+			err:     nil,
 		},
 		{
-			pattern: "foo,N/inte",
-			read:    nil,
-			cerr:    Error{Code: ErrParseInvalidType, Pos: 5},
-			want:    nil,
-			merr:    nil,
+			read:    append(bytes.Repeat([]byte("a"), 15), ';'),
+			pos:     9,
+			suffix:  []byte(";"),
+			capture: true,
+			max:     16,
+			want:    bytes.Repeat([]byte("a"), 15),
+			err:     nil,
 		},
 		{
-			pattern: "foo,N/binary",
-			read:    nil,
-			cerr:    Error{Code: ErrParseInvalidType, Pos: 5},
+			read:    append(bytes.Repeat([]byte("a"), 16), ';'),
+			pos:     10,
+			suffix:  []byte(";"),
+			capture: true,
+			max:     16,
 			want:    nil,
-			merr:    nil,
+			err:     Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, 16)), Pos: 10},
 		},
+	}
+	for _, test := range tests {
+		inst := genInstVarWithoutSize(test.pos, test.suffix, test.capture, test.max, defaultGrowth)
+		invokeInst(inst, &matchState{r: bytes.NewReader(test.read)}, test.want, test.err, t)
+		// a *bufio.Reader is read chunk by chunk if the suffix is a single byte
+		s := &matchState{r: bufio.NewReaderSize(bytes.NewReader(test.read), 16)}
+		invokeInst(inst, s, test.want, test.err, t)
+		if test.err == nil && s.n != len(test.want)+len(test.suffix) && test.capture {
+			t.Errorf("gtpm_test: got %d bytes consumed, want %d", s.n, len(test.want)+len(test.suffix))
+		}
+	}
+}
+
+func TestGenInstVarUpTo(t *testing.T) {
+	tests := []struct {
+		read     []byte
+		pos      int
+		suffix   []byte
+		limit    int
+		truncate bool
+		want     []byte
+		rest     string
+		err      error
+	}{
 		{
-			pattern: "foo,N/foo",
-			read:    nil,
-			cerr:    Error{Code: ErrParseInvalidType, Pos: 5},
-			want:    nil,
-			merr:    nil,
+			read:     []byte("foo\r\nbar"),
+			pos:      0,
+			suffix:   []byte("\r\n"),
+			limit:    4,
+			truncate: true,
+			want:     []byte("foo"),
+			rest:     "bar",
+			err:      nil,
 		},
 		{
-			pattern: "N/int,\r\n,foo/int:M",
-			read:    nil,
-			cerr:    Error{Code: ErrorCode(fmt.Sprintf(ErrParseVariableNotDefined, "M")), Pos: 10},
-			want:    nil,
-			merr:    nil,
+			read:     []byte("food\r\nbar"),
+			pos:      1,
+			suffix:   []byte("\r\n"),
+			limit:    4,
+			truncate: false,
+			want:     []byte("food"),
+			rest:     "bar",
+			err:      nil,
 		},
 		{
-			pattern: "N/int,\r\n,foo/bin:Num",
-			read:    nil,
-			cerr:    Error{Code: ErrorCode(fmt.Sprintf(ErrParseVariableNotDefined, "Num")), Pos: 10},
-			want:    nil,
-			merr:    nil,
+			read:     []byte("foobar\r\n"),
+			pos:      2,
+			suffix:   []byte("\r\n"),
+			limit:    4,
+			truncate: true,
+			want:     []byte("foob"),
+			rest:     "ar\r\n",
+			err:      nil,
+		},
+		{
+			read:     []byte("foobar\r\n"),
+			pos:      3,
+			suffix:   []byte("\r\n"),
+			limit:    4,
+			truncate: false,
+			want:     nil,
+			err:      Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, 4)), Pos: 3},
+		},
+		{
+			read:     []byte("foo"),
+			pos:      4,
+			suffix:   []byte("\r\n"),
+			limit:    4,
+			truncate: true,
+			want:     nil,
+			err:      Error{Code: ErrVarNotMuch, Pos: 4, Cause: io.EOF},
 		},
 	}
 	for _, test := range tests {
-		m, err := Compile(test.pattern, test.opts...)
-		if err != test.cerr {
-			t.Errorf("gtpm_test: got %+v, want %+v", err, test.cerr)
-		}
-		if err != nil {
+		s := &matchState{r: bytes.NewReader(test.read)}
+		inst := genInstVarUpTo(test.pos, test.suffix, test.limit, test.truncate)
+		invokeInst(inst, s, test.want, test.err, t)
+		if test.err != nil {
 			continue
 		}
-		r := bytes.NewReader(test.read)
-		matched, err := m.MatchReader(r)
-		if !cmpByteSliceSlice(matched, test.want) || err != test.merr {
-			t.Errorf("gtpm_test: got %#v %+v, want %#v %+v", matched, err, test.want, test.merr)
+		if rest, _ := io.ReadAll(s); string(rest) != test.rest {
+			t.Errorf("gtpm_test: got rest %q, want %q", rest, test.rest)
 		}
 	}
 }
+
+func TestGenInstVarQuoted(t *testing.T) {
+	tests := []struct {
+		read []byte
+		pos  int
+		max  int
+		want []byte
+		err  error
+	}{
+		{
+			read: []byte("foo\r\nbar"),
+			pos:  0,
+			max:  1024,
+			want: []byte("foo"),
+			err:  nil,
+		},
+		{
+			read: []byte("a=\"x\r\ny\"\r\nbar"),
+			pos:  1,
+			max:  1024,
+			want: []byte("a=\"x\r\ny\""),
+			err:  nil,
+		},
+		{
+			read: []byte("\"x\\\"\r\n\"\r\n"),
+			pos:  2,
+			max:  1024,
+			want: []byte("\"x\\\"\r\n\""),
+			err:  nil,
+		},
+		{
+			read: []byte("\"foo\r\n"),
+			pos:  3,
+			max:  1024,
+			want: nil,
+			err:  Error{Code: ErrVarNotMuch, Pos: 3, Cause: io.EOF},
+		},
+		{
+			read: []byte("\"0123456789abcdef\"\r\n"),
+			pos:  4,
+			max:  16,
+			want: nil,
+			err:  Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, 16)), Pos: 4},
+		},
+	}
+	for _, test := range tests {
+		r := bytes.NewReader(test.read)
+		inst := genInstVarQuoted(test.pos, []byte("\r\n"), '"', test.max, 2)
+		invokeInst(inst, &matchState{r: r}, test.want, test.err, t)
+	}
+}
+
+func TestGenInstRun(t *testing.T) {
+	tests := []struct {
+		read []byte
+		pos  int
+		max  int
+		want []byte
+		err  error
+	}{
+		{
+			read: []byte("   bar"),
+			pos:  0,
+			max:  1024,
+			want: []byte("   "),
+			err:  nil,
+		},
+		{
+			read: []byte("bar"),
+			pos:  1,
+			max:  1024,
+			want: []byte{},
+			err:  nil,
+		},
+		{
+			read: []byte("  "),
+			pos:  2,
+			max:  1024,
+			want: []byte("  "),
+			err:  nil,
+		},
+		{
+			read: bytes.Repeat([]byte(" "), 17),
+			pos:  3,
+			max:  16,
+			want: nil,
+			err:  Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, 16)), Pos: 3},
+		},
+	}
+	for _, test := range tests {
+		r := bytes.NewReader(test.read)
+		inst := genInstRun(test.pos, ' ', test.max, 2)
+		invokeInst(inst, &matchState{r: r}, test.want, test.err, t)
+	}
+}
+
+func TestGenInstVarCRC32(t *testing.T) {
+	frame := func(payload string) []byte {
+		return binary.BigEndian.AppendUint32([]byte(payload), crc32.ChecksumIEEE([]byte(payload)))
+	}
+	tests := []struct {
+		read []byte
+		pos  int
+		max  int
+		want []byte
+		err  error
+	}{
+		{
+			read: append(frame("hello, world"), "rest"...),
+			pos:  0,
+			max:  1024,
+			want: []byte("hello, world"),
+			err:  nil,
+		},
+		{
+			read: append(frame("0123456789abcdef0123456789abcdef"), frame("next")...),
+			pos:  1,
+			max:  1024,
+			want: []byte("0123456789abcdef0123456789abcdef"),
+			err:  nil,
+		},
+		{
+			read: []byte("hello, world"),
+			pos:  2,
+			max:  1024,
+			want: nil,
+			err:  Error{Code: ErrVarNotMuch, Pos: 2, Cause: io.EOF},
+		},
+		{
+			read: frame("0123456789abcdef"),
+			pos:  3,
+			max:  16,
+			want: nil,
+			err:  Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, 16)), Pos: 3},
+		},
+	}
+	for _, test := range tests {
+		r := bytes.NewReader(test.read)
+		inst := genInstVarCRC32(test.pos, test.max, 2)
+		invokeInst(inst, &matchState{r: r}, test.want, test.err, t)
+	}
+}
+
+func TestGenInstVarNest(t *testing.T) {
+	tests := []struct {
+		read []byte
+		pos  int
+		max  int
+		want []byte
+		err  error
+	}{
+		{
+			read: []byte("(a(b)c)d)"),
+			pos:  0,
+			max:  1024,
+			want: []byte("(a(b)c)"),
+			err:  nil,
+		},
+		{
+			read: []byte("()"),
+			pos:  1,
+			max:  1024,
+			want: []byte("()"),
+			err:  nil,
+		},
+		{
+			read: []byte("a(b)"),
+			pos:  2,
+			max:  1024,
+			want: nil,
+			err:  Error{Code: ErrNestNotMuch, Pos: 2},
+		},
+		{
+			read: []byte("(a(b)c"),
+			pos:  3,
+			max:  1024,
+			want: nil,
+			err:  Error{Code: ErrNestNotMuch, Pos: 3, Cause: io.EOF},
+		},
+		{
+			read: []byte("(0123456789abcdef)"),
+			pos:  4,
+			max:  16,
+			want: nil,
+			err:  Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, 16)), Pos: 4},
+		},
+	}
+	for _, test := range tests {
+		r := bytes.NewReader(test.read)
+		inst := genInstVarNest(test.pos, '(', ')', test.max, 2)
+		invokeInst(inst, &matchState{r: r}, test.want, test.err, t)
+	}
+}
+
+func TestGenInstIntWithSize(t *testing.T) {
+	tests := []struct {
+		read []byte
+		pos  int
+		size int
+		out  int
+		want []byte
+		err  error
+	}{
+		{
+			read: []byte("123"),
+			pos:  0,
+			size: 3,
+			out:  0,
+			want: []byte("123"),
+			err:  nil,
+		},
+		{
+			read: []byte("foo"),
+			pos:  1,
+			size: 3,
+			out:  0,
+			want: nil,
+			err:  Error{Code: ErrIntVarNotMuch, Pos: 1, Cause: &strconv.NumError{Func: "ParseInt", Num: "foo", Err: strconv.ErrSyntax}},
+		},
+		{
+			read: []byte("foo"),
+			pos:  2,
+			size: 4,
+			out:  0,
+			want: nil,
+			err:  Error{Code: ErrIntVarNotMuch, Pos: 2, Cause: io.EOF},
+		},
+	}
+	for _, test := range tests {
+		r := bytes.NewReader(test.read)
+		s := &matchState{r: r, ints: []int{test.size, test.out}}
+		inst := genInstIntWithSize(test.pos, 0, 1, false, 1024)
+		invokeInst(inst, s, test.want, test.err, t)
+		test.out = s.ints[1]
+		if test.out != 0 {
+			n, _ := strconv.ParseInt(string(test.want), 10, 64)
+			if test.out != int(n) {
+				t.Errorf("gtpm_test: got %d, want %d", test.out, n)
+			}
+		}
+	}
+
+}
+
+func TestGenInstHexIntWithSize(t *testing.T) {
+	tests := []struct {
+		read []byte
+		pos  int
+		size int
+		out  int
+		want []byte
+		err  error
+	}{
+		{
+			read: []byte("1f"),
+			pos:  0,
+			size: 2,
+			out:  31,
+			want: []byte("1f"),
+			err:  nil,
+		},
+		{
+			read: []byte("FF"),
+			pos:  1,
+			size: 2,
+			out:  255,
+			want: []byte("FF"),
+			err:  nil,
+		},
+		{
+			read: []byte("zz"),
+			pos:  2,
+			size: 2,
+			out:  0,
+			want: nil,
+			err:  Error{Code: ErrIntVarNotMuch, Pos: 2, Cause: &strconv.NumError{Func: "ParseUint", Num: "zz", Err: strconv.ErrSyntax}},
+		},
+		{
+			read: []byte("-1"),
+			pos:  3,
+			size: 2,
+			out:  0,
+			want: nil,
+			err:  Error{Code: ErrIntVarNotMuch, Pos: 3, Cause: &strconv.NumError{Func: "ParseUint", Num: "-1", Err: strconv.ErrSyntax}},
+		},
+		{
+			read: []byte("f"),
+			pos:  4,
+			size: 2,
+			out:  0,
+			want: nil,
+			err:  Error{Code: ErrIntVarNotMuch, Pos: 4, Cause: io.EOF},
+		},
+		{
+			read: []byte("ff"),
+			pos:  5,
+			size: -1,
+			out:  0,
+			want: nil,
+			err:  Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, 1024)), Pos: 5},
+		},
+		{
+			read: []byte("ff"),
+			pos:  6,
+			size: 1025,
+			out:  0,
+			want: nil,
+			err:  Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, 1024)), Pos: 6},
+		},
+	}
+	for _, test := range tests {
+		s := &matchState{r: bytes.NewReader(test.read), ints: []int{test.size, 0}}
+		inst := genInstHexIntWithSize(test.pos, 0, 1, 1024)
+		invokeInst(inst, s, test.want, test.err, t)
+		if s.ints[1] != test.out {
+			t.Errorf("gtpm_test: got %d, want %d", s.ints[1], test.out)
+		}
+	}
+}
+
+func TestGenInstIntWithoutSize(t *testing.T) {
+	tests := []struct {
+		read   []byte
+		pos    int
+		suffix []byte
+		out    int
+		max    int
+		want   []byte
+		err    error
+	}{
+		{
+			read:   []byte("789bar"),
+			pos:    0,
+			suffix: []byte("bar"),
+			out:    0,
+			max:    1024,
+			want:   []byte("789"),
+			err:    nil,
+		},
+		{
+			read:   []byte("foobar"),
+			pos:    1,
+			suffix: []byte("bar"),
+			out:    0,
+			max:    1024,
+			want:   nil,
+			err:    Error{Code: ErrIntVarNotMuch, Pos: 1, Cause: &strconv.NumError{Func: "ParseInt", Num: "foo", Err: strconv.ErrSyntax}},
+		},
+		{
+			read:   []byte("foobar"),
+			pos:    2,
+			suffix: []byte("buzz"),
+			out:    0,
+			max:    1024,
+			want:   nil,
+			err:    Error{Code: ErrIntVarNotMuch, Pos: 2, Cause: io.EOF},
+		},
+		{
+			read:   []byte("1234567890foobarbuzz"),
+			pos:    3,
+			suffix: []byte("foobarbuzz"),
+			out:    0,
+			max:    1024,
+			want:   []byte("1234567890"),
+			err:    nil,
+		},
+		{
+			read:   []byte("1234567890foobarbuzz"),
+			pos:    4,
+			suffix: []byte("foobarbuzz"),
+			out:    0,
+			max:    16,
+			want:   nil,
+			err:    Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, 16)), Pos: 4},
+		},
+	}
+	for _, test := range tests {
+		r := bytes.NewReader(test.read)
+		s := &matchState{r: r, ints: []int{test.out}}
+		inst := genInstIntWithoutSize(test.pos, test.suffix, 0, test.max, defaultGrowth)
+		invokeInst(inst, s, test.want, test.err, t)
+		test.out = s.ints[0]
+		if test.out != 0 {
+			n, _ := strconv.ParseInt(string(test.want), 10, 64)
+			if test.out != int(n) {
+				t.Errorf("gtpm_test: got %d, want %d", test.out, n)
+			}
+		}
+	}
+
+}
+
+func TestCompileAndMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		read    []byte
+		cerr    error
+		want    [][]byte
+		merr    error
+		opts    []Option
+	}{
+		{
+			pattern: "N/int,\r\n",
+			read:    []byte("123\r\n"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("123"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "_,\r\n",
+			read:    []byte("deadbeaf\r\n"),
+			cerr:    nil,
+			want:    nil,
+			merr:    nil,
+		},
+		{
+			pattern: "_:4",
+			read:    []byte("dead"),
+			cerr:    nil,
+			want:    nil,
+			merr:    nil,
+		},
+		{
+			pattern: "N/int,\r\n,_:N",
+			read:    []byte("4\r\nbeaf"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("4"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "N/int,\r\n,_:N:0",
+			read:    nil,
+			cerr:    Error{Code: ErrParseColonExpected, Pos: 10},
+			want:    nil,
+			merr:    nil,
+		},
+		{
+			pattern: "N/int,\r\n,_:M",
+			read:    nil,
+			cerr:    Error{Code: ErrorCode(fmt.Sprintf(ErrParseVariableNotDefined, "M")), Pos: 10},
+			want:    nil,
+			merr:    nil,
+		},
+		{
+			pattern: "Number/int,\r\n,_:Number",
+			read:    []byte("4\r\nbea"),
+			cerr:    nil,
+			want:    nil,
+			merr:    Error{Code: ErrVarNotMuch, Pos: 15, Cause: io.EOF},
+		},
+		{
+			pattern: "V/bin,\r\n,N/int:2,v2/bin:N,\r\n",
+			read:    []byte("foobarbuzz\r\n16abcdef0123456789\r\n"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("foobarbuzz"),
+				[]byte("16"),
+				[]byte("abcdef0123456789"),
+			},
+			merr: nil,
+			opts: []Option{WithMaxVariableSize(32)},
+		},
+		{
+			pattern: "V/bin:3,N/int:1,\t,N2/int:N,var/bin:N2",
+			read:    []byte("abc1\t8deadbeaf"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("abc"),
+				[]byte("1"),
+				[]byte("8"),
+				[]byte("deadbeaf"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "(GET|POST|PUT), ,_,\r\n",
+			read:    []byte("POST /index.html\r\n"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("1"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "ID/nz:4,N/int:1,Name/nz:N:20",
+			read:    []byte("\x00\x00\x00\x013ab "),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("\x00\x00\x00\x01"),
+				[]byte("3"),
+				[]byte("ab "),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "ID/nz:4,N/int:1,Name/nz:N:20",
+			read:    []byte("\x00\x00\x00\x013   "),
+			cerr:    nil,
+			want:    nil,
+			merr:    Error{Code: ErrorCode(fmt.Sprintf(ErrVarPadded, ' ')), Pos: 17},
+		},
+		{
+			pattern: "ID/nz:4:zz",
+			read:    nil,
+			cerr:    Error{Code: ErrParseInvalidPad, Pos: 1},
+			want:    nil,
+			merr:    nil,
+		},
+		{
+			pattern: "N/int:1,S/bin:N,align:4,V/bin:2",
+			read:    []byte("1a\x00\x00ok"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("1"),
+				[]byte("a"),
+				[]byte("ok"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "N/int:1,S/bin:N,align:4,V/bin:2",
+			read:    []byte("2ab\x00ok"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("2"),
+				[]byte("ab"),
+				[]byte("ok"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "N/int:1,S/bin:N,align:4,V/bin:2",
+			read:    []byte("4abcd\x00\x00\x00ok"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("4"),
+				[]byte("abcd"),
+				[]byte("ok"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "foo,align:0",
+			read:    nil,
+			cerr:    Error{Code: ErrParseInvalidAlign, Pos: 5},
+			want:    nil,
+			merr:    nil,
+		},
+		{
+			pattern: "HDR,Body/bin:rest-8,Trailer/bin:8",
+			read:    []byte("HDRhello, world\x00\x01\x02\x03\x04\x05\x06\x07"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("hello, world"),
+				[]byte("\x00\x01\x02\x03\x04\x05\x06\x07"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "Body/bin:rest8",
+			read:    nil,
+			cerr:    Error{Code: ErrParseInvalidRest, Pos: 1},
+			want:    nil,
+			merr:    nil,
+		},
+		{
+			pattern: "X/fixed:.,\r\n",
+			read:    []byte("12.34\r\n"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("12"),
+				[]byte("34"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "X/fixed,\r\n,I/bin:X,F/bin:X.frac",
+			read:    []byte("2.3\r\nabcde"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("2"),
+				[]byte("3"),
+				[]byte("ab"),
+				[]byte("cde"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "X/fixed:.",
+			read:    nil,
+			cerr:    Error{Code: ErrParseSuffixExpected, Pos: 1},
+			want:    nil,
+			merr:    nil,
+		},
+		{
+			pattern: "A/int:1,B/int:1,C/int:1,D/int:1,E/bin:A",
+			read:    []byte("3111abc"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("3"),
+				[]byte("1"),
+				[]byte("1"),
+				[]byte("1"),
+				[]byte("abc"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "?OK:,V/bin,\r\n",
+			read:    []byte("OK:foo\r\n"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("1"),
+				[]byte("foo"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "?OK:,V/bin,\r\n",
+			read:    []byte("foo\r\n"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("0"),
+				[]byte("foo"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "D/bin:1,Field/bin:@D,Next/bin:@D",
+			read:    []byte("|foo|bar|"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("|"),
+				[]byte("foo"),
+				[]byte("bar"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "D/bin,\t,Field/bin:@D",
+			read:    []byte("\r\n\tfoo\r\n"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("\r\n"),
+				[]byte("foo"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "N/int:1,D/bin:N,Field/bin:@D",
+			read:    []byte("0foo"),
+			cerr:    nil,
+			want:    nil,
+			merr:    Error{Code: ErrSuffixEmpty, Pos: 17},
+		},
+		{
+			pattern: "N/rep{,D/bin:1,},;,B/bin:@D",
+			read:    []byte(";xx"),
+			cerr:    nil,
+			want:    nil,
+			merr:    Error{Code: ErrSuffixEmpty, Pos: 20},
+		},
+		{
+			pattern: "Field/bin:@D",
+			read:    nil,
+			cerr:    Error{Code: ErrorCode(fmt.Sprintf(ErrParseVariableNotDefined, "D")), Pos: 1},
+			want:    nil,
+			merr:    nil,
+		},
+		{
+			pattern: "Count/rep{,K/bin,=,V/bin,;,},\r\n",
+			read:    []byte("a=1;b=2;c=3;\r\n"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("a"),
+				[]byte("1"),
+				[]byte("b"),
+				[]byte("2"),
+				[]byte("c"),
+				[]byte("3"),
+				[]byte("3"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "Count/rep{,K/bin,;,},\r\n,Tail/bin:Count",
+			read:    []byte("\r\n"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("0"),
+				[]byte{},
+			},
+			merr: nil,
+		},
+		{
+			pattern: "N/int:1,Count/rep{,K/bin,;,},\r\n,Tail/bin:Count",
+			read:    []byte("2x;y;\r\nab"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("2"),
+				[]byte("x"),
+				[]byte("y"),
+				[]byte("2"),
+				[]byte("ab"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "Count/rep{,K/bin,;,},\r\n",
+			read:    []byte("x;y;"),
+			cerr:    nil,
+			want:    nil,
+			merr:    Error{Code: ErrConstNotMuch, Pos: 22, Cause: io.EOF},
+		},
+		{
+			pattern: "Count/rep{,K/bin,;",
+			read:    nil,
+			cerr:    Error{Code: ErrParseBraceExpected, Pos: 18},
+			want:    nil,
+			merr:    nil,
+		},
+		{
+			pattern: "Count/rep{,K/bin,;,}",
+			read:    nil,
+			cerr:    Error{Code: ErrParseSuffixExpected, Pos: 20},
+			want:    nil,
+			merr:    nil,
+		},
+		{
+			pattern: "Len/int:4,Type/bin:1,Body/frame:Len",
+			read:    []byte("0011Xfoobarnext"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("0011"),
+				[]byte("X"),
+				[]byte("foobar"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "N/int",
+			read:    nil,
+			cerr:    Error{Code: ErrorCode(fmt.Sprintf(ErrParseSuffixExpectedFor, "N", "N/int")), Pos: 1},
+			want:    nil,
+			merr:    nil,
+		},
+		{
+			pattern: "foo,Value/bin",
+			read:    nil,
+			cerr:    Error{Code: ErrorCode(fmt.Sprintf(ErrParseSuffixExpectedFor, "Value", "Value/bin")), Pos: 5},
+			want:    nil,
+			merr:    nil,
+		},
+		{
+			pattern: "foo,_",
+			read:    nil,
+			cerr:    Error{Code: ErrParseSuffixExpected, Pos: 5},
+			want:    nil,
+			merr:    nil,
+		},
+		{
+			pattern: "N/int/bin",
+			read:    nil,
+			cerr:    Error{Code: ErrParseInvalidSlash, Pos: 1},
+			want:    nil,
+			merr:    nil,
+		},
+		{
+			pattern: "hoge,N/bi",
+			read:    nil,
+			cerr:    Error{Code: ErrParseInvalidType, Pos: 6},
+			want:    nil,
+			merr:    nil,
+		},
+		{
+			pattern: "foo,N/inte",
+			read:    nil,
+			cerr:    Error{Code: ErrParseInvalidType, Pos: 5},
+			want:    nil,
+			merr:    nil,
+		},
+		{
+			pattern: "foo,N/binary",
+			read:    nil,
+			cerr:    Error{Code: ErrParseInvalidType, Pos: 5},
+			want:    nil,
+			merr:    nil,
+		},
+		{
+			pattern: "foo,N/foo",
+			read:    nil,
+			cerr:    Error{Code: ErrParseInvalidType, Pos: 5},
+			want:    nil,
+			merr:    nil,
+		},
+		{
+			pattern: "N/int,\r\n,foo/int:M",
+			read:    nil,
+			cerr:    Error{Code: ErrorCode(fmt.Sprintf(ErrParseVariableNotDefined, "M")), Pos: 10},
+			want:    nil,
+			merr:    nil,
+		},
+		{
+			pattern: "N/int,\r\n,foo/bin:Num",
+			read:    nil,
+			cerr:    Error{Code: ErrorCode(fmt.Sprintf(ErrParseVariableNotDefined, "Num")), Pos: 10},
+			want:    nil,
+			merr:    nil,
+		},
+		{
+			pattern: "Key/bin!,:,V/bin,\r\n",
+			read:    []byte("foo:\r\n"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("foo"),
+				[]byte(""),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "Key/bin!,:,V/bin,\r\n",
+			read:    []byte(":bar\r\n"),
+			cerr:    nil,
+			want:    nil,
+			merr:    Error{Code: ErrorCode(fmt.Sprintf(ErrVarRequired, "Key")), Pos: 10},
+		},
+		{
+			pattern: "Cmd/bin, ,Arg/netstring,\r\n",
+			read:    []byte("SET 5:hello,\r\n"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("SET"),
+				[]byte("hello"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "Key/bin:3,Pad/run:20,V/bin,\r\n",
+			read:    []byte("foo   bar\r\n"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("foo"),
+				[]byte("   "),
+				[]byte("bar"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "F/crc32,END",
+			read:    []byte("abc\x35\x24\x41\xc2END"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("abc"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "F/bin, ,Args/nest:(),\r\n",
+			read:    []byte("f (a(b)c)\r\n"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("f"),
+				[]byte("(a(b)c)"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "Args/nest:((,\r\n",
+			read:    nil,
+			cerr:    Error{Code: ErrParseInvalidBrackets, Pos: 1},
+			want:    nil,
+			merr:    nil,
+		},
+		{
+			pattern: "Cmd/bin, ,Arg/lp,\r\n",
+			read:    []byte("SET 3:abc\r\n"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("SET"),
+				[]byte("abc"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "Arg/lp,\r\n",
+			read:    []byte("2048:abc\r\n"),
+			cerr:    nil,
+			want:    nil,
+			merr:    Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, 1024)), Pos: 1},
+			opts:    []Option{WithMaxVariableSize(1024)},
+		},
+		{
+			pattern: "Arg/lp,\r\n",
+			read:    []byte("-1:abc\r\n"),
+			cerr:    nil,
+			want:    nil,
+			merr:    Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, 4096)), Pos: 1},
+		},
+		{
+			pattern: "Key/bin:~4,=,V/bin,\r\n",
+			read:    []byte("foobar=baz\r\n"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("foob"),
+				[]byte("ar=baz"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "Key/bin:<=4,=,V/bin,\r\n",
+			read:    []byte("foobar=baz\r\n"),
+			cerr:    nil,
+			want:    nil,
+			merr:    Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, 4)), Pos: 13},
+		},
+		{
+			pattern: "Key/bin:~0,=",
+			read:    nil,
+			cerr:    Error{Code: ErrParseInvalidLimit, Pos: 1},
+			want:    nil,
+			merr:    nil,
+		},
+		{
+			pattern: "A/bin:~4611686018427387904,\r\n",
+			read:    nil,
+			cerr:    Error{Code: ErrParseInvalidLimit, Pos: 1},
+			want:    nil,
+			merr:    nil,
+		},
+		{
+			pattern: "A/bin:<=8,\r\n",
+			read:    nil,
+			cerr:    Error{Code: ErrParseInvalidLimit, Pos: 1},
+			want:    nil,
+			merr:    nil,
+			opts:    []Option{WithMaxVariableSize(4)},
+		},
+		{
+			pattern: "A/rep{,B/rep{,C/rep{,V/bin:1,},;,},;,},\r\n",
+			read:    nil,
+			cerr:    Error{Code: ErrorCode(fmt.Sprintf(ErrExpansionTooDeep, 2)), Pos: 15},
+			want:    nil,
+			merr:    nil,
+			opts:    []Option{WithMaxExpansionDepth(2)},
+		},
+		{
+			pattern: "A/rep{,B/rep{,V/bin:1,},;,},\r\n",
+			read:    []byte("ab;c;\r\n"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("a"),
+				[]byte("b"),
+				[]byte("2"),
+				[]byte("c"),
+				[]byte("1"),
+				[]byte("2"),
+			},
+			merr: nil,
+			opts: []Option{WithMaxExpansionDepth(2)},
+		},
+		{
+			pattern: "K/bin:2,N/int:0,\r\n",
+			read:    nil,
+			cerr:    Error{Code: ErrParseZeroWidthInt, Pos: 9},
+			want:    nil,
+			merr:    nil,
+		},
+		{
+			pattern: "N/hexint:0,\r\n",
+			read:    nil,
+			cerr:    Error{Code: ErrParseZeroWidthInt, Pos: 1},
+			want:    nil,
+			merr:    nil,
+		},
+		{
+			pattern: "K/bin:0,N/int:1,\r\n",
+			read:    []byte("5\r\n"),
+			cerr:    nil,
+			want: [][]byte{
+				{},
+				[]byte("5"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "VER ,=/int:42,\r\n,V/bin,\r\n",
+			read:    []byte("VER 42\r\nfoo\r\n"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("foo"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "VER ,=/int:42,\r\n,V/bin,\r\n",
+			read:    []byte("VER 41\r\nfoo\r\n"),
+			cerr:    nil,
+			want:    nil,
+			merr:    Error{Code: ErrorCode(fmt.Sprintf(ErrIntNotEqual, 42)), Pos: 6},
+		},
+		{
+			pattern: "=/int:4x",
+			read:    nil,
+			cerr:    Error{Code: ErrParseInvalidExpected, Pos: 1},
+			want:    nil,
+			merr:    nil,
+		},
+		{
+			pattern: "Type/int:1,V/bin:Type[1=4|2=8],\r\n",
+			read:    []byte("1abcd\r\n"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("1"),
+				[]byte("abcd"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "Type/int:1,V/bin:Type[1=4|2=8],\r\n",
+			read:    []byte("2abcdefgh\r\n"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("2"),
+				[]byte("abcdefgh"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "Type/int:1,V/bin:Type[1=4|2=8],\r\n",
+			read:    []byte("3abc\r\n"),
+			cerr:    nil,
+			want:    nil,
+			merr:    Error{Code: ErrorCode(fmt.Sprintf(ErrSizeNotFound, 3)), Pos: 12},
+		},
+		{
+			pattern: "Type/int:1,V/bin:Type[1=4|2],\r\n",
+			read:    nil,
+			cerr:    Error{Code: ErrParseInvalidSizeTable, Pos: 12},
+			want:    nil,
+			merr:    nil,
+		},
+		{
+			pattern: "A/bin,;,B/bin,;,C/bin,\r\n",
+			read:    []byte("aaaa;bbbb;cccc\r\n"),
+			cerr:    nil,
+			want:    nil,
+			merr:    Error{Code: ErrorCode(fmt.Sprintf(ErrCaptureBudget, 10)), Pos: 23},
+			opts:    []Option{WithMaxVariableSize(8), WithTotalCaptureBudget(10)},
+		},
+		{
+			pattern: "A/bin,;,B/bin,;,C/bin,\r\n",
+			read:    []byte("aaa;bbb;ccc\r\n"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("aaa"),
+				[]byte("bbb"),
+				[]byte("ccc"),
+			},
+			merr: nil,
+			opts: []Option{WithMaxVariableSize(8), WithTotalCaptureBudget(10)},
+		},
+		{
+			pattern: "N/int:1,V/bin:N*2.5",
+			read:    nil,
+			cerr:    Error{Code: ErrorCode(fmt.Sprintf(ErrParseInvalidSize, "N*2.5")), Pos: 9},
+			want:    nil,
+			merr:    nil,
+		},
+		{
+			pattern: "N/int:1,V/bin:N/0",
+			read:    nil,
+			cerr:    Error{Code: ErrParseInvalidSlash, Pos: 9},
+			want:    nil,
+			merr:    nil,
+		},
+		{
+			pattern: "_:-3,\r\n",
+			read:    nil,
+			cerr:    Error{Code: ErrorCode(fmt.Sprintf(ErrParseInvalidSize, "-3")), Pos: 1},
+			want:    nil,
+			merr:    nil,
+		},
+		{
+			pattern: "N/int:1,V/bin:N+1",
+			read:    nil,
+			cerr:    Error{Code: ErrorCode(fmt.Sprintf(ErrParseInvalidSize, "N+1")), Pos: 9},
+			want:    nil,
+			merr:    nil,
+		},
+		{
+			pattern: "A/bin:1,B/bin:1,C/bin:1,\r\n",
+			read:    nil,
+			cerr:    Error{Code: ErrorCode(fmt.Sprintf(ErrTooManyVariables, 2)), Pos: 17},
+			want:    nil,
+			merr:    nil,
+			opts:    []Option{WithMaxVariables(2)},
+		},
+		{
+			pattern: "N/int:1,V/bin:N,N/int:1,V/bin:N",
+			read:    []byte("1a2bc"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("1"),
+				[]byte("a"),
+				[]byte("2"),
+				[]byte("bc"),
+			},
+			merr: nil,
+			opts: []Option{WithMaxVariables(2)},
+		},
+		{
+			pattern: "Len/int:2,Items/rep{:Len,T/bin:2,V/bin:8,},\r\n",
+			read:    []byte("20t1abcdefght2ijklmnop\r\n"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("20"),
+				[]byte("t1"),
+				[]byte("abcdefgh"),
+				[]byte("t2"),
+				[]byte("ijklmnop"),
+				[]byte("2"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "Len/int:2,Items/rep{:Len,T/bin:2,V/bin:8,},\r\n",
+			read:    []byte("15t1abcdefght2ijklmnop\r\n"),
+			cerr:    nil,
+			want:    nil,
+			merr:    Error{Code: ErrorCode(fmt.Sprintf(ErrRepOverrun, 15)), Pos: 11},
+		},
+		{
+			pattern: "Items/rep{:Len,V/bin:8,}",
+			read:    nil,
+			cerr:    Error{Code: ErrorCode(fmt.Sprintf(ErrParseVariableNotDefined, "Len")), Pos: 1},
+			want:    nil,
+			merr:    nil,
+		},
+		{
+			pattern: "Key/bin,:,Value/bin:\",\r\n,Next/bin,\r\n",
+			read:    []byte("Cookie:a=\"b\r\nc\"\r\nfoo\r\n"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("Cookie"),
+				[]byte("a=\"b\r\nc\""),
+				[]byte("foo"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "N/hexint:2,V/bin:N",
+			read:    []byte("1f0123456789abcdef0123456789abcde"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("1f"),
+				[]byte("0123456789abcdef0123456789abcde"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "Count/u16be,Items/bin:4{Count},\r\n",
+			read:    []byte("\x00\x03aaaabbbbcccc\r\n"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("\x00\x03"),
+				[]byte("aaaa"),
+				[]byte("bbbb"),
+				[]byte("cccc"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "Count/u8,Items/bin:4{Count},\r\n",
+			read:    []byte("\x00\r\n"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("\x00"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "Count/u32le,Items/bin:4{Count}",
+			read:    []byte("\xff\xff\x00\x00aaaa"),
+			cerr:    nil,
+			want:    nil,
+			merr:    Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, 1024)), Pos: 13},
+			opts:    []Option{WithMaxVariableSize(1024)},
+		},
+		{
+			pattern: "Count/u16be,Items/bin:4{Count}",
+			read:    []byte("\x01\x01aaaa"),
+			cerr:    nil,
+			want:    nil,
+			merr:    Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, 1024)), Pos: 13},
+			opts:    []Option{WithMaxVariableSize(1024)},
+		},
+		{
+			pattern: "N/u64be,B/bin:N",
+			read:    []byte("\xff\xff\xff\xff\xff\xff\xff\xffab"),
+			cerr:    nil,
+			want:    nil,
+			merr:    Error{Code: ErrIntVarNotMuch, Pos: 1, Cause: strconv.ErrRange},
+		},
+		{
+			pattern: "N/u32be,B/bin:N",
+			read:    []byte("\xff\xff\xff\xffab"),
+			cerr:    nil,
+			want:    nil,
+			merr:    Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, 4096)), Pos: 9},
+		},
+		{
+			pattern: "X/fixed:.,;,B/bin:X",
+			read:    []byte("-2.5;ab"),
+			cerr:    nil,
+			want:    nil,
+			merr:    Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, 4096)), Pos: 13},
+		},
+		{
+			pattern: "(GET|OPTIONS), ,Path/bin,\r\n",
+			read:    []byte("GET /\r\n"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("0"),
+				[]byte("/"),
+			},
+			merr: nil,
+			opts: []Option{WithMaxLookahead(4)},
+		},
+		{
+			pattern: "(GET|OPTIONS), ,Path/bin,\r\n",
+			read:    []byte("OPTIONS *\r\n"),
+			cerr:    nil,
+			want:    nil,
+			merr:    Error{Code: ErrorCode(fmt.Sprintf(ErrLookaheadTooLong, 4)), Pos: 1},
+			opts:    []Option{WithMaxLookahead(4)},
+		},
+		{
+			pattern: "?VERBOSE:,Msg/bin,\n",
+			read:    []byte("hello\n"),
+			cerr:    nil,
+			want:    nil,
+			merr:    Error{Code: ErrorCode(fmt.Sprintf(ErrLookaheadTooLong, 4)), Pos: 1},
+			opts:    []Option{WithMaxLookahead(4)},
+		},
+		{
+			pattern: "A/bin,\\,\r\n,B/bin,\r\n",
+			read:    []byte("x,y,\r\nz\r\n"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("x,y"),
+				[]byte("z"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "(a\\,b|c),V/bin:1",
+			read:    []byte("a,bd"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("0"),
+				[]byte("d"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "C:\\\\,V/bin:1",
+			read:    []byte("C:\\x"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("x"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "A\\\\\\,B,V/bin:1",
+			read:    []byte("A\\,Bx"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("x"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "T/int:1,x/bin:T[1=9223372036854775807]",
+			read:    nil,
+			cerr:    Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, 4096)), Pos: 9},
+			want:    nil,
+			merr:    nil,
+		},
+		{
+			pattern: "T/int:1,x/bin:T[1=100]",
+			read:    nil,
+			cerr:    Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, 16)), Pos: 9},
+			want:    nil,
+			merr:    nil,
+			opts:    []Option{WithMaxVariableSize(16)},
+		},
+		{
+			pattern: "N/int:2,x/hexint:N",
+			read:    []byte("-1ff"),
+			cerr:    nil,
+			want:    nil,
+			merr:    Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, 4096)), Pos: 9},
+		},
+		{
+			pattern: "N/int:2,x/int:N",
+			read:    []byte("-1ff"),
+			cerr:    nil,
+			want:    nil,
+			merr:    Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, 4096)), Pos: 9},
+		},
+		{
+			pattern: "N/int:4,x/int:N",
+			read:    []byte("9999ff"),
+			cerr:    nil,
+			want:    nil,
+			merr:    Error{Code: ErrorCode(fmt.Sprintf(ErrVarExceedMaxSize, 4096)), Pos: 9},
+		},
+		{
+			pattern: "n/rep{,},;",
+			read:    []byte("x;"),
+			cerr:    nil,
+			want:    nil,
+			merr:    Error{Code: ErrRepNoProgress, Pos: 10},
+		},
+		{
+			pattern: "n/rep{,?a,},;",
+			read:    []byte("x;"),
+			cerr:    nil,
+			want:    nil,
+			merr:    Error{Code: ErrRepNoProgress, Pos: 13},
+		},
+		{
+			pattern: "n/rep{,?a,},;",
+			read:    []byte("aa;"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("1"),
+				[]byte("1"),
+				[]byte("2"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "L/int:1,n/rep{:L,?a,}",
+			read:    []byte("2xy"),
+			cerr:    nil,
+			want:    nil,
+			merr:    Error{Code: ErrRepNoProgress, Pos: 9},
+		},
+		{
+			pattern: "V/bin,;,W/bin:1",
+			read:    []byte(";x"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte(""),
+				[]byte("x"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "V/bin:0,W/bin:1",
+			read:    []byte("x"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte(""),
+				[]byte("x"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "n/rep{,K/bin:1,},;",
+			read:    []byte("ab;"),
+			cerr:    nil,
+			want: [][]byte{
+				[]byte("a"),
+				[]byte("b"),
+				[]byte("2"),
+			},
+			merr: nil,
+		},
+		{
+			pattern: "Key/bin!:3",
+			read:    nil,
+			cerr:    Error{Code: ErrParseInvalidRequired, Pos: 1},
+			want:    nil,
+			merr:    nil,
+		},
+	}
+	for _, test := range tests {
+		m, err := Compile(test.pattern, test.opts...)
+		if err != test.cerr {
+			t.Errorf("gtpm_test: got %+v, want %+v", err, test.cerr)
+		}
+		if err != nil {
+			continue
+		}
+		r := bytes.NewReader(test.read)
+		matched, err := m.MatchReader(r)
+		if !cmpByteSliceSlice(matched, test.want) || err != test.merr {
+			t.Errorf("gtpm_test: got %#v %+v, want %#v %+v", matched, err, test.want, test.merr)
+		}
+		// zero-copy captures must be the same as copied ones
+		want, werr := m.MatchBytes(test.read)
+		zm, err := Compile(test.pattern, append(test.opts[:len(test.opts):len(test.opts)], WithZeroCopyCaptures())...)
+		if err != nil {
+			t.Fatalf("gtpm_test: got %+v, want nil", err)
+		}
+		got, gerr := zm.MatchBytes(test.read)
+		if !cmpByteSliceSlice(got, want) || fmt.Sprint(gerr) != fmt.Sprint(werr) {
+			t.Errorf("gtpm_test: %q zero-copy got %#v %+v, want %#v %+v", test.pattern, got, gerr, want, werr)
+		}
+	}
+}
+
+func TestCompileUnresolved(t *testing.T) {
+	_, err := Compile("A/bin:Len,B/bin:@Delim,C/bin:4")
+	want := Errors{
+		{Code: ErrorCode(fmt.Sprintf(ErrParseVariableNotDefined, "Len")), Pos: 1},
+		{Code: ErrorCode(fmt.Sprintf(ErrParseVariableNotDefined, "Delim")), Pos: 11},
+	}
+	var got Errors
+	if !errors.As(err, &got) || len(got) != len(want) {
+		t.Fatalf("gtpm_test: got %+v, want %+v", err, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("gtpm_test: got %+v, want %+v", got[i], want[i])
+		}
+	}
+	if !errors.Is(err, want[1]) {
+		t.Errorf("gtpm_test: got %+v, want it to wrap %+v", err, want[1])
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		read    []byte
+		opts    []Option
+	}{
+		{
+			pattern: "V/bin,\r\n,N/int:2,v2/bin:N,\r\n",
+			read:    []byte("foobarbuzz\r\n16abcdef0123456789\r\n"),
+			opts:    []Option{WithMaxVariableSize(32)},
+		},
+		{
+			pattern: "Number/int,\r\n,_:Number",
+			read:    []byte("4\r\nbea"),
+		},
+		{
+			pattern: "N/int,\r\n,_:M",
+			read:    []byte("4\r\nbeaf"),
+		},
+	}
+	for _, test := range tests {
+		got, gotErr := Match(test.pattern, bytes.NewReader(test.read), test.opts...)
+		var want [][]byte
+		m, wantErr := Compile(test.pattern, test.opts...)
+		if wantErr == nil {
+			want, wantErr = m.MatchReader(bytes.NewReader(test.read))
+		}
+		if !cmpByteSliceSlice(got, want) || gotErr != wantErr {
+			t.Errorf("gtpm_test: got %#v %+v, want %#v %+v", got, gotErr, want, wantErr)
+		}
+	}
+}
+
+func TestCompileAll(t *testing.T) {
+	patterns := []string{
+		"N/int,\r\n",
+		"V/bin,\r\n,N/int:2,v2/bin:N,\r\n",
+		"N/int,\r\n,_:M",
+		"N/int",
+	}
+	matchers, err := CompileAll(patterns[:2], WithMaxVariableSize(32))
+	if err != nil || len(matchers) != 2 {
+		t.Fatalf("gtpm_test: got %d matchers %+v, want 2 matchers nil", len(matchers), err)
+	}
+	for _, m := range matchers {
+		if m.(*TextPatternMatcher).maxVarSize != 32 {
+			t.Errorf("gtpm_test: got %d, want 32", m.(*TextPatternMatcher).maxVarSize)
+		}
+	}
+	matched, err := matchers[1].MatchReader(bytes.NewReader([]byte("foobarbuzz\r\n16abcdef0123456789\r\n")))
+	if err != nil || len(matched) != 3 {
+		t.Errorf("gtpm_test: got %#v %+v, want 3 captures nil", matched, err)
+	}
+
+	matchers, err = CompileAll(patterns)
+	want := PatternError{Index: 2, Err: Error{Code: ErrorCode(fmt.Sprintf(ErrParseVariableNotDefined, "M")), Pos: 10}}
+	if matchers != nil || err != want {
+		t.Errorf("gtpm_test: got %#v %+v, want nil %+v", matchers, err, want)
+	}
+	var e Error
+	if !errors.As(err, &e) || e.Pos != 10 {
+		t.Errorf("gtpm_test: got %+v, want an Error at 10", err)
+	}
+	for _, ps := range [][]string{nil, patterns[:2]} {
+		matchers, err = CompileAll(ps, WithMaxVariableSizeBytes("bogus"))
+		if !errors.As(err, &e) || e.Code != ErrorCode(fmt.Sprintf(ErrInvalidByteSize, "bogus")) || matchers != nil {
+			t.Errorf("gtpm_test: got %#v %+v, want nil %s", matchers, err, fmt.Sprintf(ErrInvalidByteSize, "bogus"))
+		}
+		if errors.As(err, new(PatternError)) {
+			t.Errorf("gtpm_test: got %+v, want it not to blame a pattern", err)
+		}
+	}
+}
+
+func TestWithEOFOnEmpty(t *testing.T) {
+	tests := []struct {
+		pattern string
+		read    []byte
+		opts    []Option
+		err     error
+	}{
+		{
+			pattern: "foo",
+			read:    nil,
+			opts:    []Option{WithEOFOnEmpty()},
+			err:     io.EOF,
+		},
+		{
+			pattern: "foo",
+			read:    nil,
+			opts:    nil,
+			err:     Error{Code: ErrConstNotMuch, Pos: 1, Cause: io.EOF},
+		},
+		{
+			pattern: "foo",
+			read:    []byte("fo"),
+			opts:    []Option{WithEOFOnEmpty()},
+			err:     Error{Code: ErrConstNotMuch, Pos: 1, Cause: io.EOF},
+		},
+		{
+			pattern: "N/int,\r\n,_:N",
+			read:    []byte("3\r\n"),
+			opts:    []Option{WithEOFOnEmpty()},
+			err:     Error{Code: ErrVarNotMuch, Pos: 10, Cause: io.EOF},
+		},
+	}
+	for _, test := range tests {
+		m, err := Compile(test.pattern, test.opts...)
+		if err != nil {
+			t.Fatalf("gtpm_test: got %+v, want nil", err)
+		}
+		_, err = m.MatchReader(bytes.NewReader(test.read))
+		if err != test.err {
+			t.Errorf("gtpm_test: got %+v, want %+v", err, test.err)
+		}
+	}
+	m, _ := Compile("N/int,\r\n", WithEOFOnEmpty())
+	r := bytes.NewReader([]byte("1\r\n2\r\n"))
+	var records int
+	for {
+		_, err := m.MatchReader(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("gtpm_test: got %+v, want nil", err)
+		}
+		records++
+	}
+	if records != 2 {
+		t.Errorf("gtpm_test: got %d records, want 2", records)
+	}
+}
+
+func TestMinInputLen(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    int
+	}{
+		{
+			pattern: "foo",
+			want:    3,
+		},
+		{
+			pattern: "V/bin,\r\n,N/int:2,v2/bin:N,\r\n",
+			want:    6,
+		},
+		{
+			pattern: "V/bin:3,N/int:1,\t,N2/int:N,var/bin:N2",
+			want:    5,
+		},
+		{
+			pattern: "(GET|POST|PUT), ,_:4,_,\r\n",
+			want:    10,
+		},
+		{
+			pattern: "N/int:1,Count/rep{,K/bin:4,;,},\r\n",
+			want:    3,
+		},
+		{
+			pattern: "?V2:{,HEADER,},X",
+			want:    1,
+		},
+		{
+			pattern: "?V2:{,HEADER,}|{,AB,},X",
+			want:    3,
+		},
+		{
+			pattern: "?A:{,?B:{,xy,}|{,},}|{,LONGER,},Z",
+			want:    3,
+		},
+	}
+	for _, test := range tests {
+		m, err := Compile(test.pattern)
+		if err != nil {
+			t.Fatalf("gtpm_test: got %+v, want nil", err)
+		}
+		if got := m.(*TextPatternMatcher).MinInputLen(); got != test.want {
+			t.Errorf("gtpm_test: %q got %d, want %d", test.pattern, got, test.want)
+		}
+	}
+}
+
+func TestIsFixedSize(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    int
+		fixed   bool
+	}{
+		{
+			pattern: "HDR,Type/bin:2,Len/int:4,_:2,Flag/nz:1",
+			want:    12,
+			fixed:   true,
+		},
+		{
+			pattern: "HDR,Type/bin:2,Name/bin,\r\n",
+			want:    0,
+			fixed:   false,
+		},
+		{
+			pattern: "Len/int:2,Body/bin:Len",
+			want:    0,
+			fixed:   false,
+		},
+	}
+	for _, test := range tests {
+		m, err := Compile(test.pattern)
+		if err != nil {
+			t.Fatalf("gtpm_test: got %+v, want nil", err)
+		}
+		if got, fixed := m.(*TextPatternMatcher).IsFixedSize(); got != test.want || fixed != test.fixed {
+			t.Errorf("gtpm_test: %q got %d %v, want %d %v", test.pattern, got, fixed, test.want, test.fixed)
+		}
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    []byte
+		ok      bool
+	}{
+		{
+			pattern: "HELLO ,world ,Name/bin,\r\n",
+			want:    []byte("HELLO world "),
+			ok:      true,
+		},
+		{
+			pattern: "Method/bin, ,Path/bin,\r\n",
+			want:    nil,
+			ok:      false,
+		},
+		{
+			pattern: "(GET|PUT), ,Path/bin,\r\n",
+			want:    nil,
+			ok:      false,
+		},
+	}
+	for _, test := range tests {
+		m, err := Compile(test.pattern)
+		if err != nil {
+			t.Fatalf("gtpm_test: got %+v, want nil", err)
+		}
+		if got, ok := m.(*TextPatternMatcher).Prefix(); !bytes.Equal(got, test.want) || ok != test.ok {
+			t.Errorf("gtpm_test: %q got %q %v, want %q %v", test.pattern, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	m, err := Compile("Key/bin,:,N/int,\r\n,V/bin:N,END")
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	tpm := m.(*TextPatternMatcher)
+	if got, want := tpm.Explain(bytes.NewReader([]byte("foo:3\r\nbarEND"))), "matched 13 bytes with 3 captures"; got != want {
+		t.Errorf("gtpm_test: got %q, want %q", got, want)
+	}
+	got := tpm.Explain(bytes.NewReader([]byte("foo:3\r\nbarEOF")))
+	for _, want := range []string{"instruction 3 (const at 28)", `expected: "END"`, `actual: "EOF"`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("gtpm_test: got %q, want it to contain %q", got, want)
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+type errReader struct {
+	data []byte
+	err  error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestWithConstReadFailed(t *testing.T) {
+	failure := errors.New("connection reset")
+	tests := []struct {
+		r    io.Reader
+		opts []Option
+		want error
+	}{
+		{
+			r:    bytes.NewReader([]byte("HTTP 200 NG\r\n")),
+			opts: []Option{WithConstReadFailed()},
+			want: Error{Code: ErrConstNotMuch, Pos: 21},
+		},
+		{
+			r:    &errReader{data: []byte("HTTP 200 "), err: failure},
+			opts: []Option{WithConstReadFailed()},
+			want: Error{Code: ErrConstReadFailed, Pos: 21, Cause: failure},
+		},
+		{
+			r:    bytes.NewReader([]byte("HTTP 200 ")),
+			opts: []Option{WithConstReadFailed()},
+			want: Error{Code: ErrConstNotMuch, Pos: 21, Cause: io.EOF},
+		},
+		{
+			r:    &errReader{data: []byte("HTTP 200 "), err: failure},
+			opts: nil,
+			want: Error{Code: ErrConstNotMuch, Pos: 21, Cause: failure},
+		},
+	}
+	for _, test := range tests {
+		_, err := Match("HTTP, ,Code/int:3, ,OK,\r\n", test.r, test.opts...)
+		if !checkError(err, test.want) {
+			t.Errorf("gtpm_test: got %+v, want %+v", err, test.want)
+		}
+	}
+}
+
+// flakyReader returns a temporary error at the given offsets once each.
+type flakyReader struct {
+	data  []byte
+	off   int
+	fails map[int]bool
+}
+
+func (r *flakyReader) Read(p []byte) (int, error) {
+	if r.fails[r.off] {
+		delete(r.fails, r.off)
+		return 0, timeoutError{}
+	}
+	if r.off == len(r.data) {
+		return 0, io.EOF
+	}
+	n := copy(p[:1], r.data[r.off:])
+	r.off += n
+	return n, nil
+}
+
+func TestWithRetry(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		data     string
+		retry    int
+		fails    []int
+		buffered bool
+		want     [][]byte
+		err      bool
+	}{
+		{
+			pattern: "N/int,\r\n,V/bin:N",
+			data:    "3\r\nfoo",
+			retry:   2,
+			fails:   []int{0, 5},
+			want:    [][]byte{[]byte("3"), []byte("foo")},
+			err:     false,
+		},
+		{
+			pattern: "N/int,\r\n,V/bin:N",
+			data:    "3\r\nfoo",
+			retry:   1,
+			fails:   []int{0, 5},
+			want:    nil,
+			err:     true,
+		},
+		{
+			pattern: "N/int,\r\n,V/bin:N",
+			data:    "3\r\nfoo",
+			retry:   0,
+			fails:   []int{2},
+			want:    nil,
+			err:     true,
+		},
+		{
+			pattern:  "?OK:,V/bin,;,W/bin:1",
+			data:     "OK:foo;x",
+			retry:    2,
+			fails:    []int{0, 4},
+			buffered: true,
+			want:     [][]byte{[]byte("1"), []byte("foo"), []byte("x")},
+			err:      false,
+		},
+	}
+	for _, test := range tests {
+		fr := &flakyReader{data: []byte(test.data), fails: make(map[int]bool)}
+		for _, off := range test.fails {
+			fr.fails[off] = true
+		}
+		var r io.Reader = fr
+		if test.buffered {
+			r = bufio.NewReader(fr)
+		}
+		matched, err := Match(test.pattern, r, WithRetry(test.retry))
+		if !cmpByteSliceSlice(matched, test.want) || (err != nil) != test.err {
+			t.Errorf("gtpm_test: got %q %+v, want %q error %v", matched, err, test.want, test.err)
+		}
+	}
+}
+
+func TestRawCause(t *testing.T) {
+	tests := []struct {
+		pattern string
+		r       io.Reader
+		want    error
+	}{
+		{
+			pattern: "N/int,\r\n,_:N",
+			r:       bytes.NewReader([]byte("4\r\nbe")),
+			want:    io.EOF,
+		},
+		{
+			pattern: "N/int,\r\n,_:N",
+			r:       &errReader{data: []byte("4\r\nbe"), err: timeoutError{}},
+			want:    timeoutError{},
+		},
+		{
+			pattern: "foo",
+			r:       bytes.NewReader([]byte("bar")),
+			want:    nil,
+		},
+	}
+	for _, test := range tests {
+		m, err := Compile(test.pattern)
+		if err != nil {
+			t.Fatalf("gtpm_test: got %+v, want nil", err)
+		}
+		_, err = m.MatchReader(test.r)
+		if err == nil {
+			t.Fatalf("gtpm_test: got nil, want an error")
+		}
+		got := RawCause(fmt.Errorf("wrapped: %w", err))
+		if got != test.want {
+			t.Errorf("gtpm_test: got %+v, want %+v", got, test.want)
+		}
+		var ne net.Error
+		if test.want == (timeoutError{}) && (!errors.As(err, &ne) || !ne.Timeout()) {
+			t.Errorf("gtpm_test: got %+v, want a net.Error with timeout", err)
+		}
+	}
+}
+
+func TestWithBinaryIntFallback(t *testing.T) {
+	tests := []struct {
+		read []byte
+		want [][]byte
+		err  error
+	}{
+		{
+			read: []byte("03abc"),
+			want: [][]byte{
+				[]byte("03"),
+				[]byte("abc"),
+			},
+			err: nil,
+		},
+		{
+			read: []byte("\x00\x03abc"),
+			want: [][]byte{
+				[]byte("\x00\x03"),
+				[]byte("abc"),
+			},
+			err: nil,
+		},
+	}
+	m, err := Compile("N/int:2,V/bin:N", WithBinaryIntFallback())
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	for _, test := range tests {
+		matched, err := m.MatchReader(bytes.NewReader(test.read))
+		if !cmpByteSliceSlice(matched, test.want) || err != test.err {
+			t.Errorf("gtpm_test: got %#v %+v, want %#v %+v", matched, err, test.want, test.err)
+		}
+	}
+	m, _ = Compile("N/int:2,V/bin:N")
+	if _, err := m.MatchReader(bytes.NewReader([]byte("\x00\x03abc"))); err == nil {
+		t.Errorf("gtpm_test: got nil, want an error without the option")
+	}
+}
+
+type recordHandler struct {
+	level   slog.Level
+	records []slog.Record
+}
+
+func (h *recordHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *recordHandler) Handle(_ context.Context, r slog.Record) error {
+	h.records = append(h.records, r)
+	return nil
+}
+
+func (h *recordHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *recordHandler) WithGroup(string) slog.Handler      { return h }
+
+func TestWithLogger(t *testing.T) {
+	h := &recordHandler{level: slog.LevelDebug}
+	m, err := Compile("V/bin,\r\n,N/int:2,v2/bin:N,\r\n", WithLogger(slog.New(h)))
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	if _, err := m.MatchReader(bytes.NewReader([]byte("foo\r\n03bar\r\n"))); err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	if len(h.records) != 4 {
+		t.Fatalf("gtpm_test: got %d records, want 4", len(h.records))
+	}
+	var consumed int64
+	h.records[2].Attrs(func(a slog.Attr) bool {
+		if a.Key == "bytes" {
+			consumed = a.Value.Int64()
+		}
+		return true
+	})
+	if consumed != 3 {
+		t.Errorf("gtpm_test: got %d bytes, want 3", consumed)
+	}
+
+	h = &recordHandler{level: slog.LevelInfo}
+	m, _ = Compile("foo", WithLogger(slog.New(h)))
+	m.MatchReader(bytes.NewReader([]byte("foo")))
+	if len(h.records) != 0 {
+		t.Errorf("gtpm_test: got %d records, want 0", len(h.records))
+	}
+}
+
+func TestMatchReaderInts(t *testing.T) {
+	m, err := Compile("Count/rep{,V/int,;,},\r\n,Sum/int,\r\n")
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	matched, ints, err := m.(*TextPatternMatcher).MatchReaderInts(bytes.NewReader([]byte("1;22;333;4444;\r\n4800\r\n")))
+	if err != nil || len(matched) != 6 {
+		t.Fatalf("gtpm_test: got %#v %+v, want 6 captures nil", matched, err)
+	}
+	want := map[string][]int{"V": {1, 22, 333, 4444}, "Sum": {4800}}
+	if fmt.Sprint(ints) != fmt.Sprint(want) {
+		t.Errorf("gtpm_test: got %v, want %v", ints, want)
+	}
+	if _, ints, err = m.(*TextPatternMatcher).MatchReaderInts(bytes.NewReader([]byte("1;x;\r\n"))); ints != nil || err == nil {
+		t.Errorf("gtpm_test: got %v %+v, want nil error", ints, err)
+	}
+}
+
+func TestMatchReaderFloats(t *testing.T) {
+	tests := []struct {
+		pattern string
+		read    []byte
+		want    float64
+	}{
+		{
+			pattern: "V/f32be",
+			read:    []byte{0x3f, 0x80, 0x00, 0x00},
+			want:    1,
+		},
+		{
+			pattern: "V/f32le",
+			read:    []byte{0x00, 0x00, 0xc0, 0xbf},
+			want:    -1.5,
+		},
+		{
+			pattern: "V/f64be",
+			read:    []byte{0x40, 0x09, 0x21, 0xfb, 0x54, 0x44, 0x2d, 0x18},
+			want:    3.141592653589793,
+		},
+		{
+			pattern: "V/f64le",
+			read:    []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x24, 0x40},
+			want:    10,
+		},
+	}
+	for _, test := range tests {
+		m, err := Compile(test.pattern)
+		if err != nil {
+			t.Fatalf("gtpm_test: got %+v, want nil", err)
+		}
+		matched, floats, err := m.(*TextPatternMatcher).MatchReaderFloats(bytes.NewReader(test.read))
+		if !cmpByteSliceSlice(matched, [][]byte{test.read}) || err != nil {
+			t.Errorf("gtpm_test: got %#v %+v, want %#v nil", matched, err, [][]byte{test.read})
+		}
+		if len(floats["V"]) != 1 || floats["V"][0] != test.want {
+			t.Errorf("gtpm_test: %s got %v, want %v", test.pattern, floats["V"], test.want)
+		}
+	}
+	_, err := Match("V/f64le", bytes.NewReader([]byte{0x00, 0x00}))
+	if want := (Error{Code: ErrFloatVarNotMuch, Pos: 1, Cause: io.EOF}); err != want {
+		t.Errorf("gtpm_test: got %+v, want %+v", err, want)
+	}
+}
+
+func TestMatchReaderLineEndings(t *testing.T) {
+	m, err := Compile("Level/bin, ,Msg/line")
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	tests := []struct {
+		read   string
+		want   [][]byte
+		ending string
+	}{
+		{
+			read:   "INFO started\n",
+			want:   [][]byte{[]byte("INFO"), []byte("started")},
+			ending: "\n",
+		},
+		{
+			read:   "WARN disk full\r\n",
+			want:   [][]byte{[]byte("WARN"), []byte("disk full")},
+			ending: "\r\n",
+		},
+		{
+			read:   "DEBUG \n",
+			want:   [][]byte{[]byte("DEBUG"), []byte("")},
+			ending: "\n",
+		},
+	}
+	for _, test := range tests {
+		matched, endings, err := m.(*TextPatternMatcher).MatchReaderLineEndings(bytes.NewReader([]byte(test.read)))
+		if !cmpByteSliceSlice(matched, test.want) || err != nil {
+			t.Errorf("gtpm_test: got %#v %+v, want %#v nil", matched, err, test.want)
+		}
+		if len(endings["Msg"]) != 1 || endings["Msg"][0] != test.ending {
+			t.Errorf("gtpm_test: got %q, want %q", endings["Msg"], test.ending)
+		}
+	}
+}
+
+func TestMatchReaderRest(t *testing.T) {
+	m1, _ := Compile("(abcd|ab)")
+	m2, _ := Compile("N/int,\r\n")
+	matched, rest, err := m1.(*TextPatternMatcher).MatchReaderRest(bytes.NewReader([]byte("ab12\r\n")))
+	if !cmpByteSliceSlice(matched, [][]byte{[]byte("1")}) || err != nil {
+		t.Fatalf("gtpm_test: got %#v %+v, want [1] nil", matched, err)
+	}
+	matched, err = m2.MatchReader(rest)
+	if !cmpByteSliceSlice(matched, [][]byte{[]byte("12")}) || err != nil {
+		t.Errorf("gtpm_test: got %#v %+v, want [12] nil", matched, err)
+	}
+
+	r := bytes.NewReader([]byte("ab\r\nfoo"))
+	_, rest, err = m2.(*TextPatternMatcher).MatchReaderRest(r)
+	if rest != io.Reader(r) {
+		t.Errorf("gtpm_test: got %#v %+v, want the reader as is", rest, err)
+	}
+}
+
+func BenchmarkGrowthFactor(b *testing.B) {
+	read := append(bytes.Repeat([]byte("a"), 3000), "\r\n"...)
+	for _, factor := range []float64{2, 1.5} {
+		b.Run(fmt.Sprintf("%gx", factor), func(b *testing.B) {
+			m, _ := Compile("V/bin,\r\n", WithGrowthFactor(factor))
+			b.ReportAllocs()
+			var peak int
+			for i := 0; i < b.N; i++ {
+				matched, err := m.MatchReader(bytes.NewReader(read))
+				if err != nil {
+					b.Fatal(err)
+				}
+				peak = cap(matched[0])
+			}
+			b.ReportMetric(float64(peak), "peak-B")
+		})
+	}
+}
+
+func BenchmarkSingleByteSuffix(b *testing.B) {
+	read := append(bytes.Repeat([]byte("a"), 1<<20), '\n')
+	m, _ := Compile("V/bin,\n", WithMaxVariableSize(2<<20))
+	b.Run("bytes.Reader", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := m.MatchReader(bytes.NewReader(read)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("bufio.Reader", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := m.MatchReader(bufio.NewReader(bytes.NewReader(read))); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestWithCaptureFrame(t *testing.T) {
+	m, err := Compile("(abcd|ab),N/int,\r\n,V/bin:N", WithCaptureFrame())
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	read := []byte("ab3\r\nfoobar")
+	if _, err := m.MatchReader(bytes.NewReader(read)); err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	if frame := m.(*TextPatternMatcher).LastFrame(); !bytes.Equal(frame, read[:8]) {
+		t.Errorf("gtpm_test: got %q, want %q", frame, read[:8])
+	}
+	if _, err := m.MatchReader(bytes.NewReader([]byte("ab3\r\nfo"))); err == nil {
+		t.Fatalf("gtpm_test: got nil, want an error")
+	}
+	if frame := m.(*TextPatternMatcher).LastFrame(); !bytes.Equal(frame, read[:8]) {
+		t.Errorf("gtpm_test: got %q, want %q", frame, read[:8])
+	}
+}
+
+func TestWithNilEmptyCaptures(t *testing.T) {
+	tests := []struct {
+		opts []Option
+		want bool
+	}{
+		{
+			opts: nil,
+			want: false,
+		},
+		{
+			opts: []Option{WithNilEmptyCaptures()},
+			want: true,
+		},
+		{
+			opts: []Option{WithNilEmptyCaptures(), WithPackedCaptures()},
+			want: true,
+		},
+	}
+	for _, test := range tests {
+		m, err := Compile("K/bin,=,V/bin,\r\n", test.opts...)
+		if err != nil {
+			t.Fatalf("gtpm_test: got %+v, want nil", err)
+		}
+		matched, err := m.MatchReader(bytes.NewReader([]byte("foo=\r\n")))
+		if err != nil || len(matched) != 2 {
+			t.Fatalf("gtpm_test: got %#v %+v, want 2 captures nil", matched, err)
+		}
+		if got := matched[1] == nil; got != test.want || len(matched[1]) != 0 {
+			t.Errorf("gtpm_test: got %#v, want nil %v", matched[1], test.want)
+		}
+	}
+}
+
+func TestWithCanonicalizeCaptures(t *testing.T) {
+	const pattern = "Text/bin,\x00,Bin/bin:4,Line/line"
+	read := []byte("a\r\nb\nc\r\n\x00\r\n\r\nd\r\r\n")
+	tests := []struct {
+		opts []Option
+		want [][]byte
+	}{
+		{
+			opts: nil,
+			want: [][]byte{[]byte("a\r\nb\nc\r\n"), []byte("\r\n\r\n"), []byte("d\r")},
+		},
+		{
+			opts: []Option{WithCanonicalizeCaptures()},
+			want: [][]byte{[]byte("a\nb\nc\n"), []byte("\r\n\r\n"), []byte("d\r")},
+		},
+	}
+	for _, test := range tests {
+		matched, err := Match(pattern, bytes.NewReader(read), test.opts...)
+		if !cmpByteSliceSlice(matched, test.want) || err != nil {
+			t.Errorf("gtpm_test: got %q %+v, want %q nil", matched, err, test.want)
+		}
+	}
+}
+
+func TestWithZeroCopyCaptures(t *testing.T) {
+	tests := []struct {
+		pattern string
+		read    []byte
+	}{
+		{
+			pattern: "N/int,\r\n,V/bin:N,K/bin,=,W/bin,\r\n",
+			read:    []byte("3\r\nfookey=value\r\n"),
+		},
+		{
+			pattern: "Cmd/bin, ,Arg/netstring,Line/line",
+			read:    []byte("SET 5:hello,abc\r\n"),
+		},
+		{
+			pattern: "Delim/bin:2,V/bin:@Delim,\r\n",
+			read:    []byte("--0123456789abcdef0123456789--\r\n"),
+		},
+	}
+	for _, test := range tests {
+		want, err := Match(test.pattern, bytes.NewReader(test.read))
+		if err != nil {
+			t.Fatalf("gtpm_test: got %+v, want nil", err)
+		}
+		m, _ := Compile(test.pattern, WithZeroCopyCaptures())
+		got, err := m.(*TextPatternMatcher).MatchBytes(test.read)
+		if !cmpByteSliceSlice(got, want) || err != nil {
+			t.Errorf("gtpm_test: got %q %+v, want %q nil", got, err, want)
+		}
+		begin := uintptr(unsafe.Pointer(&test.read[0]))
+		for _, c := range got {
+			if len(c) == 0 {
+				continue
+			}
+			if p := uintptr(unsafe.Pointer(&c[0])); p < begin || p >= begin+uintptr(len(test.read)) {
+				t.Errorf("gtpm_test: got %q not sharing the input, want a subslice", c)
+			}
+		}
+	}
+}
+
+func TestWithZeroCopyCapturesPairs(t *testing.T) {
+	for _, read := range []string{"", "a=1&bb=22"} {
+		want, werr := Match("V/kv:=&", bytes.NewReader([]byte(read)))
+		m, err := Compile("V/kv:=&", WithZeroCopyCaptures())
+		if err != nil {
+			t.Fatalf("gtpm_test: got %+v, want nil", err)
+		}
+		got, gerr := m.(*TextPatternMatcher).MatchBytes([]byte(read))
+		if !cmpByteSliceSlice(got, want) || gerr != werr {
+			t.Errorf("gtpm_test: %q got %q %+v, want %q %+v", read, got, gerr, want, werr)
+		}
+	}
+}
+func BenchmarkZeroCopyCaptures(b *testing.B) {
+	const pattern = "A/bin:2,B/bin:2,C/bin:2,D/bin:2,E/bin:2,F/bin,;,G/bin,;,H/bin,;,I/bin,;,J/bin,;"
+	read := []byte("aabbccddeeff;gg;hh;ii;jj;")
+	for _, tt := range []struct {
+		name string
+		opts []Option
+	}{
+		{"default", nil},
+		{"zero-copy", []Option{WithZeroCopyCaptures()}},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			m, _ := Compile(pattern, tt.opts...)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := m.(*TextPatternMatcher).MatchBytes(read); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestAcquire(t *testing.T) {
+	m, err := Compile("N/int,\r\n,V/bin:N,;", WithPackedCaptures())
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	tpm := m.(*TextPatternMatcher)
+	ms := tpm.Acquire()
+	for _, tt := range []struct {
+		read string
+		want [][]byte
+		err  error
+	}{
+		{"3\r\nfoo;", [][]byte{[]byte("3"), []byte("foo")}, nil},
+		{"5\r\nhello;", [][]byte{[]byte("5"), []byte("hello")}, nil},
+		{"5\r\nhi;", nil, Error{Code: ErrVarNotMuch, Pos: 10, Cause: io.EOF}},
+		{"2\r\nhi;", [][]byte{[]byte("2"), []byte("hi")}, nil},
+	} {
+		matched, err := ms.MatchReader(strings.NewReader(tt.read))
+		if !cmpByteSliceSlice(matched, tt.want) || err != tt.err {
+			t.Errorf("gtpm_test: got %q %+v, want %q %+v", matched, err, tt.want, tt.err)
+		}
+	}
+	tpm.Release(ms)
+	other, err := Compile("V/bin:2")
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	// a MatchState of another matcher is never pooled
+	other.(*TextPatternMatcher).Release(tpm.Acquire())
+	if ms := other.(*TextPatternMatcher).Acquire(); ms.tpm != other {
+		t.Errorf("gtpm_test: got %p, want %p", ms.tpm, other)
+	}
+}
+
+func BenchmarkAcquire(b *testing.B) {
+	const pattern = "N/int,\r\n,V/bin:N,\r\n,A/bin,;,B/bin,;,C/bin,;"
+	read := []byte("3\r\nfoo\r\naa;bb;cc;")
+	m, _ := Compile(pattern, WithPackedCaptures())
+	tpm := m.(*TextPatternMatcher)
+	b.Run("default", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := tpm.MatchReader(bytes.NewReader(read)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("pool", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			ms := tpm.Acquire()
+			if _, err := ms.MatchReader(bytes.NewReader(read)); err != nil {
+				b.Fatal(err)
+			}
+			tpm.Release(ms)
+		}
+	})
+}
+
+func TestMatchBytes(t *testing.T) {
+	tests := []struct {
+		pattern string
+		reads   []string
+	}{
+		{"GET ,Path/bin, ,HTTP\r\n", []string{"GET /a HTTP\r\n", "GET /a HTTP\r\nnext", "PUT /a HTTP\r\n", "GET /a HT", "GET /a", ""}},
+		{"V/bin,;;,W/bin:2", []string{"abc;;de", ";;de", "01234567890123;;de", "012345678901234;;de", "0123456789", "0123456789012345678901234567890123456789", "abc;"}},
+		{"_,;,V/bin:2,?!,W/bin,\r\n", []string{"skip;ab!c\r\n", "skip;abc\r\n", "skip;ab", "skip"}},
+		{"N/int,:,V/bin:N,K/line", []string{"3:fooline\r\n", "3:fo", "x:foo"}},
+	}
+	for _, tt := range tests {
+		m, err := Compile(tt.pattern, WithMaxVariableSize(20), WithByteCounter())
+		if err != nil {
+			t.Fatalf("gtpm_test: got %+v, want nil", err)
+		}
+		for _, read := range tt.reads {
+			want, wantErr := m.MatchReader(bytes.NewReader([]byte(read)))
+			wantConsumed := m.(*TextPatternMatcher).Consumed()
+			got, gotErr := m.MatchBytes([]byte(read))
+			if !cmpByteSliceSlice(got, want) || !reflect.DeepEqual(gotErr, wantErr) {
+				t.Errorf("gtpm_test: %q got %q %+v, want %q %+v", read, got, gotErr, want, wantErr)
+			}
+			if got := m.(*TextPatternMatcher).Consumed(); got != wantConsumed {
+				t.Errorf("gtpm_test: %q got %d, want %d", read, got, wantConsumed)
+			}
+		}
+	}
+}
+
+func TestGenInstVarEqual(t *testing.T) {
+	tests := []struct {
+		read string
+		want [][]byte
+		err  error
+	}{
+		{"12;body;12", [][]byte{[]byte("12"), []byte("body"), []byte("12")}, nil},
+		{";body;", [][]byte{[]byte(""), []byte("body"), []byte("")}, nil},
+		{"12;body;13", nil, Error{Code: ErrorCode(fmt.Sprintf(ErrVarNotEqual, "Len")), Pos: 22}},
+		{"12;body;1", nil, Error{Code: ErrVarNotMuch, Pos: 22, Cause: io.EOF}},
+	}
+	m, err := Compile("Len/bin,;,Body/bin,;,Echo/bin:=Len")
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	for _, tt := range tests {
+		matched, err := m.MatchReader(strings.NewReader(tt.read))
+		if !cmpByteSliceSlice(matched, tt.want) || err != tt.err {
+			t.Errorf("gtpm_test: %q got %q %+v, want %q %+v", tt.read, matched, err, tt.want, tt.err)
+		}
+	}
+	for _, tt := range []struct {
+		pattern string
+		read    string
+		pos     int
+	}{
+		{"?V2:{,A/bin:2,},B/bin:=A", "xx", 17},
+		{"N/rep{,A/bin:2,},;,B/bin:=A", ";xx", 20},
+	} {
+		m, err := Compile(tt.pattern)
+		if err != nil {
+			t.Fatalf("gtpm_test: got %+v, want nil", err)
+		}
+		want := Error{Code: ErrorCode(fmt.Sprintf(ErrVarNotBound, "A")), Pos: tt.pos}
+		if _, err := m.MatchReader(strings.NewReader(tt.read)); err != want {
+			t.Errorf("gtpm_test: %s got %+v, want %+v", tt.pattern, err, want)
+		}
+	}
+	if _, err := Compile("Echo/bin:=Len"); err != (Error{Code: ErrorCode(fmt.Sprintf(ErrParseVariableNotDefined, "Len")), Pos: 1}) {
+		t.Errorf("gtpm_test: got %+v, want %s", err, fmt.Sprintf(ErrParseVariableNotDefined, "Len"))
+	}
+}
+
+func TestGenerateSample(t *testing.T) {
+	for _, pattern := range []string{
+		"GET ,Path/bin, ,Version/bin,\r\n,N/int,\r\n,Body/bin:N",
+		"V/bin:4,_:2,=/int:42,(GET|PUT),?x,L/line",
+		"Count/rep{,K/bin,=,V/bin,;,},\r\n,T/hex:2",
+		"N/u16be,Items/bin:2{N},Q/kv:=&,\r\n",
+		"S/bin,00,T/bin:2,_,0123,R/run:20",
+		"Last/bin?,;",
+	} {
+		m, err := Compile(pattern)
+		if err != nil {
+			t.Fatalf("gtpm_test: got %+v, want nil", err)
+		}
+		sample, err := m.(*TextPatternMatcher).GenerateSample()
+		if err != nil {
+			t.Fatalf("gtpm_test: %s got %+v, want nil", pattern, err)
+		}
+		if _, err := m.MatchBytes(sample); err != nil {
+			t.Errorf("gtpm_test: %s %q got %+v, want nil", pattern, sample, err)
+		}
+	}
+	m, err := Compile("A,S/netstring")
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	var e Error
+	if _, err := m.(*TextPatternMatcher).GenerateSample(); !errors.As(err, &e) || e.Code != ErrNoSample || e.Pos != 3 {
+		t.Errorf("gtpm_test: got %+v, want %s at 3", err, ErrNoSample)
+	}
+}
+
+func TestMatchReaderNamed(t *testing.T) {
+	tests := []struct {
+		pattern string
+		read    string
+		want    map[string][]byte
+		err     error
+	}{
+		{"N/int,\r\n,V/bin:N,_,;,Number/int:2", "3\r\nfooskip;42", map[string][]byte{"N": []byte("3"), "V": []byte("foo"), "Number": []byte("42")}, nil},
+		{"Count/rep{,K/bin,;,},\r\n", "a;b;\r\n", map[string][]byte{"K": []byte("b")}, nil},
+		{"(GET|PUT), ,V/bin:2", "PUT ab", map[string][]byte{"V": []byte("ab")}, nil},
+		{"V/bin:2", "a", nil, Error{Code: ErrVarNotMuch, Pos: 1, Cause: io.EOF}},
+	}
+	for _, tt := range tests {
+		m, err := Compile(tt.pattern)
+		if err != nil {
+			t.Fatalf("gtpm_test: got %+v, want nil", err)
+		}
+		named, err := m.(*TextPatternMatcher).MatchReaderNamed(strings.NewReader(tt.read))
+		if !reflect.DeepEqual(named, tt.want) || err != tt.err {
+			t.Errorf("gtpm_test: got %q %+v, want %q %+v", named, err, tt.want, tt.err)
+		}
+	}
+}
+
+// endlessReader reads 'a' forever calling cancel once n bytes are read.
+type endlessReader struct {
+	n      int
+	cancel context.CancelFunc
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'a'
+	}
+	if r.n -= len(p); r.n <= 0 && r.cancel != nil {
+		r.cancel()
+	}
+	return len(p), nil
+}
+
+func TestMatchReaderContext(t *testing.T) {
+	m, err := Compile("a,V/bin,;", WithMaxVariableSize(math.MaxInt32))
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	tpm := m.(*TextPatternMatcher)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := tpm.MatchReaderContext(ctx, strings.NewReader("abc;")); err != (Error{Code: ErrCanceled, Pos: 1, Cause: context.Canceled}) {
+		t.Errorf("gtpm_test: got %+v, want %s caused by %v", err, ErrCanceled, context.Canceled)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := tpm.MatchReaderContext(ctx, &endlessReader{n: 1 << 16, cancel: cancel}); err != (Error{Code: ErrCanceled, Pos: 9, Cause: context.Canceled}) {
+		t.Errorf("gtpm_test: got %+v, want %s caused by %v", err, ErrCanceled, context.Canceled)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := tpm.MatchReaderContext(ctx, &endlessReader{}); err != (Error{Code: ErrCanceled, Pos: 9, Cause: context.DeadlineExceeded}) {
+		t.Errorf("gtpm_test: got %+v, want %s caused by %v", err, ErrCanceled, context.DeadlineExceeded)
+	}
+
+	matched, err := tpm.MatchReaderContext(context.Background(), strings.NewReader("abc;"))
+	if want := [][]byte{[]byte("bc")}; !cmpByteSliceSlice(matched, want) || err != nil {
+		t.Errorf("gtpm_test: got %q %+v, want %q nil", matched, err, want)
+	}
+}
+
+func TestGenInstIf(t *testing.T) {
+	tests := []struct {
+		pattern string
+		read    string
+		want    [][]byte
+		err     error
+	}{
+		{"?GTV2{,Ver/bin:1,;,Len/int,\r\n,Body/bin:Len,}|{,Body/bin,\r\n,},END", "GTV27;3\r\nabcEND", [][]byte{[]byte("1"), []byte("7"), []byte("3"), []byte("abc")}, nil},
+		{"?GTV2{,Ver/bin:1,;,Len/int,\r\n,Body/bin:Len,}|{,Body/bin,\r\n,},END", "hello\r\nEND", [][]byte{[]byte("0"), []byte("hello")}, nil},
+		{"?GTV2{,Ver/bin:1,;,Len/int,\r\n,Body/bin:Len,}|{,Body/bin,\r\n,},END", "GTV27;3\r\nabEND", nil, Error{Code: ErrConstNotMuch, Pos: 62, Cause: io.EOF}},
+		{"?X:{,V/bin:2,},T/bin:1", "X:abc", [][]byte{[]byte("1"), []byte("ab"), []byte("c")}, nil},
+		{"?X:{,V/bin:2,},T/bin:1", "c", [][]byte{[]byte("0"), []byte("c")}, nil},
+		{"?X:{,},T/bin:1", "X:c", [][]byte{[]byte("1"), []byte("c")}, nil},
+		{"?X:{,A,},B", "X:AB", [][]byte{[]byte("1")}, nil},
+		{"?X:{,A,},B", "B", [][]byte{[]byte("0")}, nil},
+		{"N/rep{,?+{,S/bin:1,},K/bin:1,;,},\r\n", "+ab;c;\r\n", [][]byte{[]byte("1"), []byte("a"), []byte("b"), []byte("0"), []byte("c"), []byte("2")}, nil},
+	}
+	for _, tt := range tests {
+		m, err := Compile(tt.pattern)
+		if err != nil {
+			t.Fatalf("gtpm_test: got %+v, want nil", err)
+		}
+		matched, err := m.MatchReader(strings.NewReader(tt.read))
+		if !cmpByteSliceSlice(matched, tt.want) || err != tt.err {
+			t.Errorf("gtpm_test: %q got %q %+v, want %q %+v", tt.read, matched, err, tt.want, tt.err)
+		}
+		if _, err := m.(*TextPatternMatcher).GenerateSample(); err != nil {
+			t.Errorf("gtpm_test: got %+v, want nil", err)
+		}
+	}
+	for _, pattern := range []string{"?X{,V/bin:1", "?X{,A,}|{,B", "?X{,A,}|{,B,}|{,C,}"} {
+		if _, err := Compile(pattern); !errors.As(err, new(Error)) || err.(Error).Code != ErrParseBraceExpected {
+			t.Errorf("gtpm_test: %s got %+v, want %s", pattern, err, ErrParseBraceExpected)
+		}
+	}
+}
+
+func TestMatchString(t *testing.T) {
+	tests := []struct {
+		pattern string
+		opts    []Option
+		reads   []string
+	}{
+		{"N/int,\r\n", nil, []string{"42\r\n", "42", ""}},
+		{"V/bin:2", []Option{WithZeroCopyCaptures()}, []string{"ab", "a", ""}},
+		{"?x,V/bin,;", []Option{WithEOFOnEmpty()}, []string{"xab;", "ab;", ""}},
+		{"_:0", nil, []string{""}},
+	}
+	for _, tt := range tests {
+		m, err := Compile(tt.pattern, tt.opts...)
+		if err != nil {
+			t.Fatalf("gtpm_test: got %+v, want nil", err)
+		}
+		for _, read := range tt.reads {
+			want, wantErr := m.MatchReader(strings.NewReader(read))
+			got, gotErr := m.(*TextPatternMatcher).MatchString(read)
+			if !cmpByteSliceSlice(got, want) || !reflect.DeepEqual(gotErr, wantErr) {
+				t.Errorf("gtpm_test: %q got %q %+v, want %q %+v", read, got, gotErr, want, wantErr)
+			}
+		}
+	}
+}
+
+func BenchmarkMatchBytes(b *testing.B) {
+	const pattern = "GET ,Path/bin, ,Version/bin,\r\n,Host: ,Host/bin,\r\n,Agent/bin,\r\n\r\n"
+	read := []byte("GET /index.html HTTP/1.1\r\nHost: www.example.com\r\nUser-Agent: Mozilla/5.0 (X11; Linux x86_64)\r\n\r\n")
+	m, _ := Compile(pattern)
+	b.Run("reader", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := m.MatchReader(bytes.NewReader(read)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("bytes", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := m.MatchBytes(read); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestWithByteCounter(t *testing.T) {
+	m, err := Compile("N/int,\r\n,V/bin:N,\r\n", WithByteCounter())
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	tests := []struct {
+		read []byte
+		want int
+		err  bool
+	}{
+		{
+			read: []byte("3\r\nfoo\r\nbar"),
+			want: 8,
+			err:  false,
+		},
+		{
+			read: []byte("3\r\nfo"),
+			want: 5,
+			err:  true,
+		},
+		{
+			read: []byte("3\r\nfoo;;"),
+			want: 8,
+			err:  true,
+		},
+	}
+	for _, test := range tests {
+		_, err := m.MatchReader(bytes.NewReader(test.read))
+		if (err != nil) != test.err {
+			t.Errorf("gtpm_test: got %+v, want error %v", err, test.err)
+		}
+		if got := m.(*TextPatternMatcher).Consumed(); got != test.want {
+			t.Errorf("gtpm_test: got %d, want %d", got, test.want)
+		}
+	}
+}
+
+func TestResync(t *testing.T) {
+	m, err := Compile("$,N/int,:,V/bin:N,\n", WithResyncWindow(4))
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	tests := []struct {
+		read []byte
+		want [][]byte
+		off  int64
+		err  error
+	}{
+		{
+			read: []byte("$3:foo\nbar"),
+			want: [][]byte{[]byte("3"), []byte("foo")},
+			off:  0,
+			err:  nil,
+		},
+		{
+			read: []byte("\x00x$$3:foo\nbar"),
+			want: [][]byte{[]byte("3"), []byte("foo")},
+			off:  3,
+			err:  nil,
+		},
+		{
+			read: []byte("junk!$3:foo\n"),
+			want: nil,
+			off:  0,
+			err:  Error{Code: ErrorCode(fmt.Sprintf(ErrResyncWindow, 4)), Cause: Error{Code: ErrConstNotMuch, Pos: 1}},
+		},
+	}
+	for _, test := range tests {
+		r := bytes.NewReader(test.read)
+		matched, off, err := m.(*TextPatternMatcher).Resync(r)
+		if !cmpByteSliceSlice(matched, test.want) || off != test.off || !checkError(err, test.err) {
+			t.Errorf("gtpm_test: got %#v %d %+v, want %#v %d %+v", matched, off, err, test.want, test.off, test.err)
+		}
+		if err != nil {
+			continue
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != "bar" {
+			t.Errorf("gtpm_test: got %q, want %q", rest, "bar")
+		}
+	}
+}
+
+func TestMatchReaderFunc(t *testing.T) {
+	m, _ := Compile("K/bin,=,V/bin,;,W/bin,\r\n")
+	var total int
+	var names []string
+	err := m.(*TextPatternMatcher).MatchReaderFunc(bytes.NewReader([]byte("foo=ba;z\r\n")), func(index int, name string, b []byte) error {
+		total += len(b)
+		names = append(names, fmt.Sprintf("%d:%s", index, name))
+		return nil
+	})
+	if err != nil || total != 6 {
+		t.Errorf("gtpm_test: got %d %+v, want 6 nil", total, err)
+	}
+	if want := []string{"0:K", "1:V", "2:W"}; fmt.Sprint(names) != fmt.Sprint(want) {
+		t.Errorf("gtpm_test: got %v, want %v", names, want)
+	}
+
+	stop := errors.New("stop")
+	var calls int
+	err = m.(*TextPatternMatcher).MatchReaderFunc(bytes.NewReader([]byte("foo=ba;z\r\n")), func(index int, name string, b []byte) error {
+		calls++
+		if name == "V" {
+			return stop
+		}
+		return nil
+	})
+	if want := (Error{Code: ErrCaptureCallback, Pos: 15, Cause: stop}); !checkError(err, want) || calls != 2 {
+		t.Errorf("gtpm_test: got %+v %d, want %+v 2", err, calls, want)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	m, err := Compile("HELLO ,Len/int:2,_:1,Name/bin,\r\n,V/f32le,Body/bin:Len")
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	want := []FieldSpec{
+		{Kind: "const", FixedSize: 6},
+		{Name: "Len", Kind: "int", FixedSize: 2},
+		{Kind: "blind", FixedSize: 1},
+		{Name: "Name", Kind: "bin", Suffix: []byte("\r\n")},
+		{Name: "V", Kind: "float", FixedSize: 4},
+		{Name: "Body", Kind: "bin"},
+	}
+	if got := m.(*TextPatternMatcher).Schema(); fmt.Sprintf("%+v", got) != fmt.Sprintf("%+v", want) {
+		t.Errorf("gtpm_test: got %+v, want %+v", got, want)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	m, _ := Compile("N/int,\r\n,V/bin:N")
+	tpm := m.(*TextPatternMatcher)
+	cases := []CheckCase{
+		{In: []byte("3\r\nfoo"), Want: [][]byte{[]byte("3"), []byte("foo")}},
+		{In: []byte("0\r\n"), Want: [][]byte{[]byte("0"), {}}},
+		{In: []byte("3\r\nfo"), Err: io.EOF},
+	}
+	if err := tpm.Check(cases); err != nil {
+		t.Errorf("gtpm_test: got %+v, want nil", err)
+	}
+	cases = append(cases, CheckCase{In: []byte("3\r\nbar"), Want: [][]byte{[]byte("3"), []byte("baz")}})
+	want := Error{Code: ErrorCode(fmt.Sprintf(ErrCheckMismatch, 3, [][]byte{[]byte("3"), []byte("bar")}, nil, cases[3].Want, nil))}
+	if err := tpm.Check(cases); err != want {
+		t.Errorf("gtpm_test: got %+v, want %+v", err, want)
+	}
+}
+
+func TestMatchReaderResult(t *testing.T) {
+	m, err := Compile("(GET|PUT), ,Path/bin, ,Len/int,\r\n,Body/bin:Len,\r\n")
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	res, err := m.(*TextPatternMatcher).MatchReaderResult(bytes.NewReader([]byte("PUT /a 5\r\nhello\r\n")))
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	wantBytes := map[string][]byte{"Path": []byte("/a"), "Len": []byte("5"), "Body": []byte("hello")}
+	if fmt.Sprint(res.Bytes) != fmt.Sprint(wantBytes) {
+		t.Errorf("gtpm_test: got %q, want %q", res.Bytes, wantBytes)
+	}
+	wantInts := map[string]int{"Len": 5}
+	if fmt.Sprint(res.Ints) != fmt.Sprint(wantInts) {
+		t.Errorf("gtpm_test: got %v, want %v", res.Ints, wantInts)
+	}
+}
+
+func TestWithTrimPatternTrailingSpace(t *testing.T) {
+	const pattern = "V/bin,\r\n,OK\r\n \t"
+	read := []byte("foo\r\nOK\r\n")
+	tests := []struct {
+		opts []Option
+		want [][]byte
+		err  bool
+	}{
+		{
+			opts: nil,
+			want: nil,
+			err:  true,
+		},
+		{
+			opts: []Option{WithTrimPatternTrailingSpace()},
+			want: [][]byte{[]byte("foo")},
+			err:  false,
+		},
+	}
+	for _, test := range tests {
+		matched, err := Match(pattern, bytes.NewReader(read), test.opts...)
+		if !cmpByteSliceSlice(matched, test.want) || (err != nil) != test.err {
+			t.Errorf("gtpm_test: got %#v %+v, want %#v error %v", matched, err, test.want, test.err)
+		}
+	}
+}
+
+func TestWithOffsets(t *testing.T) {
+	tests := []struct {
+		pattern string
+		read    []byte
+		want    map[string][2]int
+	}{
+		{
+			pattern: "Cmd/bin, ,Arg/netstring,\r\n",
+			read:    []byte("SET 5:hello,\r\n"),
+			want:    map[string][2]int{"Cmd": {0, 3}, "Arg": {6, 11}},
+		},
+		{
+			pattern: "A/netstring",
+			read:    []byte("1:1,"),
+			want:    map[string][2]int{"A": {2, 3}},
+		},
+		{
+			pattern: "K/bin,=,V/hex:1",
+			read:    []byte("a=61"),
+			want:    map[string][2]int{"K": {0, 1}, "V": {2, 4}},
+		},
+	}
+	for _, test := range tests {
+		m, err := Compile(test.pattern, WithOffsets())
+		if err != nil {
+			t.Fatalf("gtpm_test: got %+v, want nil", err)
+		}
+		res, err := m.(*TextPatternMatcher).MatchReaderResult(bytes.NewReader(test.read))
+		if err != nil {
+			t.Fatalf("gtpm_test: got %+v, want nil", err)
+		}
+		if fmt.Sprint(res.Offsets) != fmt.Sprint(test.want) {
+			t.Errorf("gtpm_test: %q got %v, want %v", test.pattern, res.Offsets, test.want)
+		}
+	}
+}
+
+func TestWithStrictGrammar(t *testing.T) {
+	tests := []struct {
+		pattern string
+		err     error
+	}{
+		{
+			pattern: "Cmd/bin, ,Arg/bin,\r\n",
+			err:     nil,
+		},
+		{
+			pattern: "V/nz:4:20,\r\n",
+			err:     nil,
+		},
+		{
+			pattern: "V/bin,;,,\r\n",
+			err:     Error{Code: ErrorCode(fmt.Sprintf(ErrParseStrict, "empty token")), Pos: 9},
+		},
+		{
+			pattern: "V/bin,\r\n,OK \r\n",
+			err:     Error{Code: ErrorCode(fmt.Sprintf(ErrParseStrict, "white spaces around token")), Pos: 10},
+		},
+		{
+			pattern: "V/bin:4:2,\r\n",
+			err:     Error{Code: ErrorCode(fmt.Sprintf(ErrParseStrict, "multiple colons")), Pos: 1},
+		},
+		{
+			pattern: "V/bin,;,;END",
+			err:     Error{Code: ErrorCode(fmt.Sprintf(ErrParseStrict, "suffix followed by a const starting with it")), Pos: 9},
+		},
+	}
+	for _, test := range tests {
+		if _, err := Compile(test.pattern); err != nil {
+			t.Errorf("gtpm_test: got %+v, want nil for %q by default", err, test.pattern)
+		}
+		if _, err := Compile(test.pattern, WithStrictGrammar()); !checkError(err, test.err) {
+			t.Errorf("gtpm_test: got %+v, want %+v", err, test.err)
+		}
+	}
+}
+
+func TestWithExternalInts(t *testing.T) {
+	header, _ := Compile("Size/int,\r\n")
+	data, err := Compile("V/bin:Size,\r\n", WithExternalInts("Size"))
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	r := bytes.NewReader([]byte("3\r\nfoo\r\nbar\r\nbuz\r\n"))
+	_, ints, err := header.(*TextPatternMatcher).MatchReaderInts(r)
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	sc := NewScanner(r, data.(*TextPatternMatcher))
+	sc.SetInts(map[string]int{"Size": ints["Size"][0]})
+	var got [][]byte
+	for sc.Scan() {
+		got = append(got, sc.Record()...)
+	}
+	if want := [][]byte{[]byte("foo"), []byte("bar"), []byte("buz")}; !cmpByteSliceSlice(got, want) || sc.Err() != nil {
+		t.Errorf("gtpm_test: got %#v %+v, want %#v nil", got, sc.Err(), want)
+	}
+	matched, err := data.(*TextPatternMatcher).MatchReaderWithInts(bytes.NewReader([]byte("ab\r\n")), map[string]int{"Size": 2, "Other": 5})
+	if want := [][]byte{[]byte("ab")}; !cmpByteSliceSlice(matched, want) || err != nil {
+		t.Errorf("gtpm_test: got %#v %+v, want %#v nil", matched, err, want)
+	}
+}
+
+func TestMatchReaderSpill(t *testing.T) {
+	dir := t.TempDir()
+	m, err := Compile("N/int,\r\n,V/bin:N,T/bin:3", WithSpillToFile(1024, dir), WithSkipEmptyCaptures())
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	large := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	read := append(append([]byte(strconv.Itoa(len(large))+"\r\n"), large...), "end"...)
+	matched, spilled, err := m.(*TextPatternMatcher).MatchReaderSpill(bytes.NewReader(read))
+	if err != nil || len(matched) != 3 || len(matched[1]) != 0 || string(matched[2]) != "end" {
+		t.Fatalf("gtpm_test: got %d captures %+v, want 3 nil", len(matched), err)
+	}
+	if len(spilled) != 1 || filepath.Dir(spilled[1]) != dir {
+		t.Fatalf("gtpm_test: got %v, want a file in %s for 1", spilled, dir)
+	}
+	got, err := os.ReadFile(spilled[1])
+	if err != nil || !bytes.Equal(got, large) {
+		t.Errorf("gtpm_test: got %d bytes %+v, want %d bytes nil", len(got), err, len(large))
+	}
+	os.Remove(spilled[1])
+
+	read = append([]byte(strconv.Itoa(len(large))+"\r\n"), large[:2048]...)
+	if _, _, err := m.(*TextPatternMatcher).MatchReaderSpill(bytes.NewReader(read)); err == nil {
+		t.Errorf("gtpm_test: got nil, want an error")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("gtpm_test: got %d files left, want 0", len(entries))
+	}
+}
+
+func TestMatchAt(t *testing.T) {
+	m, _ := Compile("N/int,\r\n,V/bin:N")
+	name := filepath.Join(t.TempDir(), "records")
+	if err := os.WriteFile(name, []byte("3\r\nfoo5\r\nhello"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tests := []struct {
+		off  int64
+		want [][]byte
+	}{
+		{
+			off:  0,
+			want: [][]byte{[]byte("3"), []byte("foo")},
+		},
+		{
+			off:  6,
+			want: [][]byte{[]byte("5"), []byte("hello")},
+		},
+	}
+	var wg sync.WaitGroup
+	for _, test := range tests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				matched, err := m.(*TextPatternMatcher).MatchAt(f, test.off)
+				if !cmpByteSliceSlice(matched, test.want) || err != nil {
+					t.Errorf("gtpm_test: got %#v %+v, want %#v nil", matched, err, test.want)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	rest, _ := Compile("b/bin:rest-2,t/bin:2")
+	want := [][]byte{[]byte("5\r\nhel"), []byte("lo")}
+	for _, ra := range []io.ReaderAt{f, bytes.NewReader([]byte("3\r\nfoo5\r\nhello")), struct{ io.ReaderAt }{f}} {
+		matched, err := rest.(*TextPatternMatcher).MatchAt(ra, 6)
+		if !cmpByteSliceSlice(matched, want) || err != nil {
+			t.Errorf("gtpm_test: %T got %q %+v, want %q nil", ra, matched, err, want)
+		}
+	}
+}
+
+func TestWithConstAudit(t *testing.T) {
+	m, err := Compile("HELLO ,V/bin,\r\n,END", WithConstAudit())
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	matched, err := m.MatchReader(bytes.NewReader([]byte("HELLO world\r\nEND")))
+	if want := [][]byte{[]byte("world")}; !cmpByteSliceSlice(matched, want) || err != nil {
+		t.Fatalf("gtpm_test: got %#v %+v, want %#v nil", matched, err, want)
+	}
+	want := []ConstRecord{
+		{Pos: 1, Offset: 0, Bytes: []byte("HELLO ")},
+		{Pos: 17, Offset: 13, Bytes: []byte("END")},
+	}
+	if got := m.(*TextPatternMatcher).LastAudit(); fmt.Sprintf("%+v", got) != fmt.Sprintf("%+v", want) {
+		t.Errorf("gtpm_test: got %+v, want %+v", got, want)
+	}
+}
+
+func TestToRegexp(t *testing.T) {
+	tests := []struct {
+		pattern string
+		in      string
+	}{
+		{"GET ,path/bin, HTTP\r\n,_,\r\n,body/line", "GET /index.html HTTP\r\nHost example.com\r\nhello\r\n"},
+		{"a.b*,x/bin,(|),y/line", "a.b*1+2(|)\n"},
+		{"k=,v/bin?,;", "k=value"},
+	}
+	for _, tt := range tests {
+		m, err := Compile(tt.pattern)
+		if err != nil {
+			t.Fatalf("gtpm_test: got %+v, want nil", err)
+		}
+		expr, err := m.(*TextPatternMatcher).ToRegexp()
+		if err != nil {
+			t.Fatalf("gtpm_test: got %+v, want nil", err)
+		}
+		matched, err := m.MatchReader(strings.NewReader(tt.in))
+		if err != nil {
+			t.Fatalf("gtpm_test: got %+v, want nil", err)
+		}
+		sub := regexp.MustCompile(expr).FindStringSubmatch(tt.in)
+		if len(sub) != len(matched)+1 {
+			t.Fatalf("gtpm_test: got %q, want %q", sub, matched)
+		}
+		for i := range matched {
+			if string(matched[i]) != sub[i+1] {
+				t.Errorf("gtpm_test: got %q, want %q", sub[i+1], matched[i])
+			}
+		}
+	}
+	errs := []struct {
+		pattern string
+		err     error
+	}{
+		{"len/int:2,body/bin:len", Error{Code: ErrorCode(fmt.Sprintf(ErrNotRegexp, "int")), Pos: 1}},
+		{"k=,v/bin!,;", Error{Code: ErrorCode(fmt.Sprintf(ErrNotRegexp, "bin!")), Pos: 11}},
+		{"v/bin:~4,;", Error{Code: ErrorCode(fmt.Sprintf(ErrNotRegexp, "bin~4")), Pos: 10}},
+		{"v/bin:<=4,;", Error{Code: ErrorCode(fmt.Sprintf(ErrNotRegexp, "bin<=4")), Pos: 11}},
+		{"v/bin:\",;", Error{Code: ErrorCode(fmt.Sprintf(ErrNotRegexp, "bin\"")), Pos: 9}},
+	}
+	for _, tt := range errs {
+		m, err := Compile(tt.pattern)
+		if err != nil {
+			t.Fatalf("gtpm_test: got %+v, want nil", err)
+		}
+		if _, err := m.(*TextPatternMatcher).ToRegexp(); !errors.Is(err, tt.err) {
+			t.Errorf("gtpm_test: %q got %+v, want %+v", tt.pattern, err, tt.err)
+		}
+	}
+	m, err := Compile("V/bin,\r\n", WithSkipBOM())
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	want := Error{Code: ErrorCode(fmt.Sprintf(ErrNotRegexp, "bom"))}
+	if _, err := m.(*TextPatternMatcher).ToRegexp(); !errors.Is(err, want) {
+		t.Errorf("gtpm_test: got %+v, want %+v", err, want)
+	}
+}
+
+func TestMatchReaderSharedBufioReader(t *testing.T) {
+	tests := []struct {
+		pattern string
+		in      string
+		want    [][]byte
+	}{
+		{"HDR,pad/run:20,?;", "HDR  REST", [][]byte{[]byte("  "), []byte("0")}},
+		{"v/bin:2,?;;", "abREST", [][]byte{[]byte("ab"), []byte("0")}},
+		{"v/bin,\r\n", "ab\r\nREST", [][]byte{[]byte("ab")}},
+		{"v/bin:2,n/rep{,x/bin:1,},.", "ab12.REST", [][]byte{[]byte("ab"), []byte("1"), []byte("2"), []byte("2")}},
+	}
+	for _, tt := range tests {
+		m, err := Compile(tt.pattern)
+		if err != nil {
+			t.Fatalf("gtpm_test: got %+v, want nil", err)
+		}
+		br := bufio.NewReader(strings.NewReader(tt.in))
+		matched, err := m.MatchReader(br)
+		if !cmpByteSliceSlice(matched, tt.want) || err != nil {
+			t.Errorf("gtpm_test: got %q %+v, want %q nil", matched, err, tt.want)
+		}
+		if rest, err := io.ReadAll(br); string(rest) != "REST" || err != nil {
+			t.Errorf("gtpm_test: got %q %+v, want %q nil", rest, err, "REST")
+		}
+	}
+}
+
+func TestWithMaxVariableSizeBytes(t *testing.T) {
+	tests := []struct {
+		size string
+		want int
+		err  error
+	}{
+		{"1MiB", 1048576, nil},
+		{"4KiB", 4096, nil},
+		{"1GiB", 1 << 30, nil},
+		{"512B", 512, nil},
+		{"512", 512, nil},
+		{"1.5KiB", 0, &strconv.NumError{Func: "ParseUint", Num: "1.5", Err: strconv.ErrSyntax}},
+		{"-1KiB", 0, &strconv.NumError{Func: "ParseUint", Num: "-1", Err: strconv.ErrSyntax}},
+		{"KiB", 0, &strconv.NumError{Func: "ParseUint", Num: "", Err: strconv.ErrSyntax}},
+		{"4kb", 0, &strconv.NumError{Func: "ParseUint", Num: "4kb", Err: strconv.ErrSyntax}},
+		{"9223372036854775807GiB", 0, strconv.ErrRange},
+	}
+	for _, tt := range tests {
+		m, err := Compile("v/bin,;", WithMaxVariableSize(32), WithMaxVariableSizeBytes(tt.size))
+		if tt.err != nil {
+			want := Error{Code: ErrorCode(fmt.Sprintf(ErrInvalidByteSize, tt.size)), Cause: tt.err}
+			if fmt.Sprint(err) != fmt.Sprint(want) {
+				t.Errorf("gtpm_test: %s got %+v, want %+v", tt.size, err, want)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("gtpm_test: got %+v, want nil", err)
+		}
+		if got := m.(*TextPatternMatcher).maxVarSize; got != tt.want {
+			t.Errorf("gtpm_test: %s got %d, want %d", tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestGenInstVarUntilEOF(t *testing.T) {
+	tests := []struct {
+		in   string
+		want [][]byte
+		err  error
+	}{
+		{"a\r\nb\r\n", [][]byte{[]byte("a"), []byte("b")}, nil},
+		{"a\r\nb", [][]byte{[]byte("a"), []byte("b")}, nil},
+		{"a\r\nbcdefghijklmnopqrstuvwxyz", [][]byte{[]byte("a"), []byte("bcdefghijklmnopqrstuvwxyz")}, nil},
+		{"a\r\n", [][]byte{[]byte("a"), []byte("")}, nil},
+		{"a", nil, Error{Code: ErrVarNotMuch, Pos: 11, Cause: io.EOF}},
+	}
+	m, err := Compile("First/bin,\r\n,Last/bin?,\r\n")
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	for _, tt := range tests {
+		matched, err := m.MatchReader(strings.NewReader(tt.in))
+		if !cmpByteSliceSlice(matched, tt.want) || err != tt.err {
+			t.Errorf("gtpm_test: got %q %+v, want %q %+v", matched, err, tt.want, tt.err)
+		}
+	}
+	if _, err := Compile("Last/bin?:2"); err != (Error{Code: ErrParseInvalidUntilEOF, Pos: 1}) {
+		t.Errorf("gtpm_test: got %+v, want %s", err, ErrParseInvalidUntilEOF)
+	}
+}
+
+func TestMatchReaderReplay(t *testing.T) {
+	tests := []struct {
+		in    string
+		want  [][]byte
+		frame string
+		err   error
+	}{
+		{"GET index HTTP\r\nnext", [][]byte{[]byte("index")}, "GET index HTTP\r\n", nil},
+		{"GET index FTP\r\n", nil, "GET index FTP\r\n", Error{Code: ErrConstNotMuch, Pos: 17, Cause: io.EOF}},
+	}
+	m, err := Compile("GET ,Path/bin, ,HTTP\r\n")
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	for _, tt := range tests {
+		matched, frame, err := m.(*TextPatternMatcher).MatchReaderReplay(strings.NewReader(tt.in))
+		if !cmpByteSliceSlice(matched, tt.want) || err != tt.err {
+			t.Errorf("gtpm_test: got %q %+v, want %q %+v", matched, err, tt.want, tt.err)
+		}
+		if got, err := io.ReadAll(frame); string(got) != tt.frame || err != nil {
+			t.Errorf("gtpm_test: got %q %+v, want %q nil", got, err, tt.frame)
+		}
+	}
+}
+
+func TestKeyValuePairs(t *testing.T) {
+	tests := []struct {
+		pattern string
+		in      string
+		want    [][]byte
+		err     error
+	}{
+		{"Q/kv:=&", "a=1&b=2", [][]byte{[]byte("a"), []byte("1"), []byte("b"), []byte("2"), []byte("2")}, nil},
+		{"Q/kv:=&", "", [][]byte{[]byte("0")}, nil},
+		{"Q/kv:=&", "a=&b=", [][]byte{[]byte("a"), []byte(""), []byte("b"), []byte(""), []byte("2")}, nil},
+		{"Q/kv:=;,\r\n,Tail/bin:2", "a=1;bc=23\r\nxy", [][]byte{[]byte("a"), []byte("1"), []byte("bc"), []byte("23"), []byte("2"), []byte("xy")}, nil},
+		{"Q/kv:=;,\r\n,Tail/bin:2", "a=1;\r\nxy", [][]byte{[]byte("a"), []byte("1"), []byte("1"), []byte("xy")}, nil},
+		{"Q/kv:=;,\r\n,Tail/bin:2", "\r\nxy", [][]byte{[]byte("0"), []byte("xy")}, nil},
+		{"Q/kv:=;,\r\n", "a=1;b=2", nil, Error{Code: ErrConstNotMuch, Pos: 9, Cause: io.EOF}},
+	}
+	for _, tt := range tests {
+		m, err := Compile(tt.pattern)
+		if err != nil {
+			t.Fatalf("gtpm_test: got %+v, want nil", err)
+		}
+		matched, err := m.MatchReader(strings.NewReader(tt.in))
+		if !cmpByteSliceSlice(matched, tt.want) || err != tt.err {
+			t.Errorf("gtpm_test: %q got %q %+v, want %q %+v", tt.in, matched, err, tt.want, tt.err)
+		}
+	}
+	for _, pattern := range []string{"Q/kv", "Q/kv:=", "Q/kv:==", "Q/kv:=&;"} {
+		if _, err := Compile(pattern); err != (Error{Code: ErrParseInvalidSeparators, Pos: 1}) {
+			t.Errorf("gtpm_test: got %+v, want %s", err, ErrParseInvalidSeparators)
+		}
+	}
+}
+
+func TestWithFoldedSkips(t *testing.T) {
+	pattern := "A,_:2,_:3,B/bin:1,_:1,_:1,Len/int:1,_:Len,_:1"
+	folded, err := Compile(pattern, WithFoldedSkips())
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	var got []string
+	for _, inst := range folded.(*TextPatternMatcher).instSlice {
+		got = append(got, fmt.Sprintf("%s:%d", inst.kind, inst.min))
+	}
+	if want := []string{"const:1", "blind:5", "bin:1", "blind:2", "int:1", "blind:0", "blind:1"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("gtpm_test: got %v, want %v", got, want)
+	}
+	plain, err := Compile(pattern)
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	for _, in := range []string{"A12345b..2xx.", "A12345b..0.", "A12345b..3xx", "A1234", "Ax"} {
+		want, wantErr := plain.MatchReader(strings.NewReader(in))
+		got, gotErr := folded.MatchReader(strings.NewReader(in))
+		// the folded skip reports errors at the position of the first one
+		var ge, we Error
+		if !cmpByteSliceSlice(got, want) || errors.As(gotErr, &ge) != errors.As(wantErr, &we) || ge.Code != we.Code {
+			t.Errorf("gtpm_test: %q got %q %+v, want %q %+v", in, got, gotErr, want, wantErr)
+		}
+	}
+}
+
+func TestGenInstVarHex(t *testing.T) {
+	tests := []struct {
+		pattern string
+		in      string
+		want    [][]byte
+		err     error
+	}{
+		{"ID/hex:4,;", "0a1B2c3d;", [][]byte{{0x0a, 0x1b, 0x2c, 0x3d}}, nil},
+		{"ID/hex:0,;", ";", [][]byte{{}}, nil},
+		{"N/int:1,ID/hex:N", "2ffee", [][]byte{[]byte("2"), {0xff, 0xee}}, nil},
+		{"ID/hex:4,;", "0a1b2c3;", nil, Error{Code: ErrVarNotMuch, Pos: 1, Cause: hex.InvalidByteError(';')}},
+		{"ID/hex:4,;", "0a1b2c3", nil, Error{Code: ErrVarNotMuch, Pos: 1, Cause: io.EOF}},
+		{"ID/hex:4,;", "0a1b2c3g;", nil, Error{Code: ErrVarNotMuch, Pos: 1, Cause: hex.InvalidByteError('g')}},
+	}
+	for _, tt := range tests {
+		m, err := Compile(tt.pattern)
+		if err != nil {
+			t.Fatalf("gtpm_test: got %+v, want nil", err)
+		}
+		matched, err := m.MatchReader(strings.NewReader(tt.in))
+		if !cmpByteSliceSlice(matched, tt.want) || err != tt.err {
+			t.Errorf("gtpm_test: %q got %q %+v, want %q %+v", tt.in, matched, err, tt.want, tt.err)
+		}
+	}
+	if _, err := Compile("ID/hex"); err != (Error{Code: ErrParseColonExpected, Pos: 1}) {
+		t.Errorf("gtpm_test: got %+v, want %s", err, ErrParseColonExpected)
+	}
+}
+
+func TestMatchReaderConcurrently(t *testing.T) {
+	m, _ := Compile("N/int,\r\n,V/bin:N")
+	var wg sync.WaitGroup
+	for i := 1; i <= 16; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			v := bytes.Repeat([]byte("a"), n)
+			read := append([]byte(strconv.Itoa(n)+"\r\n"), v...)
+			for j := 0; j < 100; j++ {
+				matched, err := m.MatchReader(bytes.NewReader(read))
+				if err != nil || !bytes.Equal(matched[1], v) {
+					t.Errorf("gtpm_test: got %#v %+v, want %q", matched, err, v)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestWithSkipBOM(t *testing.T) {
+	m, err := Compile("V/bin,\r\n", WithSkipBOM())
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	for _, read := range []string{"\xEF\xBB\xBFfoo\r\n", "foo\r\n"} {
+		matched, err := m.MatchReader(bytes.NewReader([]byte(read)))
+		if !cmpByteSliceSlice(matched, [][]byte{[]byte("foo")}) || err != nil {
+			t.Errorf("gtpm_test: got %#v %+v, want [foo] nil", matched, err)
+		}
+	}
+}
+
+func TestWithHexInput(t *testing.T) {
+	m, err := Compile("\xca\xfe,Len/int:1,V/bin:Len,\r\n", WithHexInput(), WithBinaryIntFallback())
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	for _, c := range []struct {
+		read string
+		want [][]byte
+		err  error
+	}{
+		{
+			read: "ca fe 04\nde ad be ef\n0d 0a\n",
+			want: [][]byte{[]byte{0x04}, []byte{0xde, 0xad, 0xbe, 0xef}},
+			err:  nil,
+		},
+		{
+			read: "CAFE02BEEF0D0A",
+			want: [][]byte{[]byte{0x02}, []byte{0xbe, 0xef}},
+			err:  nil,
+		},
+		{
+			read: "ca fe 02 be eg",
+			want: nil,
+			err:  Error{Code: ErrVarNotMuch, Pos: 14, Cause: hex.InvalidByteError('g')},
+		},
+		{
+			read: "ca fe 02 be e",
+			want: nil,
+			err:  Error{Code: ErrVarNotMuch, Pos: 14, Cause: io.ErrUnexpectedEOF},
+		},
+	} {
+		matched, err := m.MatchReader(bytes.NewReader([]byte(c.read)))
+		if !cmpByteSliceSlice(matched, c.want) || err != c.err {
+			t.Errorf("gtpm_test: got %#v %+v, want %#v %+v", matched, err, c.want, c.err)
+		}
+	}
+}
+
+func TestMarshalResults(t *testing.T) {
+	tests := []struct {
+		captures [][]byte
+	}{
+		{
+			captures: [][]byte{[]byte("GET"), []byte("/index.html"), {}, bytes.Repeat([]byte("a"), 300)},
+		},
+		{
+			captures: [][]byte{},
+		},
+	}
+	for _, test := range tests {
+		data := MarshalResults(test.captures)
+		got, err := UnmarshalResults(data)
+		if !cmpByteSliceSlice(got, test.captures) || err != nil {
+			t.Errorf("gtpm_test: got %#v %+v, want %#v nil", got, err, test.captures)
+		}
+		for i := 1; i < len(data); i++ {
+			if _, err := UnmarshalResults(data[:i]); !checkError(err, Error{Code: ErrResultsInvalid}) {
+				t.Errorf("gtpm_test: got %+v, want %+v", err, Error{Code: ErrResultsInvalid})
+			}
+		}
+	}
+}
+
+func TestMarshalSpec(t *testing.T) {
+	m, err := Compile("Key/bin,:,N/int,\r\n,L/rep{,V/bin:N,},\r\n,Key", WithMaxVariableSize(16), WithEOFOnEmpty())
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	data, err := m.(*TextPatternMatcher).MarshalSpec()
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	var reloaded TextPatternMatcher
+	if err := reloaded.UnmarshalSpec(data); err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	if again, _ := reloaded.MarshalSpec(); !bytes.Equal(again, data) {
+		t.Errorf("gtpm_test: got %s, want %s", again, data)
+	}
+	if got, want := reloaded.MinInputLen(), m.(*TextPatternMatcher).MinInputLen(); got != want {
+		t.Errorf("gtpm_test: got %d, want %d", got, want)
+	}
+	for _, read := range []string{"foo:2\r\nabcd\r\nfoo", "foo:3\r\nabc\r\nfoo", "foo:2\r\nab\r\nbar", ""} {
+		want, werr := m.MatchReader(bytes.NewReader([]byte(read)))
+		got, gerr := reloaded.MatchReader(bytes.NewReader([]byte(read)))
+		if !cmpByteSliceSlice(got, want) || gerr != werr {
+			t.Errorf("gtpm_test: got %#v %+v, want %#v %+v", got, gerr, want, werr)
+		}
+	}
+
+	tampered := bytes.Replace(data, []byte(`"kind":"bin"`), []byte(`"kind":"int"`), 1)
+	if err := new(TextPatternMatcher).UnmarshalSpec(tampered); err != (Error{Code: ErrSpecInstMismatch, Pos: 9}) {
+		t.Errorf("gtpm_test: got %+v, want %+v", err, Error{Code: ErrSpecInstMismatch, Pos: 9})
+	}
+	versioned := bytes.Replace(data, []byte(`"version":1`), []byte(`"version":2`), 1)
+	if err := new(TextPatternMatcher).UnmarshalSpec(versioned); err != (Error{Code: ErrorCode(fmt.Sprintf(ErrSpecVersion, 2))}) {
+		t.Errorf("gtpm_test: got %+v, want %s", err, fmt.Sprintf(ErrSpecVersion, 2))
+	}
+}
+
+func TestMarshalSpecExternalInts(t *testing.T) {
+	m, err := Compile("V/bin:N", WithExternalInts("N"))
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	data, err := m.(*TextPatternMatcher).MarshalSpec()
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	var reloaded TextPatternMatcher
+	if err := reloaded.UnmarshalSpec(data); err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	got, err := reloaded.MatchReaderWithInts(bytes.NewReader([]byte("abcd")), map[string]int{"N": 2})
+	if want := [][]byte{[]byte("ab")}; err != nil || !cmpByteSliceSlice(got, want) {
+		t.Errorf("gtpm_test: got %#v %+v, want %#v nil", got, err, want)
+	}
+}
+
+func TestWithCaptureTransform(t *testing.T) {
+	errNotASCII := errors.New("not ascii")
+	transform := func(name string, b []byte) ([]byte, error) {
+		if name != "Method" {
+			return b, nil
+		}
+		for _, c := range b {
+			if c >= 0x80 {
+				return nil, errNotASCII
+			}
+		}
+		return bytes.ToUpper(b), nil
+	}
+	m, err := Compile("Method/bin, ,Path/bin,\r\n", WithCaptureTransform(transform))
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	matched, err := m.MatchReader(bytes.NewReader([]byte("get /index\r\n")))
+	if want := [][]byte{[]byte("GET"), []byte("/index")}; !cmpByteSliceSlice(matched, want) || err != nil {
+		t.Errorf("gtpm_test: got %#v %+v, want %#v nil", matched, err, want)
+	}
+	matched, err = m.MatchReader(bytes.NewReader([]byte("g\xe9t /index\r\n")))
+	if want := (Error{Code: ErrCaptureTransform, Pos: 12, Cause: errNotASCII}); matched != nil || err != want {
+		t.Errorf("gtpm_test: got %#v %+v, want nil %+v", matched, err, want)
+	}
+}
+
+func TestWithSkipEmptyCaptures(t *testing.T) {
+	const pattern = "N/int:1,V/bin:N,W/bin:3"
+	matched, err := Match(pattern, bytes.NewReader([]byte("0foo")))
+	if err != nil || len(matched) != 3 || matched[1] == nil || len(matched[1]) != 0 {
+		t.Errorf("gtpm_test: got %#v %+v, want [0 {} foo] nil", matched, err)
+	}
+	matched, err = Match(pattern, bytes.NewReader([]byte("0foo")), WithSkipEmptyCaptures())
+	if want := [][]byte{[]byte("0"), []byte("foo")}; !cmpByteSliceSlice(matched, want) || err != nil {
+		t.Errorf("gtpm_test: got %#v %+v, want %#v nil", matched, err, want)
+	}
+}
+
+func TestWithMaxCaptures(t *testing.T) {
+	r := bytes.NewReader([]byte("route:3\r\nfoo"))
+	matched, err := Match("Key/bin,:,N/int,\r\n,V/bin:N", r, WithMaxCaptures(1))
+	if want := [][]byte{[]byte("route")}; !cmpByteSliceSlice(matched, want) || err != nil {
+		t.Errorf("gtpm_test: got %#v %+v, want %#v nil", matched, err, want)
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != "3\r\nfoo" {
+		t.Errorf("gtpm_test: got rest %q, want %q", rest, "3\r\nfoo")
+	}
+}
+
+func TestWithBufferAllocator(t *testing.T) {
+	var sizes []int
+	alloc := func(size int) []byte {
+		sizes = append(sizes, size)
+		return make([]byte, 0, size)
+	}
+	m, err := Compile("N/int:1,V/bin:N,_:2,W/bin:3", WithBufferAllocator(alloc))
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	matched, err := m.MatchReader(bytes.NewReader([]byte("5hello..foo")))
+	if want := [][]byte{[]byte("5"), []byte("hello"), []byte("foo")}; !cmpByteSliceSlice(matched, want) || err != nil {
+		t.Errorf("gtpm_test: got %#v %+v, want %#v nil", matched, err, want)
+	}
+	if want := []int{1, 5, 2, 3}; fmt.Sprint(sizes) != fmt.Sprint(want) {
+		t.Errorf("gtpm_test: got %v, want %v", sizes, want)
+	}
+}
+
+func TestWithPackedCaptures(t *testing.T) {
+	m, err := Compile("N/int:1,V/bin:N,_:2,W/bin:3", WithPackedCaptures())
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	matched, err := m.MatchReader(bytes.NewReader([]byte("5hello..foo")))
+	if want := [][]byte{[]byte("5"), []byte("hello"), []byte("foo")}; !cmpByteSliceSlice(matched, want) || err != nil {
+		t.Fatalf("gtpm_test: got %#v %+v, want %#v nil", matched, err, want)
+	}
+	for i := 1; i < len(matched); i++ {
+		prev := matched[i-1]
+		if uintptr(unsafe.Pointer(&prev[0]))+uintptr(len(prev)) != uintptr(unsafe.Pointer(&matched[i][0])) {
+			t.Errorf("gtpm_test: got capture %d not adjacent to capture %d, want adjacent", i, i-1)
+		}
+		if cap(prev) != len(prev) {
+			t.Errorf("gtpm_test: got cap %d, want %d", cap(prev), len(prev))
+		}
+	}
+}
+
+func BenchmarkPackedCaptures(b *testing.B) {
+	const pattern = "A/bin:2,B/bin:2,C/bin:2,D/bin:2,E/bin:2,F/bin:2,G/bin:2,H/bin:2,I/bin:2,J/bin:2"
+	read := bytes.Repeat([]byte("ab"), 10)
+	for _, tt := range []struct {
+		name string
+		opts []Option
+	}{
+		{"default", nil},
+		{"packed", []Option{WithPackedCaptures()}},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			m, _ := Compile(pattern, tt.opts...)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := m.MatchReader(bytes.NewReader(read)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestScanner(t *testing.T) {
+	m, err := Compile("$,Len/int,:,V/bin:Len,\n")
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	const read = "$3:foo\n$x:zzz\n$3:bar\n$4:buzz\n"
+	tests := []struct {
+		marker []byte
+		want   [][][]byte
+		err    bool
+	}{
+		{
+			marker: nil,
+			want:   [][][]byte{{[]byte("3"), []byte("foo")}},
+			err:    true,
+		},
+		{
+			marker: []byte("$"),
+			want:   [][][]byte{{[]byte("3"), []byte("foo")}, {[]byte("3"), []byte("bar")}, {[]byte("4"), []byte("buzz")}},
+			err:    false,
+		},
+	}
+	for _, test := range tests {
+		sc := NewScanner(bytes.NewReader([]byte(read)), m.(*TextPatternMatcher))
+		if test.marker != nil {
+			sc.Resync(test.marker)
+		}
+		var got [][][]byte
+		for sc.Scan() {
+			got = append(got, sc.Record())
+		}
+		if len(got) != len(test.want) {
+			t.Fatalf("gtpm_test: got %d records, want %d", len(got), len(test.want))
+		}
+		for i := range got {
+			if !cmpByteSliceSlice(got[i], test.want[i]) {
+				t.Errorf("gtpm_test: got %#v, want %#v", got[i], test.want[i])
+			}
+		}
+		if (sc.Err() != nil) != test.err {
+			t.Errorf("gtpm_test: got %+v, want error %v", sc.Err(), test.err)
+		}
+	}
+}
+
+func TestScannerResyncNothingRead(t *testing.T) {
+	failure := errors.New("failure")
+	m, err := Compile("$,V/bin:2")
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	sc := NewScanner(&errReader{err: failure}, m.(*TextPatternMatcher))
+	sc.Resync([]byte("$"))
+	if sc.Scan() {
+		t.Errorf("gtpm_test: got true, want false")
+	}
+	if err := sc.Err(); !errors.Is(err, failure) {
+		t.Errorf("gtpm_test: got %+v, want %v", err, failure)
+	}
+
+	m, err = Compile("V/bin:T[1=4]", WithExternalInts("T"))
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	sc = NewScanner(strings.NewReader("$abcd$efgh"), m.(*TextPatternMatcher))
+	sc.Resync([]byte("$"))
+	if sc.Scan() {
+		t.Errorf("gtpm_test: got true, want false")
+	}
+	if want := (Error{Code: ErrorCode(fmt.Sprintf(ErrSizeNotFound, 0)), Pos: 1}); sc.Err() != want {
+		t.Errorf("gtpm_test: got %+v, want %+v", sc.Err(), want)
+	}
+}
+
+func TestWithRecordSeparator(t *testing.T) {
+	m, err := Compile("K/bin,=,V/bin:3", WithRecordSeparator([]byte{0x1e}))
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	tests := []struct {
+		read string
+		want [][][]byte
+		err  error
+	}{
+		{
+			read: "a=foo\x1eb=bar",
+			want: [][][]byte{{[]byte("a"), []byte("foo")}, {[]byte("b"), []byte("bar")}},
+			err:  nil,
+		},
+		{
+			read: "a=foo\x1eb=bar\x1e",
+			want: [][][]byte{{[]byte("a"), []byte("foo")}, {[]byte("b"), []byte("bar")}},
+			err:  nil,
+		},
+		{
+			read: "a=foob=bar",
+			want: [][][]byte{{[]byte("a"), []byte("foo")}},
+			err:  Error{Code: ErrSeparatorNotMuch},
+		},
+	}
+	for _, test := range tests {
+		sc := NewScanner(strings.NewReader(test.read), m.(*TextPatternMatcher))
+		var got [][][]byte
+		for sc.Scan() {
+			got = append(got, sc.Record())
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) || !checkError(sc.Err(), test.err) {
+			t.Errorf("gtpm_test: got %q %+v, want %q %+v", got, sc.Err(), test.want, test.err)
+		}
+	}
+}
+
+type zeroReader struct {
+	reads int
+}
+
+func (r *zeroReader) Read(p []byte) (int, error) {
+	r.reads++
+	return 0, nil
+}
+
+func TestWithMaxZeroReads(t *testing.T) {
+	r := &zeroReader{}
+	_, err := Match("foo,V/bin,\r\n", r, WithMaxZeroReads(100))
+	if want := (Error{Code: ErrNoProgress, Pos: 1, Cause: io.ErrNoProgress}); err != want {
+		t.Errorf("gtpm_test: got %+v, want %+v", err, want)
+	}
+	if r.reads != 100 {
+		t.Errorf("gtpm_test: got %d reads, want 100", r.reads)
+	}
+}
+
+func TestWithIntDigits(t *testing.T) {
+	tests := []struct {
+		digits  string
+		pattern string
+		read    string
+		want    int
+		err     bool
+	}{
+		{
+			digits:  "0-9a-z",
+			pattern: "N/int:1",
+			read:    "z",
+			want:    35,
+		},
+		{
+			digits:  "0-9a-z",
+			pattern: "N/int,;",
+			read:    "-10;",
+			want:    -36,
+		},
+		{
+			digits:  "01",
+			pattern: "N/int,;",
+			read:    "1011;",
+			want:    11,
+		},
+		{
+			digits:  "01",
+			pattern: "N/int,;",
+			read:    "12;",
+			err:     true,
+		},
+		{
+			digits:  "0-9a-z",
+			pattern: "=/int:42,N/int:1",
+			read:    "42z",
+			want:    35,
+		},
+		{
+			digits:  "0-9a-z",
+			pattern: "=/int:zz,N/int:1",
+			read:    "zz1",
+			want:    1,
+		},
+		{
+			digits:  "0-9a-z",
+			pattern: "=/int:42,N/int:1",
+			read:    "43z",
+			err:     true,
+		},
+	}
+	for _, test := range tests {
+		m, err := Compile(test.pattern, WithIntDigits(test.digits))
+		if err != nil {
+			t.Fatalf("gtpm_test: got %+v, want nil", err)
+		}
+		_, ints, err := m.(*TextPatternMatcher).MatchReaderInts(bytes.NewReader([]byte(test.read)))
+		if test.err {
+			if err == nil {
+				t.Errorf("gtpm_test: %q got nil, want error", test.read)
+			}
+			continue
+		}
+		if err != nil || len(ints["N"]) != 1 || ints["N"][0] != test.want {
+			t.Errorf("gtpm_test: %q got %v %+v, want %d nil", test.read, ints["N"], err, test.want)
+		}
+	}
+}
+
+func TestFixed(t *testing.T) {
+	tests := []struct {
+		read  string
+		x     int
+		frac  int
+		scale string
+		err   bool
+	}{
+		{read: "12.34;ab", x: 12, frac: 34, scale: "ab"},
+		{read: "-0.5;ab", x: 0, frac: -5, scale: "a"},
+		{read: "-12.34;ab", x: -12, frac: -34, scale: "ab"},
+		{read: "1.05;ab", x: 1, frac: 5, scale: "ab"},
+		{read: "1.5;ab", x: 1, frac: 5, scale: "a"},
+		{read: "12.-5;ab", err: true},
+		{read: "12.+5;ab", err: true},
+	}
+	m, err := Compile("X/fixed:.,;,S/bin:X.scale")
+	if err != nil {
+		t.Fatalf("gtpm_test: got %+v, want nil", err)
+	}
+	for _, test := range tests {
+		matched, ints, err := m.(*TextPatternMatcher).MatchReaderInts(bytes.NewReader([]byte(test.read)))
+		if test.err {
+			if err == nil {
+				t.Errorf("gtpm_test: %q got nil, want error", test.read)
+			}
+			continue
+		}
+		if err != nil || ints["X"][0] != test.x || ints["X.frac"][0] != test.frac || string(matched[len(matched)-1]) != test.scale {
+			t.Errorf("gtpm_test: %q got %v %q %+v, want %d %d %q nil", test.read, ints, matched, err, test.x, test.frac, test.scale)
+		}
+	}
+}
+func TestWithSingleRecord(t *testing.T) {
+	const pattern = "MAGIC,Ver/int:1,\n,Body/bin:rest"
+	matched, err := Match(pattern, bytes.NewReader([]byte("MAGIC1\nline 1\nline 2\n")), WithSingleRecord())
+	if want := [][]byte{[]byte("1"), []byte("line 1\nline 2\n")}; !cmpByteSliceSlice(matched, want) || err != nil {
+		t.Errorf("gtpm_test: got %#v %+v, want %#v nil", matched, err, want)
+	}
+	_, err = Match("MAGIC,Ver/int:1,\n", bytes.NewReader([]byte("MAGIC1\ntrailing")), WithSingleRecord())
+	if want := (Error{Code: ErrNotEOF, Pos: 18}); err != want {
+		t.Errorf("gtpm_test: got %+v, want %+v", err, want)
+	}
+	if _, err = Match("MAGIC,Ver/int:1,\n", bytes.NewReader([]byte("MAGIC1\ntrailing"))); err != nil {
+		t.Errorf("gtpm_test: got %+v, want nil", err)
+	}
+}
+
+func TestAll(t *testing.T) {
+	m, _ := Compile("Key/bin,:,N/int,\r\n,V/bin:N")
+	r := bytes.NewReader([]byte("route:3\r\nfoo"))
+	var got [][]byte
+	for buf, err := range m.(*TextPatternMatcher).All(r) {
+		if err != nil {
+			t.Fatalf("gtpm_test: got %+v, want nil", err)
+		}
+		got = append(got, buf)
+		if string(buf) == "route" {
+			break
+		}
+	}
+	if !cmpByteSliceSlice(got, [][]byte{[]byte("route")}) {
+		t.Errorf("gtpm_test: got %#v, want [route]", got)
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != "3\r\nfoo" {
+		t.Errorf("gtpm_test: got rest %q, want %q", rest, "3\r\nfoo")
+	}
+
+	got = nil
+	var errs []error
+	for buf, err := range m.(*TextPatternMatcher).All(bytes.NewReader([]byte("route:3\r\nfo"))) {
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		got = append(got, buf)
+	}
+	want := []error{Error{Code: ErrVarNotMuch, Pos: 20, Cause: io.EOF}}
+	if len(got) != 2 || len(errs) != 1 || errs[0] != want[0] {
+		t.Errorf("gtpm_test: got %#v %+v, want 2 captures %+v", got, errs, want)
+	}
+}